@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MaxHotKeys is the most keys HotKeys will return.
+	MaxHotKeys = 100
+	// hotKeysRefresh is how stale the HotKeys ranking may get before a call
+	// recomputes it.
+	hotKeysRefresh = time.Second
+)
+
+var ErrAccessTrackingDisabled = errors.New("access tracking is not enabled")
+
+// keyAccess is updated atomically, so reads can record an access while only
+// holding their shard's read lock.
+type keyAccess struct {
+	hits atomic.Uint64
+	last atomic.Int64 // unix nanoseconds
+}
+
+func (a *keyAccess) record(now time.Time) {
+	a.hits.Add(1)
+	a.last.Store(now.UnixNano())
+}
+
+// KeyAccess is a key's read count and last read time.
+type KeyAccess struct {
+	Key        string    `json:"key"`
+	Hits       uint64    `json:"hits"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+type hotKeys struct {
+	mu       sync.Mutex
+	computed time.Time
+	ranking  []KeyAccess // most hits first, at most MaxHotKeys
+}
+
+// recordAccess notes a successful read of key. Callers must hold s.lock.
+func (s *shard) recordAccess(key string) {
+	if s.access == nil {
+		return
+	}
+	if a, ok := s.access[key]; ok {
+		a.record(time.Now())
+	}
+}
+
+// recordTouch notes that key was touched: it counts as recently used, but not
+// as a read. Callers must hold s.lock.
+func (s *shard) recordTouch(key string, now time.Time) {
+	if s.access == nil {
+		return
+	}
+	if a, ok := s.access[key]; ok {
+		a.last.Store(now.UnixNano())
+	}
+}
+
+type accessHeap []KeyAccess // min-heap on hits
+
+func (h accessHeap) Len() int           { return len(h) }
+func (h accessHeap) Less(i, j int) bool { return h[i].Hits < h[j].Hits }
+func (h accessHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *accessHeap) Push(x any)        { *h = append(*h, x.(KeyAccess)) }
+func (h *accessHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// HotKeys returns up to n of the most read keys, most hits first. The
+// ranking is recomputed at most once every hotKeysRefresh, so it may lag
+// slightly behind the live counts.
+func (c *Cache) HotKeys(n int) ([]KeyAccess, error) {
+	if !c.trackAccess {
+		return nil, ErrAccessTrackingDisabled
+	}
+	n = min(max(n, 0), MaxHotKeys)
+
+	c.hot.mu.Lock()
+	defer c.hot.mu.Unlock()
+	if time.Since(c.hot.computed) >= hotKeysRefresh {
+		c.hot.ranking = c.rankAccess()
+		c.hot.computed = time.Now()
+	}
+	return c.hot.ranking[:min(n, len(c.hot.ranking))], nil
+}
+
+// rankAccess finds the MaxHotKeys most read keys with a bounded heap rather
+// than sorting the whole keyspace.
+func (c *Cache) rankAccess() []KeyAccess {
+	h := make(accessHeap, 0, MaxHotKeys)
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		for k, a := range sh.access {
+			hits := a.hits.Load()
+			if hits == 0 || (len(h) == MaxHotKeys && hits <= h[0].Hits) {
+				continue
+			}
+			e := KeyAccess{Key: k, Hits: hits, LastAccess: time.Unix(0, a.last.Load())}
+			if len(h) < MaxHotKeys {
+				heap.Push(&h, e)
+			} else {
+				h[0] = e
+				heap.Fix(&h, 0)
+			}
+		}
+		sh.lock.RUnlock()
+	}
+
+	sort.Slice(h, func(i, j int) bool { return h[i].Hits > h[j].Hits })
+	return h
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Append adds value to the end of key's value, creating the key if it
+// doesn't exist or has expired, and returns the new length. The key keeps its
+// expiry; one it creates never expires.
+func (c *Cache) Append(key, value []byte) (int, error) {
+	val, _, err := c.appendValue(key, value)
+	return len(val), err
+}
+
+// appendValue does Append and returns the key's new value and remaining TTL.
+func (c *Cache) appendValue(key, value []byte) ([]byte, time.Duration, error) {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	now := time.Now()
+	live := sh.live(strKey, now)
+	var old []byte
+	var ttl time.Duration
+	if live {
+		old, _ = sh.value(strKey)
+		if exp, ok := sh.expiry[strKey]; ok {
+			ttl = exp.Sub(now)
+		}
+	}
+	// Readers may still hold the old value, so it is never appended to in
+	// place.
+	val := slices.Concat(old, value)
+	if err := c.checkSize(strKey, val); err != nil {
+		sh.lock.Unlock()
+		return nil, 0, err
+	}
+	if !live {
+		sh.setTTL(strKey, 0, now)
+	}
+	c.put(sh, strKey, val, 0)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+	sh.lock.Unlock()
+
+	c.logger.Debug("APPEND", "key", strKey, c.valueAttr(value), "len", len(val))
+	c.evictForMemory()
+	return val, ttl, nil
+}
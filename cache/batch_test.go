@@ -0,0 +1,53 @@
+package cache
+
+import "testing"
+
+func TestBatchSetEmpty(t *testing.T) {
+	for _, c := range []*Cache{NewCache(), NewCache(WithAtomicBatches())} {
+		if err := c.Set([]byte("k"), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+		before := *c.Metrics()
+		for _, pairs := range []map[string][]byte{nil, {}} {
+			if err := c.BatchSet(pairs, 0); err != nil {
+				t.Fatalf("BatchSet(%#v) = %v, want nil", pairs, err)
+			}
+		}
+		if after := *c.Metrics(); after != before {
+			t.Fatalf("an empty batch changed the metrics from %+v to %+v", before, after)
+		}
+		if got, err := c.Get([]byte("k")); err != nil || string(got) != "v" {
+			t.Fatalf("Get(k) = %q, %v after an empty batch; want %q", got, err, "v")
+		}
+	}
+}
+
+// TestBatchSetRepeatedKey writes a key that is already set. A map can't
+// hold a key twice, so this is how one shows up more than once: the batch
+// replaces it, and it is still counted once.
+func TestBatchSetRepeatedKey(t *testing.T) {
+	c := NewCache()
+	if err := c.Set([]byte("a"), []byte("old value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BatchSet(map[string][]byte{"a": []byte("new"), "b": []byte("2")}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BatchSet(map[string][]byte{"a": []byte("newer")}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := c.Get([]byte("a")); err != nil || string(got) != "newer" {
+		t.Fatalf("Get(a) = %q, %v; want %q", got, err, "newer")
+	}
+	if n := c.DBSize(); n != 2 {
+		t.Fatalf("DBSize = %d, want 2", n)
+	}
+	// The replaced values' bytes must be given back.
+	want := NewCache()
+	want.Set([]byte("a"), []byte("newer"), 0)
+	want.Set([]byte("b"), []byte("2"), 0)
+	if got, want := c.Metrics().ApproxMemoryBytes, want.Metrics().ApproxMemoryBytes; got != want {
+		t.Fatalf("ApproxMemoryBytes = %d, want %d", got, want)
+	}
+}
@@ -1,151 +1,566 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Cache struct {
-	lock    sync.RWMutex
-	data    map[string][]byte
-	expiry  map[string]time.Time
+	shards  []*shard
 	metrics *CacheMetrics
+	size    int64  // approximate bytes held by keys and values, read atomically
+	changes uint64 // writes ever made, read atomically
+	version uint64 // last key version handed out, read atomically
+
+	evictMu   sync.Mutex // guards creating evictions
+	evictions atomic.Pointer[evictDispatcher]
+
+	atomicBatches bool
+	logger        *slog.Logger
+	logValues     bool
+
+	maxBytes       int64 // 0 for no limit; atomic, since SetMaxBytes changes it
+	maxKeyBytes    int   // 0 for no limit
+	maxValueBytes  int   // 0 for no limit
+	evictionPolicy EvictionPolicy
+	policy         policy // nil unless maxBytes is set
+
+	trackAccess bool
+	hot         hotKeys
+
+	negativeTTL time.Duration // 0 unless WithNegativeCaching was given
+	sliding     bool
+	slideHooks  atomic.Pointer[[]SlideFunc]
+
+	filter *missFilter // nil unless WithMissFilter was given
+
+	compressAbove int   // 0 unless WithValueCompression was given
+	saved         int64 // bytes compression saves across every stored value; atomic
+
+	loader  atomic.Pointer[Loader] // nil unless WithLoader or SetLoader was given
+	flights flights
+
+	janitor janitor
 }
 
+// CacheMetrics counters are updated atomically, so they may be bumped while
+// only a read lock is held.
 type CacheMetrics struct {
 	Hits    uint64
 	Misses  uint64
 	Sets    uint64
 	Deletes uint64
+
+	ExpiredKeys       uint64 `json:"expiredKeys"`
+	EvictedKeys       uint64 `json:"evictedKeys"`
+	KeyCount          int    `json:"keyCount"`
+	DBSize            int    `json:"dbSize"` // live keys, as DBSIZE reports; the same as KeyCount
+	ApproxMemoryBytes int64  `json:"approxMemoryBytes"`
+	MaxBytes          int64  `json:"maxBytes,omitempty"`
+	NegativeHits      uint64 `json:"negativeHits"`             // reads of keys marked with MarkAbsent
+	MissFilterHits    uint64 `json:"missFilterHits"`           // misses answered by WithMissFilter, also counted in Misses
+	RejectedSets      uint64 `json:"rejectedSets"`             // writes over a size limit
+	DeleteMisses      uint64 `json:"deleteMisses"`             // deletes of keys that didn't exist
+	Loads             uint64 `json:"loads"`                    // misses answered by the Loader
+	LoadErrors        uint64 `json:"loadErrors"`               // Loads that failed
+	CompressionSaved  int64  `json:"compressionSavedBytes"`    // how much smaller compressed values are than as set
+	ChecksumFailures  uint64 `json:"checksumFailures"`         // reads refused because the value didn't match its checksum
+	EvictionPolicy    string `json:"evictionPolicy,omitempty"` // only with MaxBytes
+}
+
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// put stores value under key in sh, compressed if it should be, keeping the
+// size accounting in step, and returns the key's new version: version itself
+// if non-zero, otherwise the next one. Callers must hold sh.lock for writing.
+func (c *Cache) put(sh *shard, key string, value []byte, version uint64) uint64 {
+	if sh.sums != nil {
+		sh.sums[key] = sum(value)
+	}
+	value, n := c.pack(value)
+	delta := entrySize(key, value)
+	old, existed := sh.data[key]
+	c.addSaved(-sh.savedBytes(key))
+	if n > 0 {
+		sh.packed[key] = n
+		c.addSaved(int64(n - len(value)))
+	} else {
+		delete(sh.packed, key)
+	}
+	if existed {
+		delta -= entrySize(key, old)
+	} else {
+		c.filter.add(key)
+		sh.created[key] = time.Now()
+		if sh.access != nil {
+			sh.access[key] = &keyAccess{}
+		}
+	}
+	sh.data[key] = value
+	delete(sh.absent, key)
+	if version == 0 {
+		version = c.nextVersion()
+	} else {
+		c.observeVersion(version)
+	}
+	sh.version[key] = version
+	atomic.AddInt64(&c.size, delta)
+	atomic.AddUint64(&c.changes, 1)
+	switch {
+	case c.policy == nil:
+	case existed:
+		c.policy.use(key)
+	default:
+		c.policy.add(key)
+	}
+	return version
+}
+
+// remove deletes key and its expiry from sh, returning the value it held.
+// Callers must hold sh.lock for writing.
+func (c *Cache) remove(sh *shard, key string) ([]byte, bool) {
+	stored, ok := sh.data[key]
+	if !ok {
+		return nil, false
+	}
+	val, _ := sh.value(key)
+	c.addSaved(-sh.savedBytes(key))
+	delete(sh.packed, key)
+	delete(sh.sums, key)
+	delete(sh.data, key)
+	delete(sh.expiry, key)
+	delete(sh.ttl, key)
+	delete(sh.slid, key)
+	delete(sh.created, key)
+	delete(sh.version, key)
+	if sh.access != nil {
+		delete(sh.access, key)
+	}
+	atomic.AddInt64(&c.size, -entrySize(key, stored))
+	c.filter.remove(key)
+	atomic.AddUint64(&c.changes, 1)
+	if c.policy != nil {
+		c.policy.remove(key)
+	}
+	return val, true
+}
+
+// valueAttr describes a value for the debug log: the value itself only if
+// WithLogValues was given, otherwise just its length.
+func (c *Cache) valueAttr(v []byte) slog.Attr {
+	if c.logValues {
+		return slog.String("value", string(v))
+	}
+	return slog.Int("value_len", len(v))
 }
 
-func NewCache() *Cache {
-	return &Cache{
-		data:    make(map[string][]byte),
-		expiry:  make(map[string]time.Time),
+func NewCache(opts ...Option) *Cache {
+	o := buildOptions(opts)
+	c := &Cache{
+		shards:  make([]*shard, max(o.shards, 1)),
 		metrics: &CacheMetrics{},
+
+		atomicBatches: o.atomicBatches,
+		logger:        o.logger,
+		logValues:     o.logValues,
+
+		maxBytes:       o.maxBytes,
+		maxKeyBytes:    o.maxKeyBytes,
+		maxValueBytes:  o.maxValueBytes,
+		evictionPolicy: o.evictionPolicy,
+		trackAccess:    o.trackAccess,
+		negativeTTL:    o.negativeTTL,
+		sliding:        o.sliding,
+		compressAbove:  o.compressAbove,
+		filter:         newMissFilter(o.missFilterKeys),
+	}
+	for i := range c.shards {
+		c.shards[i] = newShard(o.trackAccess, o.negativeTTL > 0, o.sliding, o.compressAbove > 0, o.checksums)
+	}
+	if c.maxBytes > 0 {
+		c.policy = newPolicy(o.evictionPolicy)
 	}
+	if o.loader != nil {
+		c.loader.Store(&o.loader)
+	}
+	return c
 }
 
 func (c *Cache) Set(key, value []byte, ttl time.Duration) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
 	strKey := string(key)
-	c.data[strKey] = value
-	c.metrics.Sets++
+	if err := c.checkSize(strKey, value); err != nil {
+		return err
+	}
 
-	if ttl > 0 {
-		c.expiry[strKey] = time.Now().Add(ttl)
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	c.put(sh, strKey, value, 0)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+
+	if sh.setTTL(strKey, ttl, time.Now()) {
 		go c.startEviction(strKey, ttl)
 	}
+	sh.lock.Unlock()
 
-	log.Printf("SET %s to %s (TTL: %v)\n", strKey, string(value), ttl)
+	c.logger.Debug("SET", "key", strKey, c.valueAttr(value), "ttl", ttl)
+	c.evictForMemory()
 	return nil
 }
 
 func (c *Cache) Get(key []byte) ([]byte, error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	return c.get(context.Background(), key)
+}
 
+// get is Get, giving up on waiting for the Loader once ctx is done.
+func (c *Cache) get(ctx context.Context, key []byte) ([]byte, error) {
 	strKey := string(key)
-	val, ok := c.data[strKey]
+	val, _, err := c.read(strKey)
+	if err != nil {
+		l := c.loader.Load()
+		if l == nil {
+			c.rememberMiss(strKey, err)
+			return nil, err
+		}
+		return c.loadThrough(ctx, *l, strKey, err)
+	}
+	c.slide(strKey)
+	c.logger.Debug("GET", "key", strKey, c.valueAttr(val))
+	return val, nil
+}
+
+// read looks key up for Get and GetWithVersion, counting the hit or miss.
+func (c *Cache) read(key string) ([]byte, uint64, error) {
+	if c.filteredMiss(key) {
+		return nil, 0, ErrKeyNotFound
+	}
+	sh := c.shardFor(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	val, ok := sh.value(key)
 	if !ok {
-		c.metrics.Misses++
-		return nil, fmt.Errorf("key (%s) not found", strKey)
+		return nil, 0, c.miss(sh, key, false)
 	}
 
-	if exp, exists := c.expiry[strKey]; exists && time.Now().After(exp) {
-		c.metrics.Misses++
-		go c.Delete(key) // Async delete expired key
-		return nil, fmt.Errorf("key (%s) has expired", strKey)
+	if exp, exists := sh.expiry[key]; exists && time.Now().After(exp) {
+		return nil, 0, c.miss(sh, key, true)
+	}
+	if err := c.verify(sh, key, val); err != nil {
+		return nil, 0, err
 	}
 
-	c.metrics.Hits++
-	log.Printf("GET %s = %s\n", strKey, string(val))
-	return val, nil
+	atomic.AddUint64(&c.metrics.Hits, 1)
+	if c.policy != nil {
+		c.policy.use(key)
+	}
+	sh.recordAccess(key)
+	return val, sh.version[key], nil
 }
 
-func (c *Cache) Has(key []byte) bool {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	strKey := string(key)
-	if _, ok := c.data[strKey]; !ok {
-		return false
+// MGet looks up several keys while holding the read locks of all their
+// shards at once, so the values form a consistent point-in-time view. Results
+// are in request order; a missing or expired key has a nil value and a
+// non-nil error at its index.
+func (c *Cache) MGet(keys [][]byte) ([][]byte, []error) {
+	strKeys := make([]string, len(keys))
+	for i, k := range keys {
+		strKeys[i] = string(k)
 	}
+	unlock := c.lockShards(strKeys, false)
 
-	if exp, exists := c.expiry[strKey]; exists && time.Now().After(exp) {
-		return false
+	now := time.Now()
+	vals := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	hits := make([]string, 0, len(keys))
+	for i, strKey := range strKeys {
+		sh := c.shardFor(strKey)
+		val, ok := sh.value(strKey)
+		if !ok {
+			errs[i] = c.miss(sh, strKey, false)
+			continue
+		}
+		if exp, exists := sh.expiry[strKey]; exists && now.After(exp) {
+			errs[i] = c.miss(sh, strKey, true)
+			continue
+		}
+		if errs[i] = c.verify(sh, strKey, val); errs[i] != nil {
+			continue
+		}
+		atomic.AddUint64(&c.metrics.Hits, 1)
+		if c.policy != nil {
+			c.policy.use(strKey)
+		}
+		sh.recordAccess(strKey)
+		vals[i] = val
+		hits = append(hits, strKey)
 	}
-	return true
+	unlock()
+
+	c.slide(hits...)
+	c.logger.Debug("MGET", "keys", len(keys))
+	return vals, errs
 }
 
-func (c *Cache) Delete(key []byte) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+func (c *Cache) Has(key []byte) bool {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.live(strKey, time.Now())
+}
 
+// Delete removes key and reports whether it was live. Deleting a missing
+// or expired key is not an error.
+func (c *Cache) Delete(key []byte) (bool, error) {
 	strKey := string(key)
-	delete(c.data, strKey)
-	delete(c.expiry, strKey)
-	c.metrics.Deletes++
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	live := sh.live(strKey, time.Now())
+	val, existed := c.remove(sh, strKey)
+	if live {
+		atomic.AddUint64(&c.metrics.Deletes, 1)
+	} else {
+		atomic.AddUint64(&c.metrics.DeleteMisses, 1)
+	}
+	sh.lock.Unlock()
 
-	log.Printf("DELETE %s\n", strKey)
-	return nil
+	c.logger.Debug("DELETE", "key", strKey, "existed", live)
+	if existed {
+		c.notifyEvicted(evictEvent{key: key, value: val, reason: Deleted})
+	}
+	return live, nil
 }
 
-func (c *Cache) Keys() [][]byte {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	keys := make([][]byte, 0, len(c.data))
-	for k := range c.data {
-		if exp, exists := c.expiry[k]; !exists || !time.Now().After(exp) {
-			keys = append(keys, []byte(k))
+// MDel removes several keys while holding the write locks of all their shards
+// at once and returns how many of them actually existed.
+func (c *Cache) MDel(keys [][]byte) (int, error) {
+	strKeys := make([]string, len(keys))
+	for i, k := range keys {
+		strKeys[i] = string(k)
+	}
+	unlock := c.lockShards(strKeys, true)
+	events := make([]evictEvent, 0, len(keys))
+	for i, strKey := range strKeys {
+		val, ok := c.remove(c.shardFor(strKey), strKey)
+		if !ok {
+			continue
 		}
+		events = append(events, evictEvent{key: keys[i], value: val, reason: Deleted})
 	}
+	atomic.AddUint64(&c.metrics.Deletes, uint64(len(events)))
+	atomic.AddUint64(&c.metrics.DeleteMisses, uint64(len(keys)-len(events)))
+	unlock()
+
+	c.logger.Debug("MDEL", "deleted", len(events), "keys", len(keys))
+	c.notifyEvicted(events...)
+	return len(events), nil
+}
+
+// Keys returns every live key at once. The result grows with the cache, so
+// prefer Scan for anything but small caches. Shards are read one at a time,
+// so the result is not a single point-in-time view.
+func (c *Cache) Keys() [][]byte {
+	keys, _ := c.KeysMatchingCtx(context.Background(), "")
 	return keys
 }
 
+// KeysMatching returns the live keys matching a path.Match pattern. An empty
+// pattern matches every key.
+func (c *Cache) KeysMatching(pattern string) ([][]byte, error) {
+	return c.KeysMatchingCtx(context.Background(), pattern)
+}
+
 func (c *Cache) Metrics() *CacheMetrics {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	live := c.DBSize()
+	var policyName string
+	if c.maxBytesLimit() > 0 {
+		policyName = c.evictionPolicy.String()
+	}
 	return &CacheMetrics{
-		Hits:    c.metrics.Hits,
-		Misses:  c.metrics.Misses,
-		Sets:    c.metrics.Sets,
-		Deletes: c.metrics.Deletes,
+		Hits:    atomic.LoadUint64(&c.metrics.Hits),
+		Misses:  atomic.LoadUint64(&c.metrics.Misses),
+		Sets:    atomic.LoadUint64(&c.metrics.Sets),
+		Deletes: atomic.LoadUint64(&c.metrics.Deletes),
+
+		ExpiredKeys:       atomic.LoadUint64(&c.metrics.ExpiredKeys),
+		EvictedKeys:       atomic.LoadUint64(&c.metrics.EvictedKeys),
+		NegativeHits:      atomic.LoadUint64(&c.metrics.NegativeHits),
+		MissFilterHits:    atomic.LoadUint64(&c.metrics.MissFilterHits),
+		RejectedSets:      atomic.LoadUint64(&c.metrics.RejectedSets),
+		DeleteMisses:      atomic.LoadUint64(&c.metrics.DeleteMisses),
+		Loads:             atomic.LoadUint64(&c.metrics.Loads),
+		LoadErrors:        atomic.LoadUint64(&c.metrics.LoadErrors),
+		CompressionSaved:  atomic.LoadInt64(&c.saved),
+		ChecksumFailures:  atomic.LoadUint64(&c.metrics.ChecksumFailures),
+		KeyCount:          live,
+		DBSize:            live,
+		ApproxMemoryBytes: atomic.LoadInt64(&c.size),
+		MaxBytes:          c.maxBytesLimit(),
+		EvictionPolicy:    policyName,
 	}
 }
 
 func (c *Cache) startEviction(key string, ttl time.Duration) {
 	<-time.After(ttl)
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.expire(key)
+}
+
+// expire removes key if its TTL has passed.
+func (c *Cache) expire(key string) {
+	sh := c.shardFor(key)
+	sh.lock.Lock()
+	exp, exists := sh.expiry[key]
+	if !exists || !time.Now().After(exp) {
+		if _, slid := sh.slid[key]; slid && exists {
+			// A read has pushed the expiry back since this timer was set,
+			// without setting a timer of its own.
+			delete(sh.slid, key)
+			go c.startEviction(key, time.Until(exp))
+		}
+		sh.lock.Unlock()
+		return
+	}
+	val, _ := c.remove(sh, key)
+	atomic.AddUint64(&c.metrics.Deletes, 1)
+	atomic.AddUint64(&c.metrics.ExpiredKeys, 1)
+	sh.lock.Unlock()
+
+	c.logger.Debug("EVICTED", "key", key)
+	c.notifyEvicted(evictEvent{key: []byte(key), value: val, reason: Expired})
+}
 
-	if exp, exists := c.expiry[key]; exists && time.Now().After(exp) {
-		delete(c.data, key)
-		delete(c.expiry, key)
-		c.metrics.Deletes++
-		log.Printf("EVICTED %s\n", key)
+// BatchError reports the pairs of a batch that failed validation.
+type BatchError struct {
+	Rejected map[string]error
+	Applied  bool // whether the valid pairs were still written
+}
+
+func (e *BatchError) Error() string {
+	keys := make([]string, 0, len(e.Rejected))
+	for k, err := range e.Rejected {
+		keys = append(keys, fmt.Sprintf("%s (%v)", strconv.Quote(k), err))
 	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%d pair(s) rejected: %s", len(keys), strings.Join(keys, ", "))
 }
 
-// BatchSet sets multiple key-value pairs
+func validatePair(key string, value []byte) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	return nil
+}
+
+// BatchSet sets multiple key-value pairs. The batch is validated up front and
+// then applied in a single pass while holding the write locks of every shard
+// it touches, so readers never see part of it. Pairs that fail validation are
+// skipped and reported in a *BatchError; with WithAtomicBatches a single
+// invalid pair rejects the whole batch. An empty batch is a no-op.
 func (c *Cache) BatchSet(pairs map[string][]byte, ttl time.Duration) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	rejected := c.validateBatch(pairs)
+	if rejected != nil && c.atomicBatches {
+		return &BatchError{Rejected: rejected}
+	}
 
-	for k, v := range pairs {
-		c.data[k] = v
-		c.metrics.Sets++
-		if ttl > 0 {
-			c.expiry[k] = time.Now().Add(ttl)
-			go c.startEviction(k, ttl)
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		if _, bad := rejected[k]; !bad {
+			keys = append(keys, k)
 		}
-		log.Printf("BATCH SET %s to %s\n", k, string(v))
+	}
+
+	unlock := c.lockShards(keys, true)
+	c.applyBatch(keys, pairs, ttl, time.Now())
+	unlock()
+	c.evictForMemory()
+
+	if ttl > 0 && len(keys) > 0 {
+		go c.startBatchEviction(keys, ttl)
+	}
+	c.logger.Debug("BATCH SET", "keys", len(keys), "ttl", ttl)
+
+	if rejected != nil {
+		return &BatchError{Rejected: rejected, Applied: true}
 	}
 	return nil
 }
+
+// BatchSetNX is BatchSet, except that it writes nothing, and returns false,
+// if any of the keys is live. Keys past their TTL count as absent. Every pair
+// must be valid; one that isn't fails the whole batch with a *BatchError.
+func (c *Cache) BatchSetNX(pairs map[string][]byte, ttl time.Duration) (bool, error) {
+	if rejected := c.validateBatch(pairs); rejected != nil {
+		return false, &BatchError{Rejected: rejected}
+	}
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+
+	unlock := c.lockShards(keys, true)
+	now := time.Now()
+	for _, k := range keys {
+		if c.shardFor(k).live(k, now) {
+			unlock()
+			c.logger.Debug("BATCH SETNX declined", "key", k)
+			return false, nil
+		}
+	}
+	c.applyBatch(keys, pairs, ttl, now)
+	unlock()
+	c.evictForMemory()
+
+	if ttl > 0 && len(keys) > 0 {
+		go c.startBatchEviction(keys, ttl)
+	}
+	c.logger.Debug("BATCH SETNX", "keys", len(keys), "ttl", ttl)
+	return true, nil
+}
+
+// validateBatch returns the pairs that can't be written, or nil if all can.
+func (c *Cache) validateBatch(pairs map[string][]byte) map[string]error {
+	var rejected map[string]error
+	for k, v := range pairs {
+		err := validatePair(k, v)
+		if err == nil {
+			err = c.checkSize(k, v)
+		}
+		if err != nil {
+			if rejected == nil {
+				rejected = make(map[string]error)
+			}
+			rejected[k] = err
+		}
+	}
+	return rejected
+}
+
+// applyBatch writes keys' values from pairs, all at one version. Callers must
+// hold the write locks of every shard involved, and start the keys' eviction
+// once they have released them.
+func (c *Cache) applyBatch(keys []string, pairs map[string][]byte, ttl time.Duration, now time.Time) {
+	version := c.nextVersion()
+	for _, k := range keys {
+		sh := c.shardFor(k)
+		c.put(sh, k, pairs[k], version)
+		sh.setTTL(k, ttl, now)
+	}
+	atomic.AddUint64(&c.metrics.Sets, uint64(len(keys)))
+}
+
+func (c *Cache) startBatchEviction(keys []string, ttl time.Duration) {
+	<-time.After(ttl)
+	for _, k := range keys {
+		c.expire(k)
+	}
+}
@@ -1,13 +1,56 @@
 package cache
 
-import "time"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 type Cacher interface {
 	Set([]byte, []byte, time.Duration) error
 	BatchSet(map[string][]byte, time.Duration) error
+	BatchSetNX(map[string][]byte, time.Duration) (bool, error)
+	ApplyBatch([]Operation) ([]bool, error)
 	Has([]byte) bool
 	Get([]byte) ([]byte, error)
-	Delete([]byte) error
+	GetWithVersion([]byte) ([]byte, uint64, error)
+	CompareAndSwap(key, expected, value []byte, ttl time.Duration) (bool, error)
+	CompareAndSwapVersion(key []byte, version uint64, value []byte, ttl time.Duration) (bool, error)
+	MGet([][]byte) ([][]byte, []error)
+	Delete([]byte) (bool, error)
+	MDel([][]byte) (int, error)
+	Rename(src, dst []byte) error
+	Copy(src, dst []byte, replace bool) (bool, error)
+	CopyTTL(src, dst []byte, ttl time.Duration, replace bool) (bool, error)
+	Touch(keys [][]byte) (int, error)
+	ResetTTL(key []byte, ttl time.Duration) (time.Duration, error)
+	Append(key, value []byte) (int, error)
+	GetDel(key []byte) ([]byte, error)
+	GetEx(key []byte, ttl time.Duration) ([]byte, error)
 	Keys() [][]byte
+	Entries() map[string][]byte
+	Range(fn func(key, value []byte) bool)
+	DBSize() int
+	RandomKey() []byte
+	KeysMatching(pattern string) ([][]byte, error)
+	Scan(cursor uint64, count int) ([][]byte, uint64)
+	Dump(key []byte) ([]byte, error)
+	Restore(key, payload []byte, replace bool) error
+	MarkAbsent([]byte) error
+	ApplyDump(key, payload []byte) (bool, error)
+	Inspect(key []byte) (KeyInfo, error)
+	ExportJSON(w io.Writer) error
+	ImportJSON(r io.Reader) (int, error)
+	HotKeys(n int) ([]KeyAccess, error)
 	Metrics() *CacheMetrics
+	MaxBytes() int64
+	SetMaxBytes(int64) error
+	OnEvict(EvictFunc)
+	OnSlide(SlideFunc)
+
+	// Context-aware variants, which give up with ctx.Err() once ctx is done.
+	GetCtx(ctx context.Context, key []byte) ([]byte, error)
+	SetCtx(ctx context.Context, key, value []byte, ttl time.Duration) error
+	DeleteCtx(ctx context.Context, key []byte) (bool, error)
+	KeysMatchingCtx(ctx context.Context, pattern string) ([][]byte, error)
 }
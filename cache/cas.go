@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+// CompareAndSwap sets key to value, with ttl as in Set, only if it currently
+// holds expected, and reports whether it did. An empty expected means the key
+// must not exist (or have expired), which makes CompareAndSwap a set-if-absent;
+// a key holding an empty value therefore never matches.
+func (c *Cache) CompareAndSwap(key, expected, value []byte, ttl time.Duration) (bool, error) {
+	strKey := string(key)
+	if err := c.checkSize(strKey, value); err != nil {
+		return false, err
+	}
+
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	live := sh.live(strKey, time.Now())
+	var swap bool
+	if len(expected) == 0 {
+		swap = !live
+	} else if live {
+		current, _ := sh.value(strKey)
+		swap = bytes.Equal(current, expected)
+	}
+	if !swap {
+		sh.lock.Unlock()
+		c.logger.Debug("CAS mismatch", "key", strKey)
+		return false, nil
+	}
+
+	c.put(sh, strKey, value, 0)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+	if sh.setTTL(strKey, ttl, time.Now()) {
+		go c.startEviction(strKey, ttl)
+	}
+	sh.lock.Unlock()
+
+	c.logger.Debug("CAS", "key", strKey, c.valueAttr(value), "ttl", ttl)
+	c.evictForMemory()
+	return true, nil
+}
@@ -0,0 +1,24 @@
+package cache
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// sum is the checksum WithChecksums keeps for a value as it was set.
+func sum(value []byte) uint32 {
+	return crc32.ChecksumIEEE(value)
+}
+
+// verify checks value, as read from key in sh, against the checksum it was
+// set with. Values are only checked when read, so writes pay for the sum and
+// nothing else. Callers must hold sh.lock.
+func (c *Cache) verify(sh *shard, key string, value []byte) error {
+	want, ok := sh.sums[key]
+	if !ok || sum(value) == want {
+		return nil
+	}
+	atomic.AddUint64(&c.metrics.ChecksumFailures, 1)
+	c.logger.Error("value doesn't match its checksum", "key", key)
+	return &KeyError{Key: key, Err: ErrCorrupt}
+}
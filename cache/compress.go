@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// pack returns value as it should be stored, and its length if that is
+// gzipped, 0 if not. Values are only compressed with WithValueCompression,
+// when longer than its threshold, and if that makes them smaller.
+func (c *Cache) pack(value []byte) ([]byte, int) {
+	if c.compressAbove <= 0 || len(value) <= c.compressAbove {
+		return value, 0
+	}
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(&buf)
+	zw.Write(value)
+	zw.Close()
+	gzipWriters.Put(zw)
+	if buf.Len() >= len(value) {
+		return value, 0
+	}
+	return buf.Bytes(), len(value)
+}
+
+// unpack reverses pack for a value n bytes long.
+func unpack(stored []byte, n int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(zr, value); err != nil {
+		return nil, err
+	}
+	if _, err := zr.Read(make([]byte, 1)); err != io.EOF {
+		return nil, fmt.Errorf("compressed value longer than %d bytes", n)
+	}
+	return value, nil
+}
+
+// value returns key's value as it was set, decompressing it if need be.
+// Callers must hold s.lock.
+func (s *shard) value(key string) ([]byte, bool) {
+	v, ok := s.data[key]
+	if n, packed := s.packed[key]; ok && packed {
+		var err error
+		// Only pack writes compressed values, and snapshot loads check
+		// theirs, so this can't fail short of memory corruption.
+		if v, err = unpack(v, n); err != nil {
+			panic(fmt.Sprintf("cache: corrupt compressed value for key %q: %v", key, err))
+		}
+	}
+	return v, ok
+}
+
+// savedBytes is how much smaller key's stored value is than the value it was
+// set to. Callers must hold s.lock.
+func (s *shard) savedBytes(key string) int64 {
+	n, packed := s.packed[key]
+	if !packed {
+		return 0
+	}
+	return int64(n - len(s.data[key]))
+}
+
+func (c *Cache) addSaved(delta int64) {
+	if delta != 0 {
+		atomic.AddInt64(&c.saved, delta)
+	}
+}
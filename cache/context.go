@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+// ctxCheckInterval is how many keys a full scan visits between checks for
+// cancellation.
+const ctxCheckInterval = 1024
+
+// GetCtx is Get, but fails fast with ctx.Err() if ctx is already done, and
+// stops waiting for the Loader with ctx.Err() once it is.
+func (c *Cache) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.get(ctx, key)
+}
+
+// SetCtx is Set, but fails fast with ctx.Err() if ctx is already done.
+func (c *Cache) SetCtx(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, value, ttl)
+}
+
+// DeleteCtx is Delete, but fails fast with ctx.Err() if ctx is already done.
+func (c *Cache) DeleteCtx(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.Delete(key)
+}
+
+// KeysMatchingCtx is KeysMatching, but gives up with ctx.Err() if ctx is
+// cancelled part way through walking the keyspace.
+func (c *Cache) KeysMatchingCtx(ctx context.Context, pattern string) ([][]byte, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	keys := make([][]byte, 0)
+	i := 0
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		for k := range sh.data {
+			i++
+			if i%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					sh.lock.RUnlock()
+					return nil, err
+				}
+			}
+			if exp, exists := sh.expiry[k]; exists && now.After(exp) {
+				continue
+			}
+			if pattern != "" {
+				if ok, _ := path.Match(pattern, k); !ok {
+					continue
+				}
+			}
+			keys = append(keys, []byte(k))
+		}
+		sh.lock.RUnlock()
+	}
+	return keys, nil
+}
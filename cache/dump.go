@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+)
+
+// dumpVersion is bumped whenever the DUMP payload layout changes. RESTORE
+// refuses payloads from a version it doesn't know rather than guessing.
+// Version 1 payloads, which have no key version, are still accepted.
+const dumpVersion = 2
+
+var ErrKeyExists = errors.New("key already exists")
+
+// EncodeDump builds the payload Dump would return for value and ttl, without
+// a key version.
+func EncodeDump(value []byte, ttl time.Duration) []byte {
+	return encodeDump(value, ttl, 0)
+}
+
+// A dump payload is a version byte, the remaining TTL in milliseconds as a
+// uvarint (0 for none), the key's version as a uvarint (0 for none; absent
+// in version 1), the value, and a trailing CRC32 of everything before it.
+func encodeDump(value []byte, ttl time.Duration, version uint64) []byte {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(value)+4)
+	buf = append(buf, dumpVersion)
+	buf = binary.AppendUvarint(buf, uint64(ttl.Milliseconds()))
+	buf = binary.AppendUvarint(buf, version)
+	buf = append(buf, value...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// DecodeDump unpacks a payload produced by Dump.
+func DecodeDump(payload []byte) (value []byte, ttl time.Duration, err error) {
+	value, ttl, _, err = decodeDump(payload)
+	return value, ttl, err
+}
+
+func decodeDump(payload []byte) (value []byte, ttl time.Duration, version uint64, err error) {
+	if len(payload) < 6 {
+		return nil, 0, 0, errors.New("dump payload too short")
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, 0, 0, errors.New("dump payload checksum mismatch")
+	}
+	if body[0] < 1 || body[0] > dumpVersion {
+		return nil, 0, 0, fmt.Errorf("unsupported dump version %d", body[0])
+	}
+	ms, n := binary.Uvarint(body[1:])
+	if n <= 0 {
+		return nil, 0, 0, errors.New("dump payload has a bad TTL")
+	}
+	rest := body[1+n:]
+	if body[0] >= 2 {
+		if version, n = binary.Uvarint(rest); n <= 0 {
+			return nil, 0, 0, errors.New("dump payload has a bad version")
+		}
+		rest = rest[n:]
+	}
+	return rest, time.Duration(ms) * time.Millisecond, version, nil
+}
+
+// DumpOperation turns a Dump payload for key into the set that stores it,
+// version included, for ApplyBatch.
+func DumpOperation(key, payload []byte) (Operation, error) {
+	value, ttl, version, err := decodeDump(payload)
+	if err != nil {
+		return Operation{}, err
+	}
+	return Operation{Kind: OpSet, Key: key, Value: value, TTL: ttl, Version: version}, nil
+}
+
+// Dump serializes key's value, remaining TTL and version for Restore or
+// ApplyDump.
+func (c *Cache) Dump(key []byte) ([]byte, error) {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	val, ok := sh.value(strKey)
+	if !ok {
+		return nil, &KeyError{Key: strKey, Err: ErrKeyNotFound}
+	}
+	var ttl time.Duration
+	if exp, exists := sh.expiry[strKey]; exists {
+		ttl = time.Until(exp)
+		if ttl <= 0 {
+			return nil, &KeyError{Key: strKey, Err: ErrKeyExpired}
+		}
+		// Round up so a key with a few microseconds left doesn't come back
+		// without a TTL at all.
+		ttl = max(ttl, time.Millisecond)
+	}
+	// A corrupt value would otherwise spread to wherever the dump is
+	// restored, followers included.
+	if err := c.verify(sh, strKey, val); err != nil {
+		return nil, err
+	}
+	return encodeDump(val, ttl, sh.version[strKey]), nil
+}
+
+// Restore recreates key from a Dump payload as a new write, so it gets a new
+// version. Unless replace is set, it fails with ErrKeyExists if the key is
+// already live.
+func (c *Cache) Restore(key, payload []byte, replace bool) error {
+	value, ttl, err := DecodeDump(payload)
+	if err != nil {
+		return err
+	}
+	return c.restore(key, value, ttl, 0, func(sh *shard, key string) error {
+		if !replace && sh.live(key, time.Now()) {
+			return ErrKeyExists
+		}
+		return nil
+	})
+}
+
+// ApplyDump stores a Dump payload exactly, version included, unless key is
+// already at that version or a later one, and reports whether it did.
+// Followers apply their leader's writes this way, so that versions match
+// across the cluster and a write that arrives late can't undo a newer one.
+func (c *Cache) ApplyDump(key, payload []byte) (bool, error) {
+	value, ttl, version, err := decodeDump(payload)
+	if err != nil {
+		return false, err
+	}
+	errStale := errors.New("stale")
+	err = c.restore(key, value, ttl, version, func(sh *shard, key string) error {
+		if version != 0 && sh.version[key] >= version {
+			return errStale
+		}
+		return nil
+	})
+	if err == errStale {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// restore stores value at version (0 for the next one) if check, run under
+// the shard lock, allows it.
+func (c *Cache) restore(key, value []byte, ttl time.Duration, version uint64, check func(*shard, string) error) error {
+	strKey := string(key)
+	if err := c.checkSize(strKey, value); err != nil {
+		return err
+	}
+
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	if err := check(sh, strKey); err != nil {
+		sh.lock.Unlock()
+		return err
+	}
+	c.put(sh, strKey, value, version)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+	if sh.setTTL(strKey, ttl, time.Now()) {
+		go c.startEviction(strKey, ttl)
+	}
+	sh.lock.Unlock()
+
+	c.evictForMemory()
+	return nil
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Entries returns every live key and its value as of a single moment: every
+// shard is read-locked at once while they are copied, so no write lands
+// part way through. Writes are held up for as long as that takes, about
+// half a second per million keys, and callers then have the result to
+// themselves without any lock held.
+//
+// The map costs about 100 bytes per key on top of the values, which are
+// shared with the cache rather than copied, so must not be modified. Values
+// stored compressed are the exception: they are unpacked, so take their
+// full size again. For a large cache that is a lot to hold at once; Scan
+// and ExportJSON walk it with far less, at the cost of not being a single
+// point-in-time view.
+func (c *Cache) Entries() map[string][]byte {
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+	}
+	n := 0
+	for _, sh := range c.shards {
+		n += len(sh.data)
+	}
+	entries := make(map[string][]byte, n)
+	// Unpacking waits until the locks are released.
+	packed := make(map[string]int)
+	now := time.Now()
+	for _, sh := range c.shards {
+		for k, v := range sh.data {
+			if exp, ok := sh.expiry[k]; ok && now.After(exp) {
+				continue
+			}
+			entries[k] = v
+			if size, ok := sh.packed[k]; ok {
+				packed[k] = size
+			}
+		}
+	}
+	for _, sh := range c.shards {
+		sh.lock.RUnlock()
+	}
+
+	for k, size := range packed {
+		v, err := unpack(entries[k], size)
+		if err != nil {
+			// As in shard.value, only memory corruption gets here.
+			panic(fmt.Sprintf("cache: corrupt compressed value for key %q: %v", k, err))
+		}
+		entries[k] = v
+	}
+	return entries
+}
+
+// Range calls fn with each key and value of an Entries snapshot, stopping
+// early if fn returns false. No lock is held while fn runs, so it may use
+// the cache, but it sees the cache as it was when Range was called.
+func (c *Cache) Range(fn func(key, value []byte) bool) {
+	for k, v := range c.Entries() {
+		if !fn([]byte(k), v) {
+			return
+		}
+	}
+}
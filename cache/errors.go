@@ -0,0 +1,41 @@
+package cache
+
+import "errors"
+
+// Reads of a key that isn't there fail with one of these. Get and
+// GetWithVersion return them as they are, so a miss costs no allocation;
+// operations that can fail for other reasons wrap them in a *KeyError naming
+// the key. Either way errors.Is matches them.
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrKeyExpired  = errors.New("key has expired")
+	// ErrKnownAbsent is returned by reads of a key marked with MarkAbsent,
+	// in place of the usual not-found error.
+	ErrKnownAbsent = errors.New("known absent")
+)
+
+// ErrCorrupt is wrapped in the *KeyError a read returns instead of a value
+// that doesn't match the checksum WithChecksums recorded for it.
+var ErrCorrupt = errors.New("value doesn't match its checksum")
+
+// KeyError is an error about a particular key.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	switch e.Err {
+	case ErrKeyNotFound:
+		return "key (" + e.Key + ") not found"
+	case ErrKeyExpired:
+		return "key (" + e.Key + ") has expired"
+	case ErrKnownAbsent:
+		return "key (" + e.Key + ") is known absent"
+	case ErrCorrupt:
+		return "key (" + e.Key + ") is corrupt: its value doesn't match its checksum"
+	}
+	return "key (" + e.Key + "): " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error { return e.Err }
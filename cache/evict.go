@@ -0,0 +1,108 @@
+package cache
+
+import "sync"
+
+// EvictionReason says why a key left the cache.
+type EvictionReason int
+
+const (
+	Expired EvictionReason = iota
+	Deleted
+	EvictedForMemory
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Deleted:
+		return "deleted"
+	case EvictedForMemory:
+		return "evicted_for_memory"
+	}
+	return "unknown"
+}
+
+// EvictFunc is called with the key and last value of a removed entry.
+type EvictFunc func(key, value []byte, reason EvictionReason)
+
+type evictEvent struct {
+	key    []byte
+	value  []byte
+	reason EvictionReason
+}
+
+// evictDispatcher runs eviction callbacks on its own goroutine. Its queue is
+// unbounded so that a slow callback delays later callbacks but never blocks
+// the cache operation that produced the event.
+type evictDispatcher struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	hooks   []EvictFunc
+	pending []evictEvent
+}
+
+func newEvictDispatcher() *evictDispatcher {
+	d := &evictDispatcher{}
+	d.cond = sync.NewCond(&d.mu)
+	go d.run()
+	return d
+}
+
+func (d *evictDispatcher) register(fn EvictFunc) {
+	d.mu.Lock()
+	d.hooks = append(d.hooks, fn)
+	d.mu.Unlock()
+}
+
+func (d *evictDispatcher) enqueue(events ...evictEvent) {
+	if len(events) == 0 {
+		return
+	}
+	d.mu.Lock()
+	d.pending = append(d.pending, events...)
+	d.mu.Unlock()
+	d.cond.Signal()
+}
+
+func (d *evictDispatcher) run() {
+	for {
+		d.mu.Lock()
+		for len(d.pending) == 0 {
+			d.cond.Wait()
+		}
+		batch := d.pending
+		d.pending = nil
+		hooks := d.hooks
+		d.mu.Unlock()
+
+		for _, ev := range batch {
+			for _, fn := range hooks {
+				fn(ev.key, ev.value, ev.reason)
+			}
+		}
+	}
+}
+
+// OnEvict registers fn to be called whenever a key is removed by expiry,
+// deletion or memory pressure. Callbacks run in removal order on a dedicated
+// goroutine, outside the shard locks, so they may safely call back into the
+// cache.
+func (c *Cache) OnEvict(fn EvictFunc) {
+	c.evictMu.Lock()
+	d := c.evictions.Load()
+	if d == nil {
+		d = newEvictDispatcher()
+		c.evictions.Store(d)
+	}
+	c.evictMu.Unlock()
+	d.register(fn)
+}
+
+// notifyEvicted hands events to the registered callbacks, if any. Callers
+// must not hold a shard lock.
+func (c *Cache) notifyEvicted(events ...evictEvent) {
+	if d := c.evictions.Load(); d != nil {
+		d.enqueue(events...)
+	}
+}
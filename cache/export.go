@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// JSONEntry is one line of the ExportJSON format. Value is base64-encoded in
+// the JSON, since values are arbitrary bytes.
+type JSONEntry struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	TTLMillis int64  `json:"ttl_ms,omitempty"` // 0 for no TTL
+}
+
+func (e JSONEntry) TTL() time.Duration {
+	return time.Duration(e.TTLMillis) * time.Millisecond
+}
+
+// Validate rejects entries that could not have come from ExportJSON.
+func (e JSONEntry) Validate() error {
+	if e.Key == "" {
+		return errors.New("empty key")
+	}
+	if e.TTLMillis < 0 {
+		return errors.New("negative ttl_ms")
+	}
+	return nil
+}
+
+// ExportJSON writes every live key to w as newline-delimited JSON entries,
+// with the TTL each has left. Shards are copied one at a time and written
+// outside their locks, so a slow w doesn't hold up writers, but the export
+// is not a single point-in-time view.
+func (c *Cache) ExportJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, sh := range c.shards {
+		for _, e := range sh.jsonEntries(time.Now()) {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func (s *shard) jsonEntries(now time.Time) []JSONEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	entries := make([]JSONEntry, 0, len(s.data))
+	for k := range s.data {
+		v, _ := s.value(k)
+		e := JSONEntry{Key: k, Value: v}
+		if exp, ok := s.expiry[k]; ok {
+			left := exp.Sub(now)
+			if left <= 0 {
+				continue
+			}
+			// As in Dump, don't let a key about to expire lose its TTL.
+			e.TTLMillis = max(left.Milliseconds(), 1)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// ImportJSON sets every entry read from r, in the format written by
+// ExportJSON, and returns how many it set. Existing keys are overwritten. It
+// stops at the first bad entry; those before it stay set.
+func (c *Cache) ImportJSON(r io.Reader) (int, error) {
+	return importJSON(r, c.Set)
+}
+
+func importJSON(r io.Reader, set func(key, value []byte, ttl time.Duration) error) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var e JSONEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err == nil {
+			err = e.Validate()
+		}
+		if err == nil {
+			err = set([]byte(e.Key), e.Value, e.TTL())
+		}
+		if err != nil {
+			return n, fmt.Errorf("entry %d: %w", n+1, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by NewPersistentCache when another process already
+// has the same storage path open.
+var ErrLocked = errors.New("storage is in use by another process")
+
+func lockedError(path string, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("%s is locked (%w)", path, ErrLocked)
+	}
+	return fmt.Errorf("%s is locked by pid %d (%w)", path, pid, ErrLocked)
+}
+
+// readPID returns the pid recorded in a lock file, or 0 if there isn't one.
+func readPID(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
+
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
@@ -0,0 +1,65 @@
+//go:build !unix
+
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// fileLock is a file next to the storage, created exclusively and holding
+// the owner's pid. A file left behind by a process that no longer exists is
+// treated as stale and taken over.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+func lockFile(path, name string) (*fileLock, error) {
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			if err := writePID(f); err != nil {
+				f.Close()
+				os.Remove(path)
+				return nil, err
+			}
+			return &fileLock{path: path, f: f}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		held, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // released while we looked
+			}
+			return nil, err
+		}
+		pid := readPID(held)
+		held.Close()
+		if attempt > 0 || (pid > 0 && processAlive(pid)) {
+			return nil, lockedError(name, pid)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+// processAlive reports whether pid exists. On Windows, FindProcess fails for
+// a process that has exited.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+func (l *fileLock) release() error {
+	l.f.Close()
+	return os.Remove(l.path)
+}
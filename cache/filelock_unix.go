@@ -0,0 +1,44 @@
+//go:build unix
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileLock is an flock on a file next to the storage. The kernel drops it
+// when the holder exits, however it exits, so a crashed server never leaves
+// a stale lock behind; the pid in the file is only for the error message.
+type fileLock struct {
+	f *os.File
+}
+
+func lockFile(path, name string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := readPID(f)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, lockedError(name, pid)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err := writePID(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// release unlocks and leaves the file in place: removing it could let two
+// later processes lock different files for the same storage.
+func (l *fileLock) release() error {
+	l.f.Truncate(0)
+	return l.f.Close()
+}
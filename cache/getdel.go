@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// GetDel returns key's value and deletes it in one step, so of several
+// callers racing for the same key only one gets the value. It fails as Get
+// does if the key doesn't exist or has expired.
+func (c *Cache) GetDel(key []byte) ([]byte, error) {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	if !sh.live(strKey, time.Now()) {
+		_, expired := sh.data[strKey]
+		err := c.miss(sh, strKey, expired)
+		sh.lock.Unlock()
+		return nil, err
+	}
+	val, _ := c.remove(sh, strKey)
+	atomic.AddUint64(&c.metrics.Hits, 1)
+	atomic.AddUint64(&c.metrics.Deletes, 1)
+	sh.lock.Unlock()
+
+	c.logger.Debug("GETDEL", "key", strKey, c.valueAttr(val))
+	c.notifyEvicted(evictEvent{key: key, value: val, reason: Deleted})
+	return val, nil
+}
+
+// GetEx returns key's value and resets its expiry as ResetTTL does. It fails
+// as Get does if the key doesn't exist or has expired.
+func (c *Cache) GetEx(key []byte, ttl time.Duration) ([]byte, error) {
+	val, _, err := c.getEx(key, ttl)
+	return val, err
+}
+
+// getEx does GetEx and also returns the TTL the key was given.
+func (c *Cache) getEx(key []byte, ttl time.Duration) ([]byte, time.Duration, error) {
+	val, ttl, err := c.resetTTL(key, ttl)
+	if err != nil {
+		atomic.AddUint64(&c.metrics.Misses, 1)
+		return nil, 0, err
+	}
+	atomic.AddUint64(&c.metrics.Hits, 1)
+	return val, ttl, nil
+}
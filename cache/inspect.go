@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"time"
+)
+
+// KeyInfo describes a key without its value.
+type KeyInfo struct {
+	Key        string     `json:"key"`
+	Size       int        `json:"size"`                 // value length in bytes
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // nil if the key has no TTL
+	TTL        string     `json:"ttl,omitempty"`        // time left, rounded to the millisecond
+	CreatedAt  time.Time  `json:"created_at"`           // when the key was first set; overwrites keep it
+	Compressed bool       `json:"compressed"`
+	Version    uint64     `json:"version"` // changes on every write; see CompareAndSwapVersion
+
+	// Hits and LastAccess count reads, and are only kept with
+	// WithAccessTracking. LastAccess is nil until the first read.
+	Hits       uint64     `json:"hits,omitempty"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+// Inspect returns metadata about key. Unlike Get it does not count as a hit
+// or miss, nor as a use for eviction.
+func (c *Cache) Inspect(key []byte) (KeyInfo, error) {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	val, ok := sh.data[strKey]
+	if !ok {
+		return KeyInfo{}, &KeyError{Key: strKey, Err: ErrKeyNotFound}
+	}
+	n, compressed := sh.packed[strKey]
+	if !compressed {
+		n = len(val)
+	}
+	info := KeyInfo{Key: strKey, Size: n, CreatedAt: sh.created[strKey], Compressed: compressed, Version: sh.version[strKey]}
+	if exp, exists := sh.expiry[strKey]; exists {
+		left := time.Until(exp)
+		if left <= 0 {
+			return KeyInfo{}, &KeyError{Key: strKey, Err: ErrKeyExpired}
+		}
+		info.ExpiresAt = &exp
+		info.TTL = left.Round(time.Millisecond).String()
+	}
+	if a, ok := sh.access[strKey]; ok {
+		info.Hits = a.hits.Load()
+		if last := a.last.Load(); last != 0 {
+			t := time.Unix(0, last)
+			info.LastAccess = &t
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,36 @@
+package cache
+
+import "sync"
+
+// janitorQueue bounds how many expired keys found by reads can wait for the
+// janitor. Once it is full, reads stop queueing; every key with a TTL also
+// has its own timer, which removes it regardless.
+const janitorQueue = 1024
+
+// janitor removes keys that reads found past their TTL. Reads only hold a
+// shard's read lock, so they hand the key over rather than deleting it
+// themselves, and a single goroutine does the work however many reads there
+// are.
+type janitor struct {
+	once  sync.Once
+	queue chan string
+}
+
+// queueExpire asks the janitor to remove key if it has expired. It never
+// blocks, so it is safe to call with a shard lock held.
+func (c *Cache) queueExpire(key string) {
+	c.janitor.once.Do(func() {
+		c.janitor.queue = make(chan string, janitorQueue)
+		go c.runJanitor()
+	})
+	select {
+	case c.janitor.queue <- key:
+	default:
+	}
+}
+
+func (c *Cache) runJanitor() {
+	for key := range c.janitor.queue {
+		c.expire(key)
+	}
+}
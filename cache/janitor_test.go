@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// plantExpired stores key with an expiry already in the past and no timer
+// to remove it, as if its timer hadn't fired yet.
+func plantExpired(t *testing.T, c *Cache, key string) {
+	t.Helper()
+	if err := c.Set([]byte(key), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	sh := c.shardFor(key)
+	sh.lock.Lock()
+	sh.setTTL(key, time.Hour, time.Now().Add(-2*time.Hour))
+	sh.lock.Unlock()
+}
+
+func TestExpiredReadsDontSpawnGoroutines(t *testing.T) {
+	const (
+		keys    = 2000
+		readers = 32
+		reads   = 20000
+	)
+	c := NewCache()
+	for i := 0; i < keys; i++ {
+		plantExpired(t, c, fmt.Sprintf("k%d", i))
+	}
+	base := runtime.NumGoroutine()
+
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := int64(runtime.NumGoroutine()); n > peak.Load() {
+				peak.Store(n)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(readers)
+	for r := 0; r < readers; r++ {
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < reads; i++ {
+				key := []byte(fmt.Sprintf("k%d", (r*reads+i)%keys))
+				if _, err := c.Get(key); err != ErrKeyExpired && err != ErrKeyNotFound {
+					t.Errorf("Get(%s) = %v, want ErrKeyExpired or ErrKeyNotFound", key, err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(stop)
+	<-sampled
+
+	// The readers, the sampler and the janitor; a goroutine per expired
+	// read would be thousands more.
+	if extra := peak.Load() - int64(base); extra > readers+8 {
+		t.Fatalf("goroutines peaked %d above the %d before reading, with %d readers", extra, base, readers)
+	}
+
+	// The janitor removes what the reads found, with no timer to help it.
+	for deadline := time.Now().Add(5 * time.Second); storedKeys(c) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d expired keys still stored", storedKeys(c))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.Metrics().ExpiredKeys; n != keys {
+		t.Fatalf("ExpiredKeys = %d, want %d", n, keys)
+	}
+}
+
+func TestExpiredReadsRaceWrites(t *testing.T) {
+	const (
+		keys   = 64
+		rounds = 2000
+	)
+	c := NewCache()
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for r := 0; r < 3; r++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds*keys; i++ {
+				key := []byte(fmt.Sprintf("k%d", i%keys))
+				c.Get(key)
+				c.MGet([][]byte{key})
+			}
+		}()
+	}
+	// Keys keep being stored, expired and rewritten under the readers and
+	// the janitor. A rewritten key must never be removed for the expiry of
+	// the value it replaced.
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			key := fmt.Sprintf("k%d", i%keys)
+			plantExpired(t, c, key)
+			c.Set([]byte(key), []byte("live"), 0)
+			if v, err := c.Get([]byte(key)); err != nil || string(v) != "live" {
+				t.Errorf("Get(%s) after rewrite = %q, %v", key, v, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// DBSize returns how many live keys the cache holds. Keys past their TTL
+// linger until their expiry runs, so it counts each shard under its read
+// lock, leaving those out.
+func (c *Cache) DBSize() int {
+	live := 0
+	now := time.Now()
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		live += len(sh.data)
+		for _, exp := range sh.expiry {
+			if now.After(exp) {
+				live--
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	return live
+}
+
+// RandomKey returns a live key picked at random, or nil if there are none.
+// Keys in smaller shards are somewhat likelier to come up.
+func (c *Cache) RandomKey() []byte {
+	now := time.Now()
+	start := rand.IntN(len(c.shards))
+	for i := range c.shards {
+		sh := c.shards[(start+i)%len(c.shards)]
+		sh.lock.RLock()
+		// Map iteration starts at a random entry.
+		for k := range sh.data {
+			if sh.live(k, now) {
+				sh.lock.RUnlock()
+				return []byte(k)
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	return nil
+}
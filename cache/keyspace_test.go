@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// storedKeys counts every key c holds, live or not.
+func storedKeys(c *Cache) int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		n += len(sh.data)
+		sh.lock.RUnlock()
+	}
+	return n
+}
+
+func TestDBSizeSkipsExpired(t *testing.T) {
+	c := NewCache()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := c.Set([]byte(k), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make b look expired without its expiry having run to remove it.
+	sh := c.shardFor("b")
+	sh.lock.Lock()
+	sh.expiry["b"] = time.Now().Add(-time.Second)
+	sh.lock.Unlock()
+
+	if n := storedKeys(c); n != 3 {
+		t.Fatalf("%d keys stored, want all 3", n)
+	}
+	if n := c.DBSize(); n != 2 {
+		t.Fatalf("DBSize = %d, want 2", n)
+	}
+	if m := c.Metrics(); m.DBSize != 2 || m.KeyCount != 2 {
+		t.Fatalf("Metrics DBSize, KeyCount = %d, %d; want 2, 2", m.DBSize, m.KeyCount)
+	}
+}
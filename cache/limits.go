@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	ErrKeyTooLarge   = errors.New("key larger than MaxKeyBytes")
+	ErrValueTooLarge = errors.New("value larger than MaxValueBytes")
+)
+
+// checkSize rejects an entry whose key or value is over its limit, or that
+// could never fit under MaxBytes, and counts the rejection.
+func (c *Cache) checkSize(key string, value []byte) error {
+	var err error
+	switch {
+	case c.maxKeyBytes > 0 && len(key) > c.maxKeyBytes:
+		err = fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), c.maxKeyBytes)
+	case c.maxValueBytes > 0 && len(value) > c.maxValueBytes:
+		err = fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, len(value), c.maxValueBytes)
+	case c.maxBytesLimit() > 0 && entrySize(key, value) > c.maxBytesLimit():
+		err = fmt.Errorf("%w: %d bytes, limit is %d", ErrEntryTooLarge, entrySize(key, value), c.maxBytesLimit())
+	default:
+		return nil
+	}
+	atomic.AddUint64(&c.metrics.RejectedSets, 1)
+	return err
+}
+
+func (c *Cache) maxBytesLimit() int64 {
+	return atomic.LoadInt64(&c.maxBytes)
+}
+
+// MaxBytes returns the memory limit in force, 0 for none.
+func (c *Cache) MaxBytes() int64 {
+	return c.maxBytesLimit()
+}
+
+// SetMaxBytes changes the limit WithMaxBytes set, evicting keys straight away
+// if the cache is over the new one; 0 stops evicting. Only a cache created
+// with a limit keeps track of what to evict, so it fails for one without.
+func (c *Cache) SetMaxBytes(n int64) error {
+	if c.policy == nil {
+		return errors.New("the cache was created without a memory limit, so one can't be set at runtime")
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid memory limit %d: must not be negative", n)
+	}
+	atomic.StoreInt64(&c.maxBytes, n)
+	c.logger.Info("memory limit changed", "maxbytes", n)
+	c.evictForMemory()
+	return nil
+}
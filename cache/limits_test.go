@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSizeLimitBoundaries(t *testing.T) {
+	const (
+		maxKey   = 16
+		maxValue = 64
+	)
+	tests := []struct {
+		name  string
+		key   int
+		value int
+		want  error
+	}{
+		{"key at limit", maxKey, 1, nil},
+		{"key one over", maxKey + 1, 1, ErrKeyTooLarge},
+		{"value at limit", 1, maxValue, nil},
+		{"value one over", 1, maxValue + 1, ErrValueTooLarge},
+		{"both at limit", maxKey, maxValue, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := strings.Repeat("k", tt.key)
+			value := []byte(strings.Repeat("v", tt.value))
+			var rejected uint64
+			if tt.want != nil {
+				rejected = 1
+			}
+
+			c := NewCache(WithMaxKeyBytes(maxKey), WithMaxValueBytes(maxValue))
+			err := c.Set([]byte(key), value, 0)
+			checkLimit(t, c, "Set", key, err, tt.want, rejected)
+
+			c = NewCache(WithMaxKeyBytes(maxKey), WithMaxValueBytes(maxValue))
+			err = c.BatchSet(map[string][]byte{key: value, "ok": []byte("v")}, 0)
+			if tt.want != nil {
+				var be *BatchError
+				if !errors.As(err, &be) || !be.Applied || !errors.Is(be.Rejected[key], tt.want) {
+					t.Fatalf("BatchSet = %v, want %q rejected with %v and the rest applied", err, key, tt.want)
+				}
+				err = be.Rejected[key]
+			}
+			checkLimit(t, c, "BatchSet", key, err, tt.want, rejected)
+			if _, err := c.Get([]byte("ok")); err != nil {
+				t.Fatalf("the valid pair of the batch wasn't stored: %v", err)
+			}
+		})
+	}
+}
+
+// checkLimit checks that an op storing key failed with want, or succeeded if
+// want is nil, and was counted in RejectedSets accordingly.
+func checkLimit(t *testing.T, c *Cache, op, key string, err, want error, rejected uint64) {
+	t.Helper()
+	if !errors.Is(err, want) || (want == nil && err != nil) {
+		t.Fatalf("%s = %v, want %v", op, err, want)
+	}
+	_, getErr := c.Get([]byte(key))
+	if stored := getErr == nil; stored != (want == nil) {
+		t.Fatalf("after %s, key stored = %v, want %v", op, stored, want == nil)
+	}
+	if n := c.Metrics().RejectedSets; n != rejected {
+		t.Fatalf("after %s, RejectedSets = %d, want %d", op, n, rejected)
+	}
+}
+
+func TestNoSizeLimitsByDefault(t *testing.T) {
+	c := NewCache()
+	big := []byte(strings.Repeat("v", 1<<20))
+	if err := c.Set([]byte(strings.Repeat("k", 4096)), big, 0); err != nil {
+		t.Fatalf("Set without limits: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader is a slower store the cache sits in front of. See WithLoader.
+type Loader interface {
+	// Load fetches key, returning its value and the TTL to cache it with (0
+	// for none), or a nil value if the store doesn't have it. An error means
+	// the store couldn't be asked.
+	Load(key []byte) ([]byte, time.Duration, error)
+}
+
+// LoaderFunc lets an ordinary function be used as a Loader.
+type LoaderFunc func(key []byte) ([]byte, time.Duration, error)
+
+func (f LoaderFunc) Load(key []byte) ([]byte, time.Duration, error) {
+	return f(key)
+}
+
+// SetLoader makes Get fall back to fn as WithLoader does, replacing any
+// loader already set. A nil fn stops loading. Loads already running finish
+// with the loader they started with.
+func (c *Cache) SetLoader(fn func(key []byte) ([]byte, time.Duration, error)) {
+	if fn == nil {
+		c.loader.Store(nil)
+		return
+	}
+	var l Loader = LoaderFunc(fn)
+	c.loader.Store(&l)
+}
+
+// flight is one Load in progress. Callers that miss on the same key while
+// it runs wait for it instead of starting their own.
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+type flights struct {
+	mu      sync.Mutex
+	pending map[string]*flight
+}
+
+// loadThrough answers a Get that missed on key from the loader, storing what
+// it finds. Only one Load per key runs at a time; every caller that misses
+// meanwhile shares its result, error included. miss is the error the Get
+// failed with, which is returned if the loader doesn't have the key either.
+//
+// A key the loader doesn't have is marked with MarkAbsent when negative
+// caching is enabled, so it isn't looked up again until the marker expires.
+// A failed Load isn't remembered: the next miss tries again.
+//
+// A caller whose ctx is done stops waiting with ctx.Err(). The Load itself
+// runs on regardless, since others may be waiting on it, and what it finds
+// is still cached for the next Get.
+func (c *Cache) loadThrough(ctx context.Context, l Loader, key string, miss error) ([]byte, error) {
+	if errors.Is(miss, ErrKnownAbsent) {
+		return nil, miss
+	}
+
+	c.flights.mu.Lock()
+	f, ok := c.flights.pending[key]
+	if !ok {
+		if c.flights.pending == nil {
+			c.flights.pending = make(map[string]*flight)
+		}
+		f = &flight{done: make(chan struct{})}
+		c.flights.pending[key] = f
+		go c.fly(l, key, f)
+	}
+	c.flights.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return c.landed(f, miss)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fly runs f's Load, caches the result and lets its waiters go.
+func (c *Cache) fly(l Loader, key string, f *flight) {
+	var ttl time.Duration
+	f.value, ttl, f.err = c.load(l, key)
+	switch {
+	case f.err != nil:
+		atomic.AddUint64(&c.metrics.LoadErrors, 1)
+		c.logger.Warn("load failed", "key", key, "err", f.err)
+	case f.value != nil:
+		if err := c.Set([]byte(key), f.value, ttl); err != nil {
+			c.logger.Warn("loaded value not cached", "key", key, "err", err)
+		}
+	case c.negativeTTL > 0:
+		c.MarkAbsent([]byte(key))
+	}
+
+	c.flights.mu.Lock()
+	delete(c.flights.pending, key)
+	c.flights.mu.Unlock()
+	close(f.done)
+}
+
+// load calls the loader, turning a panic into an error so the callers
+// waiting on it aren't left hanging.
+func (c *Cache) load(l Loader, key string) (value []byte, ttl time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, ttl, err = nil, 0, fmt.Errorf("loading key (%s): loader panicked: %v", key, r)
+		}
+	}()
+	value, ttl, err = l.Load([]byte(key))
+	if err != nil {
+		return nil, 0, fmt.Errorf("loading key (%s): %w", key, err)
+	}
+	return value, ttl, nil
+}
+
+func (c *Cache) landed(f *flight, miss error) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.value == nil {
+		return nil, miss
+	}
+	atomic.AddUint64(&c.metrics.Loads, 1)
+	return f.value, nil
+}
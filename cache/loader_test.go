@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoaderCoalescesConcurrentMisses(t *testing.T) {
+	const callers = 1000
+
+	var loads int32
+	release := make(chan struct{})
+	c := NewCache(WithLoader(LoaderFunc(func(key []byte) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("loaded"), 0, nil
+	})))
+
+	var ready, done sync.WaitGroup
+	ready.Add(callers)
+	done.Add(callers)
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer done.Done()
+			ready.Done()
+			val, err := c.Get([]byte("k"))
+			if err == nil && !bytes.Equal(val, []byte("loaded")) {
+				err = errors.New("got " + string(val))
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	ready.Wait()
+	// Give the callers time to reach the loader before letting it finish.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+	if n := c.Metrics().LoadErrors; n != 0 {
+		t.Fatalf("LoadErrors = %d, want 0", n)
+	}
+}
+
+func TestLoaderErrorIsShared(t *testing.T) {
+	const callers = 100
+
+	var loads int32
+	release := make(chan struct{})
+	failure := errors.New("store down")
+	c := NewCache(WithLoader(LoaderFunc(func(key []byte) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return nil, 0, failure
+	})))
+
+	var ready, wg sync.WaitGroup
+	ready.Add(callers)
+	wg.Add(callers)
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			_, err := c.Get([]byte("k"))
+			errs <- err
+		}()
+	}
+	ready.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, failure) {
+			t.Errorf("Get error = %v, want %v", err, failure)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+
+	// A failed load isn't remembered.
+	if _, err := c.Get([]byte("k")); !errors.Is(err, failure) {
+		t.Fatalf("Get after failure = %v, want %v", err, failure)
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Fatalf("loader called %d times after retry, want 2", n)
+	}
+}
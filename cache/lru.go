@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrEntryTooLarge = errors.New("entry larger than MaxBytes")
+
+// listPolicy keeps keys in a list and evicts from the back. With promote
+// set, every use moves a key to the front, giving LRU; without it keys stay
+// in insertion order, giving FIFO.
+type listPolicy struct {
+	mu      sync.Mutex
+	promote bool
+	order   *list.List // front is most recently used (or added)
+	items   map[string]*list.Element
+}
+
+func newListPolicy(promote bool) *listPolicy {
+	return &listPolicy{promote: promote, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *listPolicy) add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(key)
+}
+
+func (l *listPolicy) use(key string) {
+	if !l.promote {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *listPolicy) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *listPolicy) next() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+func (l *listPolicy) isNext(key string) bool {
+	k, _ := l.next()
+	return k == key
+}
+
+// evictForMemory drops the keys the eviction policy picks until the cache is
+// back under MaxBytes. The keys may live in any shard, so callers must not
+// hold a shard lock; a write can briefly leave the cache over the limit until
+// its caller gets here.
+func (c *Cache) evictForMemory() {
+	if c.maxBytesLimit() <= 0 {
+		return
+	}
+	var events []evictEvent
+	for atomic.LoadInt64(&c.size) > c.maxBytesLimit() {
+		key, ok := c.policy.next()
+		if !ok {
+			break
+		}
+		sh := c.shardFor(key)
+		sh.lock.Lock()
+		// The key may have been used or removed since next picked it.
+		if !c.policy.isNext(key) {
+			sh.lock.Unlock()
+			continue
+		}
+		val, _ := c.remove(sh, key)
+		sh.lock.Unlock()
+		events = append(events, evictEvent{key: []byte(key), value: val, reason: EvictedForMemory})
+	}
+	if len(events) > 0 {
+		atomic.AddUint64(&c.metrics.EvictedKeys, uint64(len(events)))
+		c.logger.Debug("EVICTED for memory", "keys", len(events), "bytes", atomic.LoadInt64(&c.size))
+		c.notifyEvicted(events...)
+	}
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// A missFilter is a counting Bloom filter over the keys in the cache, so
+// lookups of keys that were never set can fail without taking a shard lock.
+// It can wrongly say a key might be present, which only costs the usual
+// lookup, but never wrongly says one is absent: put adds keys before storing
+// them and remove drops them after.
+//
+// Each key bumps filterHashes 8-bit counters, packed four to a word. A
+// counter that reaches 255 sticks there, since it can no longer tell how many
+// keys share it.
+type missFilter struct {
+	words []atomic.Uint32
+	mask  uint64 // number of counters - 1
+}
+
+const (
+	filterHashes      = 7
+	filterSlotsPerKey = 10 // about a 1% false positive rate at the expected key count
+)
+
+// newMissFilter sizes a filter for about expected keys. More keys only make
+// false positives more likely.
+func newMissFilter(expected int) *missFilter {
+	if expected <= 0 {
+		return nil
+	}
+	n := uint64(1) << bits.Len64(uint64(expected*filterSlotsPerKey-1))
+	n = max(n, 4)
+	return &missFilter{words: make([]atomic.Uint32, n/4), mask: n - 1}
+}
+
+// filterHash derives the two hashes the counters are picked with from
+// keyHash, mixed so they don't follow the shard a key is in.
+func filterHash(key string) (uint64, uint64) {
+	h := keyHash(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h, bits.RotateLeft64(h, 32) | 1
+}
+
+// mayContain reports whether key could be in the cache.
+func (f *missFilter) mayContain(key string) bool {
+	if f == nil {
+		return true
+	}
+	h1, h2 := filterHash(key)
+	for i := range uint64(filterHashes) {
+		pos := (h1 + i*h2) & f.mask
+		if f.words[pos/4].Load()>>(pos%4*8)&0xff == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *missFilter) add(key string) {
+	f.adjust(key, 1)
+}
+
+func (f *missFilter) remove(key string) {
+	f.adjust(key, -1)
+}
+
+func (f *missFilter) adjust(key string, delta int) {
+	if f == nil {
+		return
+	}
+	h1, h2 := filterHash(key)
+	for i := range uint64(filterHashes) {
+		pos := (h1 + i*h2) & f.mask
+		w, shift := &f.words[pos/4], pos%4*8
+		for {
+			old := w.Load()
+			count := old >> shift & 0xff
+			if count == 0xff || delta < 0 && count == 0 {
+				break
+			}
+			next := old + 1<<shift
+			if delta < 0 {
+				next = old - 1<<shift
+			}
+			if w.CompareAndSwap(old, next) {
+				break
+			}
+		}
+	}
+}
+
+// filteredMiss reports whether the filter rules key out, counting it as a
+// miss if so.
+func (c *Cache) filteredMiss(key string) bool {
+	if c.filter.mayContain(key) {
+		return false
+	}
+	atomic.AddUint64(&c.metrics.Misses, 1)
+	atomic.AddUint64(&c.metrics.MissFilterHits, 1)
+	return true
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNegativeCachingDisabled = errors.New("negative caching is not enabled")
+
+// MarkAbsent records that key doesn't exist in whatever the cache sits in
+// front of. Until the negative TTL runs out or the key is written, reads of
+// it fail with ErrKnownAbsent instead of a plain miss, so callers can skip
+// looking it up again. It fails with ErrKeyExists if the key is live.
+func (c *Cache) MarkAbsent(key []byte) error {
+	if c.negativeTTL <= 0 {
+		return ErrNegativeCachingDisabled
+	}
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	now := time.Now()
+	if sh.live(strKey, now) {
+		sh.lock.Unlock()
+		return ErrKeyExists
+	}
+	sh.absent[strKey] = now.Add(c.negativeTTL)
+	sh.lock.Unlock()
+
+	time.AfterFunc(c.negativeTTL, func() { c.forgetAbsent(strKey) })
+	c.logger.Debug("MARKABSENT", "key", strKey, "ttl", c.negativeTTL)
+	return nil
+}
+
+// rememberMiss marks key absent after a Get failed with err, when negative
+// caching is enabled, so repeated Gets of a key nobody has set are answered
+// from the marker and counted as NegativeHits. Keys the miss filter already
+// rules out aren't marked, as that answer is just as quick.
+func (c *Cache) rememberMiss(key string, err error) {
+	if c.negativeTTL <= 0 || (err != ErrKeyNotFound && err != ErrKeyExpired) || !c.filter.mayContain(key) {
+		return
+	}
+	// The key may have been set since the miss, in which case there is
+	// nothing to remember.
+	c.MarkAbsent([]byte(key))
+}
+
+// forgetAbsent drops key's absent marker if it has run out; it may have been
+// renewed since.
+func (c *Cache) forgetAbsent(key string) {
+	sh := c.shardFor(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if exp, ok := sh.absent[key]; ok && !time.Now().Before(exp) {
+		delete(sh.absent, key)
+	}
+}
+
+// miss counts a read that found nothing live under key and returns the error
+// for it, one of the bare sentinels so that a miss allocates nothing. Callers
+// must hold sh.lock.
+func (c *Cache) miss(sh *shard, key string, expired bool) error {
+	if expired {
+		c.queueExpire(key)
+	}
+	if exp, ok := sh.absent[key]; ok && time.Now().Before(exp) {
+		atomic.AddUint64(&c.metrics.NegativeHits, 1)
+		return ErrKnownAbsent
+	}
+	atomic.AddUint64(&c.metrics.Misses, 1)
+	if expired {
+		return ErrKeyExpired
+	}
+	return ErrKeyNotFound
+}
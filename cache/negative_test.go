@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// missCaches returns caches set up for each kind of miss, with key unset in
+// all of them and marked absent in the one with negative caching.
+func missCaches(t testing.TB, key []byte) map[string]*Cache {
+	t.Helper()
+	absent := NewCache(WithNegativeCaching(time.Hour))
+	if err := absent.MarkAbsent(key); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*Cache{
+		"notfound":    NewCache(),
+		"knownabsent": absent,
+	}
+}
+
+// TestMissAllocations guards the read path for keys that aren't there, which
+// a cache in front of a store hits constantly. The one allocation allowed is
+// Get copying the key into a string, which hits pay too; the error for a
+// miss must be a sentinel rather than one built per call.
+func TestMissAllocations(t *testing.T) {
+	key := []byte("missing")
+	for name, c := range missCaches(t, key) {
+		if _, err := c.Get(key); err == nil {
+			t.Fatalf("%s: Get found %s", name, key)
+		}
+		allocs := testing.AllocsPerRun(100, func() { c.Get(key) })
+		if allocs > 1 {
+			t.Errorf("%s: a missing Get allocates %v times, want at most 1", name, allocs)
+		}
+	}
+}
+
+// BenchmarkGetMiss reads a key that was never set, and one marked absent.
+func BenchmarkGetMiss(b *testing.B) {
+	key := []byte("missing")
+	for name, c := range missCaches(b, key) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.Get(key)
+			}
+		})
+	}
+}
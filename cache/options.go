@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures a Cache or PersistentCache at construction time.
+type Option func(*options)
+
+type options struct {
+	atomicBatches  bool
+	logger         *slog.Logger
+	logValues      bool
+	maxBytes       int64
+	maxKeyBytes    int
+	maxValueBytes  int
+	evictionPolicy EvictionPolicy
+	trackAccess    bool
+	negativeTTL    time.Duration
+	sliding        bool
+	loader         Loader
+	shards         int
+	compressAbove  int
+	missFilterKeys int
+	checksums      bool
+
+	wal     bool
+	walSync bool
+
+	compression Compression
+	format      Format
+}
+
+func buildOptions(opts []Option) options {
+	o := options{logger: slog.Default(), shards: defaultShards}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithAtomicBatches makes BatchSet all-or-nothing: if any pair fails
+// validation, none of the batch is applied.
+func WithAtomicBatches() Option {
+	return func(o *options) {
+		o.atomicBatches = true
+	}
+}
+
+// WithWAL makes a PersistentCache append every write to a log next to its
+// snapshot, so writes made since the last SaveToDisk survive a crash. With
+// sync set, each append is fsynced before the write returns. It has no
+// effect on a plain Cache.
+func WithWAL(sync bool) Option {
+	return func(o *options) {
+		o.wal = true
+		o.walSync = sync
+	}
+}
+
+// WithLogger sends the cache's logs to l instead of slog.Default(). Per-key
+// operations are logged at debug level, with values redacted unless
+// WithLogValues is also given.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithLogValues includes values, not just keys, in the cache's debug logs.
+// Values can hold secrets or personal data, so this is off by default.
+func WithLogValues() Option {
+	return func(o *options) {
+		o.logValues = true
+	}
+}
+
+// WithMaxBytes caps the approximate bytes held by keys and values. Writes
+// that take the cache over the limit evict keys chosen by the eviction policy
+// (see WithEvictionPolicy), and a single entry larger than the limit is
+// rejected with ErrEntryTooLarge.
+func WithMaxBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithMaxKeyBytes rejects writes of keys longer than n bytes with
+// ErrKeyTooLarge.
+func WithMaxKeyBytes(n int) Option {
+	return func(o *options) {
+		o.maxKeyBytes = n
+	}
+}
+
+// WithMaxValueBytes rejects writes of values longer than n bytes with
+// ErrValueTooLarge.
+func WithMaxValueBytes(n int) Option {
+	return func(o *options) {
+		o.maxValueBytes = n
+	}
+}
+
+// WithEvictionPolicy chooses which keys are evicted to stay under
+// WithMaxBytes (EvictLRU by default). It has no effect without a limit.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(o *options) {
+		o.evictionPolicy = p
+	}
+}
+
+// WithCompression compresses a PersistentCache's snapshots. Snapshots record
+// how they were written, so files saved with any setting, or before this
+// option existed, still load. It has no effect on a plain Cache.
+func WithCompression(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithFormat chooses how a PersistentCache writes its snapshots. By default
+// it is picked by the storage file's extension: JSON for .json, gob for
+// anything else. Snapshots load in either format whatever the setting. It
+// has no effect on a plain Cache.
+func WithFormat(f Format) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// WithMissFilter keeps a Bloom filter over the cache's keys, sized for about
+// expectedKeys, so most Gets of keys that don't exist fail without taking a
+// shard lock. It costs about 10 bytes per expected key whether or not they
+// are set, so it is off by default.
+func WithMissFilter(expectedKeys int) Option {
+	return func(o *options) {
+		o.missFilterKeys = expectedKeys
+	}
+}
+
+// WithValueCompression stores values longer than threshold bytes gzipped,
+// when that makes them smaller, and decompresses them on every read, trading
+// CPU for memory. Callers never see the compressed form, but a
+// PersistentCache's snapshots keep it. The memory limit counts values as
+// stored.
+func WithValueCompression(threshold int) Option {
+	return func(o *options) {
+		o.compressAbove = threshold
+	}
+}
+
+// WithChecksums keeps a CRC32 of every value as it is set and checks it when
+// the value is read by Get, GetWithVersion, MGet or Dump, which fail with
+// ErrCorrupt rather than return a damaged value. A PersistentCache's
+// snapshots keep the checksums, so values damaged on disk are caught too.
+func WithChecksums() Option {
+	return func(o *options) {
+		o.checksums = true
+	}
+}
+
+// WithAccessTracking counts reads and records the last read time of every
+// key, for HotKeys. It costs a little on every read, so it is off by default.
+func WithAccessTracking() Option {
+	return func(o *options) {
+		o.trackAccess = true
+	}
+}
+
+// WithShards splits the cache into n independently locked shards (16 by
+// default). More shards let more writers run in parallel; n of 1 puts every
+// key behind a single lock.
+func WithShards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// WithNegativeCaching enables MarkAbsent, with markers lasting ttl. A Get
+// that misses marks the key itself, as does a Loader that doesn't have it.
+func WithNegativeCaching(ttl time.Duration) Option {
+	return func(o *options) {
+		o.negativeTTL = ttl
+	}
+}
+
+// WithLoader makes Get fall back to l when a key isn't cached, caching
+// whatever it finds. Concurrent misses on the same key share one Load, and
+// its error if it fails. Keys marked with MarkAbsent aren't looked up, and
+// with negative caching, keys l doesn't have are marked. A PersistentCache doesn't log
+// loaded values to its WAL, since they can be loaded again.
+func WithLoader(l Loader) Option {
+	return func(o *options) {
+		o.loader = l
+	}
+}
+
+// WithSlidingExpiration makes every read that finds a key with a TTL push its
+// expiry back to the full TTL from now, so keys only expire once they go
+// unread for that long. See OnSlide.
+func WithSlidingExpiration() Option {
+	return func(o *options) {
+		o.sliding = true
+	}
+}
@@ -1,57 +1,520 @@
 package cache
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type PersistentCache struct {
 	*Cache
 	filePath string
 	lock     sync.Mutex
+	wal      *wal // nil unless WithWAL was given
+	fileLock *fileLock
+
+	compression Compression
+	format      Format
+
+	savedChanges uint64 // c.changes as of the last snapshot
 }
 
-func NewPersistentCache(filePath string) (*PersistentCache, error) {
+// NewPersistentCache loads the cache saved at filePath, if any. It fails with
+// ErrLocked if another process has filePath open; the lock is held until
+// Close.
+func NewPersistentCache(filePath string, opts ...Option) (*PersistentCache, error) {
+	o := buildOptions(opts)
+	if o.format == FormatAuto {
+		o.format = formatFor(filePath)
+	}
+	if o.format == FormatJSON && o.compression != CompressionNone {
+		return nil, errors.New("snapshot compression is only supported in the gob format")
+	}
+	lock, err := lockFile(filePath+".lock", filePath)
+	if err != nil {
+		return nil, err
+	}
 	c := &PersistentCache{
-		Cache:    NewCache(),
+		Cache:    NewCache(opts...),
 		filePath: filePath,
+		fileLock: lock,
+
+		compression: o.compression,
+		format:      o.format,
+	}
+
+	if err := c.loadFromDisk(); err != nil {
+		lock.release()
+		return nil, err
 	}
+	c.savedChanges = c.changes
 
-	// Load existing cache from disk if exists
-	if _, err := os.Stat(filePath); err == nil {
-		if err := c.loadFromDisk(); err != nil {
+	if o.wal {
+		w, err := openWAL(filePath+".wal", o.walSync, o.logger)
+		if err != nil {
+			lock.release()
 			return nil, err
 		}
+		if err := w.replay(c.applyWALRecord); err != nil {
+			w.file.Close()
+			lock.release()
+			return nil, err
+		}
+		c.wal = w
 	}
 
 	return c, nil
 }
 
+// Close releases the storage for another process to use. It does not save;
+// call SaveToDisk first to keep writes made since the last snapshot, if
+// there is no WAL.
+func (c *PersistentCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	if c.wal != nil {
+		err = c.wal.close()
+	}
+	if lerr := c.fileLock.release(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// applyWALRecord replays one logged write on top of the loaded snapshot.
+func (c *PersistentCache) applyWALRecord(r walRecord) {
+	switch r.op {
+	case walSet, walSetVersion:
+		var ttl time.Duration
+		if r.expireAt != 0 {
+			ttl = time.Until(time.Unix(0, r.expireAt))
+			if ttl <= 0 {
+				c.Cache.Delete([]byte(r.key))
+				return
+			}
+		}
+		if r.op == walSet {
+			c.Cache.Set([]byte(r.key), r.value, ttl)
+			return
+		}
+		c.Cache.restore([]byte(r.key), r.value, ttl, r.version, func(*shard, string) error { return nil })
+	case walDel:
+		c.Cache.Delete([]byte(r.key))
+	}
+}
+
+// logged runs fn and, when a WAL is configured, logs the records it returns.
+func (c *PersistentCache) logged(fn func() ([]walRecord, error)) error {
+	if c.wal == nil {
+		_, err := fn()
+		return err
+	}
+	return c.wal.apply(fn)
+}
+
+func (c *PersistentCache) Set(key, value []byte, ttl time.Duration) error {
+	return c.logged(func() ([]walRecord, error) {
+		if err := c.Cache.Set(key, value, ttl); err != nil {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+}
+
+func (c *PersistentCache) SetCtx(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, value, ttl)
+}
+
+func (c *PersistentCache) CompareAndSwap(key, expected, value []byte, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if swapped, err = c.Cache.CompareAndSwap(key, expected, value, ttl); err != nil || !swapped {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+	return swapped, err
+}
+
+func (c *PersistentCache) CompareAndSwapVersion(key []byte, version uint64, value []byte, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if swapped, err = c.Cache.CompareAndSwapVersion(key, version, value, ttl); err != nil || !swapped {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+	return swapped, err
+}
+
+func (c *PersistentCache) BatchSet(pairs map[string][]byte, ttl time.Duration) error {
+	return c.logged(func() ([]walRecord, error) {
+		err := c.Cache.BatchSet(pairs, ttl)
+		var batchErr *BatchError
+		if err != nil && !(errors.As(err, &batchErr) && batchErr.Applied) {
+			return nil, err
+		}
+		recs := make([]walRecord, 0, len(pairs))
+		for k, v := range pairs {
+			if batchErr != nil && batchErr.Rejected[k] != nil {
+				continue
+			}
+			recs = append(recs, c.setRecord(k, v, ttl))
+		}
+		return recs, err
+	})
+}
+
+func (c *PersistentCache) BatchSetNX(pairs map[string][]byte, ttl time.Duration) (bool, error) {
+	var written bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if written, err = c.Cache.BatchSetNX(pairs, ttl); err != nil || !written {
+			return nil, err
+		}
+		recs := make([]walRecord, 0, len(pairs))
+		for k, v := range pairs {
+			recs = append(recs, c.setRecord(k, v, ttl))
+		}
+		return recs, nil
+	})
+	return written, err
+}
+
+func (c *PersistentCache) ApplyBatch(ops []Operation) ([]bool, error) {
+	var applied []bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if applied, err = c.Cache.ApplyBatch(ops); err != nil {
+			return nil, err
+		}
+		recs := make([]walRecord, 0, len(ops))
+		for i, op := range ops {
+			switch {
+			case op.Kind == OpDelete:
+				recs = append(recs, walRecord{op: walDel, key: string(op.Key)})
+			case applied[i]:
+				recs = append(recs, c.setRecord(string(op.Key), op.Value, op.TTL))
+			}
+		}
+		return recs, nil
+	})
+	return applied, err
+}
+
+func (c *PersistentCache) Delete(key []byte) (bool, error) {
+	var existed bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if existed, err = c.Cache.Delete(key); err != nil {
+			return nil, err
+		}
+		return []walRecord{{op: walDel, key: string(key)}}, nil
+	})
+	return existed, err
+}
+
+func (c *PersistentCache) DeleteCtx(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.Delete(key)
+}
+
+func (c *PersistentCache) MDel(keys [][]byte) (int, error) {
+	var n int
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if n, err = c.Cache.MDel(keys); err != nil {
+			return nil, err
+		}
+		recs := make([]walRecord, len(keys))
+		for i, k := range keys {
+			recs[i] = walRecord{op: walDel, key: string(k)}
+		}
+		return recs, nil
+	})
+	return n, err
+}
+
+func (c *PersistentCache) Restore(key, payload []byte, replace bool) error {
+	return c.logged(func() ([]walRecord, error) {
+		if err := c.Cache.Restore(key, payload, replace); err != nil {
+			return nil, err
+		}
+		value, ttl, _ := DecodeDump(payload)
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+}
+
+func (c *PersistentCache) ApplyDump(key, payload []byte) (bool, error) {
+	var applied bool
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if applied, err = c.Cache.ApplyDump(key, payload); err != nil || !applied {
+			return nil, err
+		}
+		value, ttl, _ := DecodeDump(payload)
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+	return applied, err
+}
+
+func (c *PersistentCache) Rename(src, dst []byte) error {
+	return c.logged(func() ([]walRecord, error) {
+		value, ttl, _, err := c.Cache.move(src, dst, -1, true, true)
+		if err != nil || string(src) == string(dst) {
+			return nil, err
+		}
+		return []walRecord{{op: walDel, key: string(src)}, c.setRecord(string(dst), value, ttl)}, nil
+	})
+}
+
+func (c *PersistentCache) Copy(src, dst []byte, replace bool) (bool, error) {
+	return c.CopyTTL(src, dst, -1, replace)
+}
+
+func (c *PersistentCache) CopyTTL(src, dst []byte, ttl time.Duration, replace bool) (bool, error) {
+	var copied bool
+	err := c.logged(func() ([]walRecord, error) {
+		var value []byte
+		var err error
+		value, ttl, copied, err = c.Cache.move(src, dst, ttl, false, replace)
+		if err != nil || !copied || string(src) == string(dst) {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(dst), value, ttl)}, nil
+	})
+	return copied, err
+}
+
+func (c *PersistentCache) Append(key, value []byte) (int, error) {
+	var n int
+	err := c.logged(func() ([]walRecord, error) {
+		val, ttl, err := c.Cache.appendValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		n = len(val)
+		return []walRecord{c.setRecord(string(key), val, ttl)}, nil
+	})
+	return n, err
+}
+
+func (c *PersistentCache) GetDel(key []byte) ([]byte, error) {
+	var val []byte
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if val, err = c.Cache.GetDel(key); err != nil {
+			return nil, err
+		}
+		return []walRecord{{op: walDel, key: string(key)}}, nil
+	})
+	return val, err
+}
+
+func (c *PersistentCache) GetEx(key []byte, ttl time.Duration) ([]byte, error) {
+	var val []byte
+	err := c.logged(func() ([]walRecord, error) {
+		var err error
+		if val, ttl, err = c.Cache.getEx(key, ttl); err != nil {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(key), val, ttl)}, nil
+	})
+	return val, err
+}
+
+func (c *PersistentCache) ResetTTL(key []byte, ttl time.Duration) (time.Duration, error) {
+	err := c.logged(func() ([]walRecord, error) {
+		var value []byte
+		var err error
+		value, ttl, err = c.Cache.resetTTL(key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []walRecord{c.setRecord(string(key), value, ttl)}, nil
+	})
+	return ttl, err
+}
+
+// setRecord logs a write of key that has just been made, at the version it
+// was given. Only logged writes store values, so nothing can have changed the
+// version since.
+func (c *PersistentCache) setRecord(key string, value []byte, ttl time.Duration) walRecord {
+	return setRecord(key, value, ttl, c.versionOf(key))
+}
+
+// ImportJSON is Cache.ImportJSON, with every entry logged to the WAL.
+func (c *PersistentCache) ImportJSON(r io.Reader) (int, error) {
+	return importJSON(r, c.Set)
+}
+
+// loadFromDisk loads the snapshot, falling back to the previous one in
+// filePath.bak if it is missing or damaged. Having neither is not an error.
 func (c *PersistentCache) loadFromDisk() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	file, err := os.Open(c.filePath)
+	snap, err := loadSnapshot(c.filePath)
 	if err != nil {
-		return err
+		bak, bakErr := loadSnapshot(c.filePath + ".bak")
+		switch {
+		case bakErr == nil:
+			if !errors.Is(err, os.ErrNotExist) {
+				c.logger.Warn("snapshot unreadable, loaded previous snapshot instead", "path", c.filePath, "err", err)
+			}
+			snap = bak
+		case errors.Is(err, os.ErrNotExist) && errors.Is(bakErr, os.ErrNotExist):
+			return nil
+		case errors.Is(err, os.ErrNotExist):
+			return bakErr
+		default:
+			return err
+		}
 	}
-	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	return decoder.Decode(&c.data)
+	// replaceData evicts down to the memory limit, which may have been
+	// lowered since the snapshot was taken. Nothing can be listening for
+	// evictions yet, so their events are dropped.
+	c.replaceData(snap, true)
+	return nil
 }
 
+// loadSnapshot loads the snapshot at path, in whichever format it was
+// written.
+func loadSnapshot(path string) (*snapshotData, error) {
+	format, err := sniffFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatJSON {
+		return readJSONSnapshot(path)
+	}
+	snap := &snapshotData{}
+	err = readSnapshot(path, func(r io.Reader, version byte) error {
+		if version < 2 {
+			return gob.NewDecoder(r).Decode(&snap.Data)
+		}
+		return gob.NewDecoder(r).Decode(snap)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// SaveToDisk writes a snapshot of the cache without holding up writes for
+// more than a brief pause at a time (see snapshotChunk). With a WAL, the
+// records the snapshot covers are dropped from the log afterwards.
+//
+// BenchmarkSnapshotWriteStall on 1M keys and a single CPU core puts a Set's
+// p99 at 6µs while a save runs, against 3µs with none (10µs against 7µs with
+// a WAL). The slowest Set took 85ms against 9ms (122ms against 22ms), most
+// of it waiting for the core the encoder was using.
 func (c *PersistentCache) SaveToDisk() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	file, err := os.Create(c.filePath)
-	if err != nil {
+	if c.wal == nil {
+		return c.saveSnapshot()
+	}
+	return c.wal.checkpoint(c.saveSnapshot)
+}
+
+func (c *PersistentCache) saveSnapshot() error {
+	changes := atomic.LoadUint64(&c.changes)
+	snap := c.copyData()
+
+	if err := c.writeData(c.filePath, snap); err != nil {
 		return err
 	}
-	defer file.Close()
+	atomic.StoreUint64(&c.savedChanges, changes)
+	return nil
+}
+
+// writeData writes snap to path in the cache's format.
+func (c *PersistentCache) writeData(path string, snap *snapshotData) error {
+	if c.format == FormatJSON {
+		return writeJSONSnapshot(path, snap, c.logger)
+	}
+	return writeSnapshot(path, c.compression, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(snap)
+	})
+}
+
+// snapshotChunk is how many keys copyData copies per hold of a shard's read
+// lock, which bounds how long a write can be held up by a snapshot. Copying 1M keys
+// takes around half a second in total, which is how long every write would
+// stall if the lock were held throughout; in chunks of 1024 the worst pause
+// measured was about 3ms, and typically well under 1ms.
+const snapshotChunk = 1024
+
+// copyData copies the cache for a snapshot a shard at a time, releasing the
+// read lock every snapshotChunk keys so writers can get in. The copy is not a
+// single point-in-time view: a key written while it runs may appear with
+// either its old or new value, and a key added may be missed. The WAL, if any, covers
+// those writes; without one they are picked up by the next snapshot.
+func (c *PersistentCache) copyData() *snapshotData {
+	var n, nexp int
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		n, nexp = n+len(sh.data), nexp+len(sh.expiry)
+		sh.lock.RUnlock()
+	}
+
+	snap := &snapshotData{
+		Data:     make(map[string][]byte, n),
+		Expiry:   make(map[string]time.Time, nexp),
+		Created:  make(map[string]time.Time, n),
+		Versions: make(map[string]uint64, n),
+		Packed:   make(map[string]int),
+		Sums:     make(map[string]uint32),
+	}
+
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		i := 0
+		// The spec allows a map to change between steps of a range loop;
+		// the lock keeps each step from racing with a writer.
+		for k, v := range sh.data {
+			snap.Data[k] = v // values are never modified in place
+			if exp, ok := sh.expiry[k]; ok {
+				snap.Expiry[k] = exp
+			}
+			if created, ok := sh.created[k]; ok {
+				snap.Created[k] = created
+			}
+			snap.Versions[k] = sh.version[k]
+			if n, ok := sh.packed[k]; ok {
+				snap.Packed[k] = n
+			}
+			if want, ok := sh.sums[k]; ok {
+				snap.Sums[k] = want
+			}
+			if i++; i%snapshotChunk == 0 {
+				sh.lock.RUnlock()
+				sh.lock.RLock()
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	return snap
+}
 
-	encoder := gob.NewEncoder(file)
-	return encoder.Encode(c.data)
+// Dirty reports how many writes have been made since the last snapshot.
+func (c *PersistentCache) Dirty() uint64 {
+	return atomic.LoadUint64(&c.changes) - atomic.LoadUint64(&c.savedChanges)
 }
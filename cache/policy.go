@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+// EvictionPolicy selects which keys are evicted once the cache is over
+// MaxBytes.
+type EvictionPolicy byte
+
+const (
+	EvictLRU    EvictionPolicy = iota // least recently used
+	EvictLFU                          // least frequently used, oldest first among equals
+	EvictFIFO                         // oldest write of a new key
+	EvictRandom                       // any key, uniformly
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictFIFO:
+		return "fifo"
+	case EvictRandom:
+		return "random"
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", byte(p))
+}
+
+// ParseEvictionPolicy maps a name such as "lfu" to an EvictionPolicy.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	case "fifo":
+		return EvictFIFO, nil
+	case "random":
+		return EvictRandom, nil
+	}
+	return 0, fmt.Errorf("unsupported eviction policy %q (want lru, lfu, fifo or random)", name)
+}
+
+// policy does an EvictionPolicy's bookkeeping and picks the next key to
+// evict. Implementations have their own lock, so that reads, which only hold
+// a shard's read lock, can still record a use.
+type policy interface {
+	add(key string) // a new key was stored
+	use(key string) // an existing key was read or overwritten
+	remove(key string)
+	next() (string, bool)
+	// isNext reports whether key is still the one to evict, after the
+	// caller has locked its shard.
+	isNext(key string) bool
+}
+
+func newPolicy(p EvictionPolicy) policy {
+	switch p {
+	case EvictLFU:
+		return newLFUPolicy()
+	case EvictFIFO:
+		return newListPolicy(false)
+	case EvictRandom:
+		return newRandomPolicy()
+	}
+	return newListPolicy(true)
+}
+
+// lfuPolicy groups keys into lists by use count, so that adding, using and
+// picking a key are all constant time. Within a count, the key used longest
+// ago goes first. A new key starts at the lowest count in use rather than at
+// 1, or it would always be the next to go and never get the chance to be used.
+type lfuPolicy struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element // Value is *lfuEntry
+	buckets map[uint64]*list.List    // front is most recently used
+	min     uint64                   // lowest count with a bucket, if any
+}
+
+type lfuEntry struct {
+	key   string
+	count uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[string]*list.Element), buckets: make(map[uint64]*list.List)}
+}
+
+func (l *lfuPolicy) push(key string, count uint64) {
+	b := l.buckets[count]
+	if b == nil {
+		b = list.New()
+		l.buckets[count] = b
+	}
+	l.items[key] = b.PushFront(&lfuEntry{key: key, count: count})
+}
+
+// unlink takes e out of its bucket, dropping the bucket once it is empty.
+func (l *lfuPolicy) unlink(e *list.Element) *lfuEntry {
+	entry := e.Value.(*lfuEntry)
+	b := l.buckets[entry.count]
+	b.Remove(e)
+	if b.Len() == 0 {
+		delete(l.buckets, entry.count)
+	}
+	return entry
+}
+
+func (l *lfuPolicy) add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.unlink(e)
+		delete(l.items, key)
+	}
+	count := uint64(1)
+	if len(l.items) > 0 {
+		count = l.lowest()
+	}
+	l.push(key, count)
+	l.min = count
+}
+
+func (l *lfuPolicy) use(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return
+	}
+	entry := l.unlink(e)
+	if entry.count == l.min && l.buckets[entry.count] == nil {
+		l.min++
+	}
+	l.push(key, entry.count+1)
+}
+
+func (l *lfuPolicy) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.unlink(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfuPolicy) next() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.items) == 0 {
+		return "", false
+	}
+	return l.buckets[l.lowest()].Back().Value.(*lfuEntry).key, true
+}
+
+// lowest returns the lowest count any key has. There must be at least one.
+func (l *lfuPolicy) lowest() uint64 {
+	// Removals can leave min pointing at a bucket that has gone.
+	if l.buckets[l.min] == nil {
+		l.min = 0
+		for count := range l.buckets {
+			if l.min == 0 || count < l.min {
+				l.min = count
+			}
+		}
+	}
+	return l.min
+}
+
+func (l *lfuPolicy) isNext(key string) bool {
+	k, _ := l.next()
+	return k == key
+}
+
+// randomPolicy keeps keys in a slice, indexed for constant-time removal.
+type randomPolicy struct {
+	mu    sync.Mutex
+	keys  []string
+	index map[string]int
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{index: make(map[string]int)}
+}
+
+func (r *randomPolicy) add(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.index[key]; ok {
+		return
+	}
+	r.index[key] = len(r.keys)
+	r.keys = append(r.keys, key)
+}
+
+func (r *randomPolicy) use(string) {}
+
+func (r *randomPolicy) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.index[key]
+	if !ok {
+		return
+	}
+	last := len(r.keys) - 1
+	r.keys[i] = r.keys[last]
+	r.index[r.keys[i]] = i
+	r.keys = r.keys[:last]
+	delete(r.index, key)
+}
+
+func (r *randomPolicy) next() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.keys) == 0 {
+		return "", false
+	}
+	return r.keys[rand.IntN(len(r.keys))], true
+}
+
+// isNext reports whether key is still present: any key will do.
+func (r *randomPolicy) isNext(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.index[key]
+	return ok
+}
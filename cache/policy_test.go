@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Every entry in these tests is a 1-byte key and a 9-byte value, so a cache
+// of policyTestMax bytes holds exactly three.
+const policyTestMax = 30
+
+// runPolicy applies ops to a fresh cache using p and returns the keys left,
+// sorted. "set k" stores k and "get k" reads it.
+func runPolicy(t *testing.T, p EvictionPolicy, ops string) string {
+	t.Helper()
+	c := NewCache(WithMaxBytes(policyTestMax), WithEvictionPolicy(p))
+	for _, op := range strings.Split(ops, ",") {
+		cmd, key, _ := strings.Cut(strings.TrimSpace(op), " ")
+		switch cmd {
+		case "set":
+			if err := c.Set([]byte(key), []byte("123456789"), 0); err != nil {
+				t.Fatalf("%s: %v", op, err)
+			}
+		case "get":
+			if _, err := c.Get([]byte(key)); err != nil {
+				t.Fatalf("%s: %v", op, err)
+			}
+		default:
+			t.Fatalf("bad op %q", op)
+		}
+	}
+	var keys []string
+	for _, k := range c.Keys() {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "")
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy EvictionPolicy
+		ops    string
+		want   string
+	}{
+		// a is read after b, so b is the least recently used.
+		{EvictLRU, "set a, set b, set c, get a, set d", "acd"},
+		// Reading a then d leaves c used longest ago.
+		{EvictLRU, "set a, set b, set c, get a, set d, get c, get a, set e", "ace"},
+		// Overwriting counts as a use.
+		{EvictLRU, "set a, set b, set c, set a, set d", "acd"},
+
+		// c is the only key with a single use.
+		{EvictLFU, "set a, set b, set c, get a, get a, get b, set d", "abd"},
+		// Among keys used equally often, the one used longest ago goes.
+		{EvictLFU, "set a, set b, set c, get a, get b, get c, set d", "bcd"},
+		// A new key starts at the lowest count in use, not at 1: d is
+		// stored with a count of 1 like c, then used twice. e starts level
+		// with b, which was used longer ago.
+		{EvictLFU, "set a, set b, set c, get a, get a, get a, get b, set d, get d, get d, set e", "ade"},
+
+		// Reads and overwrites don't change the order keys were added in.
+		{EvictFIFO, "set a, set b, set c, get a, set a, set d", "bcd"},
+		{EvictFIFO, "set a, set b, set c, set d, get b, set e", "cde"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String()+": "+tt.ops, func(t *testing.T) {
+			if got := runPolicy(t, tt.policy, tt.ops); got != tt.want {
+				t.Fatalf("keys left = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEvictRandom can't predict which keys go, only that the limit holds and
+// the policy's bookkeeping stays consistent.
+func TestEvictRandom(t *testing.T) {
+	c := NewCache(WithMaxBytes(policyTestMax), WithEvictionPolicy(EvictRandom))
+	const n = 100
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%c", 'A'+i%58))
+		if err := c.Set(key, []byte("123456789"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if size := atomic.LoadInt64(&c.size); size > policyTestMax {
+			t.Fatalf("cache holds %d bytes, over its %d limit", size, policyTestMax)
+		}
+	}
+	if got := c.DBSize(); got != policyTestMax/10 {
+		t.Fatalf("%d keys left, want %d", got, policyTestMax/10)
+	}
+
+	// The policy's index must agree with its slice after all that removal.
+	r := c.policy.(*randomPolicy)
+	if len(r.keys) != len(r.index) || len(r.keys) != c.DBSize() {
+		t.Fatalf("policy tracks %d keys and indexes %d; the cache has %d", len(r.keys), len(r.index), c.DBSize())
+	}
+	for i, k := range r.keys {
+		if r.index[k] != i {
+			t.Fatalf("key %s is at %d but indexed at %d", k, i, r.index[k])
+		}
+	}
+}
+
+func TestEvictionPolicyInMetrics(t *testing.T) {
+	for _, p := range []EvictionPolicy{EvictLRU, EvictLFU, EvictFIFO, EvictRandom} {
+		c := NewCache(WithMaxBytes(policyTestMax), WithEvictionPolicy(p))
+		if got := c.Metrics().EvictionPolicy; got != p.String() {
+			t.Errorf("Metrics().EvictionPolicy = %q, want %q", got, p)
+		}
+	}
+	if got := NewCache().Metrics().EvictionPolicy; got != "" {
+		t.Errorf("EvictionPolicy without MaxBytes = %q, want none", got)
+	}
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+// Rename moves src's value, TTL and version to dst in one step, replacing
+// whatever dst held. It fails if src doesn't exist or has expired; renaming
+// a key to itself otherwise changes nothing.
+func (c *Cache) Rename(src, dst []byte) error {
+	_, _, _, err := c.move(src, dst, -1, true, true)
+	return err
+}
+
+// Copy sets dst to a copy of src's value, with src's version and remaining
+// TTL, and reports whether it did. Unless replace is set, it leaves a live
+// dst as it is and reports false. It fails if src doesn't exist or has
+// expired; copying a key to itself otherwise changes nothing. The copy has
+// its own bytes, so nothing done to one key's value can show up in the
+// other's.
+func (c *Cache) Copy(src, dst []byte, replace bool) (bool, error) {
+	return c.CopyTTL(src, dst, -1, replace)
+}
+
+// CopyTTL is Copy with dst expiring after ttl as in Set. A negative ttl
+// keeps src's remaining TTL, as Copy does.
+func (c *Cache) CopyTTL(src, dst []byte, ttl time.Duration, replace bool) (bool, error) {
+	_, _, copied, err := c.move(src, dst, ttl, false, replace)
+	return copied, err
+}
+
+// move does Rename, or Copy unless remove is set, under the locks of both
+// keys' shards, and returns the value and TTL dst was given and whether it
+// was written at all.
+func (c *Cache) move(src, dst []byte, ttl time.Duration, remove, replace bool) ([]byte, time.Duration, bool, error) {
+	s, d := string(src), string(dst)
+	unlock := c.lockShards([]string{s, d}, true)
+	ssh, dsh := c.shardFor(s), c.shardFor(d)
+
+	now := time.Now()
+	value, ok := ssh.value(s)
+	if !ok {
+		unlock()
+		return nil, 0, false, &KeyError{Key: s, Err: ErrKeyNotFound}
+	}
+	// Keeping src's TTL keeps the one Touch would restore as well as the
+	// time remaining.
+	var original time.Duration
+	if exp, exists := ssh.expiry[s]; exists {
+		if !now.Before(exp) {
+			unlock()
+			return nil, 0, false, &KeyError{Key: s, Err: ErrKeyExpired}
+		}
+		if ttl < 0 {
+			ttl = exp.Sub(now)
+			original = ssh.ttl[s]
+		}
+	}
+	ttl = max(ttl, 0)
+	if !replace && dsh.live(d, now) {
+		unlock()
+		return nil, 0, false, nil
+	}
+	if s == d {
+		unlock()
+		return value, ttl, true, nil
+	}
+	if err := c.checkSize(d, value); err != nil {
+		unlock()
+		return nil, 0, false, err
+	}
+	if !remove {
+		value = bytes.Clone(value)
+	}
+
+	version := ssh.version[s]
+	var events []evictEvent
+	if remove {
+		c.remove(ssh, s)
+		events = append(events, evictEvent{key: src, value: value, reason: Deleted})
+	}
+	c.put(dsh, d, value, version)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+	if dsh.setTTL(d, ttl, now) {
+		if original > 0 {
+			dsh.ttl[d] = original
+		}
+		go c.startEviction(d, ttl)
+	}
+	unlock()
+
+	if remove {
+		c.logger.Debug("RENAME", "key", s, "to", d)
+	} else {
+		c.logger.Debug("COPY", "key", s, "to", d, "ttl", ttl)
+	}
+	c.notifyEvicted(events...)
+	c.evictForMemory()
+	return value, ttl, true, nil
+}
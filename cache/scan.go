@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+type scanEntry struct {
+	hash uint64
+	key  string
+}
+
+func (a scanEntry) less(b scanEntry) bool {
+	if a.hash != b.hash {
+		return a.hash < b.hash
+	}
+	return a.key < b.key
+}
+
+// scanHeap is a max-heap, so the largest candidate can be evicted once the
+// page is full.
+type scanHeap []scanEntry
+
+func (h scanHeap) Len() int           { return len(h) }
+func (h scanHeap) Less(i, j int) bool { return h[j].less(h[i]) }
+func (h scanHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x any)        { *h = append(*h, x.(scanEntry)) }
+func (h *scanHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// keyHash is 64-bit FNV-1a, written out so hashing a key to pick its shard
+// doesn't allocate.
+func keyHash(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
+
+// Scan returns up to count live keys in hash order starting at cursor, along
+// with the cursor to pass to the next call (0 once the keyspace is
+// exhausted). Keys that exist for the whole iteration are returned at least
+// once regardless of concurrent writes. Keys sharing a hash are never split
+// across pages, so a page may occasionally exceed count.
+//
+// Only count keys are held at a time, so scanning a large cache page by page
+// does not materialize the whole keyspace the way Keys does. Shards are
+// locked one at a time.
+func (c *Cache) Scan(cursor uint64, count int) ([][]byte, uint64) {
+	if count <= 0 {
+		count = 10
+	}
+
+	now := time.Now()
+	h := make(scanHeap, 0, count)
+	more := false
+	for _, sh := range c.shards {
+		sh.lock.RLock()
+		for k := range sh.data {
+			if !sh.live(k, now) {
+				continue
+			}
+			e := scanEntry{hash: keyHash(k), key: k}
+			if e.hash < cursor {
+				continue
+			}
+			if len(h) < count {
+				heap.Push(&h, e)
+				continue
+			}
+			more = true
+			if e.less(h[0]) {
+				h[0] = e
+				heap.Fix(&h, 0)
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	if len(h) == 0 {
+		return nil, 0
+	}
+
+	last := h[0].hash
+	page := []scanEntry(h)
+	if more {
+		// Pull in any keys that share the boundary hash but lost out above.
+		// They all hash to the same shard.
+		seen := make(map[string]bool, len(page))
+		for _, e := range page {
+			seen[e.key] = true
+		}
+		sh := c.shards[last%uint64(len(c.shards))]
+		sh.lock.RLock()
+		for k := range sh.data {
+			if sh.live(k, now) && !seen[k] && keyHash(k) == last {
+				page = append(page, scanEntry{hash: last, key: k})
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].less(page[j]) })
+
+	keys := make([][]byte, len(page))
+	for i, e := range page {
+		keys[i] = []byte(e.key)
+	}
+	if !more || last == ^uint64(0) {
+		return keys, 0
+	}
+	return keys, last + 1
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShards is how many shards a Cache is split into unless WithShards
+// says otherwise.
+const defaultShards = 16
+
+// shard holds the keys that hash to it under its own lock, so writes to
+// different shards don't contend. Counters, the size accounting and the
+// eviction policy are shared by every shard and updated atomically or under
+// their own locks.
+type shard struct {
+	lock    sync.RWMutex
+	data    map[string][]byte
+	expiry  map[string]time.Time
+	created map[string]time.Time
+	version map[string]uint64
+	ttl     map[string]time.Duration // the TTL each key in expiry was last given
+	access  map[string]*keyAccess    // nil unless WithAccessTracking was given
+	absent  map[string]time.Time     // MarkAbsent expiry; nil unless WithNegativeCaching was given
+	slid    map[string]struct{}      // keys reads have slid since their timer was set; nil unless WithSlidingExpiration was given
+	packed  map[string]int           // length of each value stored gzipped; nil unless WithValueCompression was given
+	sums    map[string]uint32        // checksum of each value as set; nil unless WithChecksums was given
+}
+
+func newShard(trackAccess, negative, sliding, compress, checksums bool) *shard {
+	s := &shard{
+		data:    make(map[string][]byte),
+		expiry:  make(map[string]time.Time),
+		created: make(map[string]time.Time),
+		version: make(map[string]uint64),
+		ttl:     make(map[string]time.Duration),
+	}
+	if trackAccess {
+		s.access = make(map[string]*keyAccess)
+	}
+	if negative {
+		s.absent = make(map[string]time.Time)
+	}
+	if sliding {
+		s.slid = make(map[string]struct{})
+	}
+	if compress {
+		s.packed = make(map[string]int)
+	}
+	if checksums {
+		s.sums = make(map[string]uint32)
+	}
+	return s
+}
+
+// setTTL makes key expire ttl after now, or never if ttl isn't positive, and
+// reports whether it will expire. Callers must hold s.lock, and start its
+// eviction if it will.
+func (s *shard) setTTL(key string, ttl time.Duration, now time.Time) bool {
+	if ttl <= 0 {
+		delete(s.expiry, key)
+		delete(s.ttl, key)
+		return false
+	}
+	s.expiry[key] = now.Add(ttl)
+	s.ttl[key] = ttl
+	return true
+}
+
+// live reports whether key is present and not past its TTL. Callers must
+// hold s.lock.
+func (s *shard) live(key string, now time.Time) bool {
+	if _, ok := s.data[key]; !ok {
+		return false
+	}
+	exp, exists := s.expiry[key]
+	return !exists || !now.After(exp)
+}
+
+func (c *Cache) shardIndex(key string) int {
+	return int(keyHash(key) % uint64(len(c.shards)))
+}
+
+func (c *Cache) shardFor(key string) *shard {
+	return c.shards[c.shardIndex(key)]
+}
+
+// lockShards locks every shard holding one of keys, for writing or reading,
+// and returns a func that unlocks them. Shards are always locked in index
+// order, so multi-key operations can't deadlock with each other.
+func (c *Cache) lockShards(keys []string, write bool) (unlock func()) {
+	used := make([]bool, len(c.shards))
+	for _, k := range keys {
+		used[c.shardIndex(k)] = true
+	}
+	var locked []*shard
+	for i, sh := range c.shards {
+		if !used[i] {
+			continue
+		}
+		if write {
+			sh.lock.Lock()
+		} else {
+			sh.lock.RLock()
+		}
+		locked = append(locked, sh)
+	}
+	return func() {
+		for _, sh := range locked {
+			if write {
+				sh.lock.Unlock()
+			} else {
+				sh.lock.RUnlock()
+			}
+		}
+	}
+}
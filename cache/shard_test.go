@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// benchKeys is the key space the shard benchmarks spread their work over.
+var benchKeys = func() [][]byte {
+	keys := make([][]byte, 1<<16)
+	for i := range keys {
+		keys[i] = []byte("key-" + strconv.Itoa(i))
+	}
+	return keys
+}()
+
+// BenchmarkSetParallel has every goroutine Set random keys. A single shard
+// is the old single-lock cache; with more, writers to different shards stop
+// waiting on each other. Run it with -cpu 1,8,32 to see throughput scale
+// with the shard count.
+func BenchmarkSetParallel(b *testing.B) {
+	value := []byte("0123456789abcdef")
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewCache(WithShards(shards))
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for pb.Next() {
+					c.Set(benchKeys[r.IntN(len(benchKeys))], value, 0)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMixedParallel has every goroutine run nine Gets to every Set of
+// random keys, over a cache already holding them all. A single shard is the
+// old single-lock cache, under which each Set shuts out every Get; with more,
+// only the Gets on its own shard wait. Run it with -cpu 1,8,32 to see
+// throughput scale with the shard count.
+func BenchmarkMixedParallel(b *testing.B) {
+	value := []byte("0123456789abcdef")
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewCache(WithShards(shards))
+			for _, k := range benchKeys {
+				c.Set(k, value, 0)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for i := 0; pb.Next(); i++ {
+					key := benchKeys[r.IntN(len(benchKeys))]
+					if i%10 == 0 {
+						c.Set(key, value, 0)
+					} else {
+						c.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
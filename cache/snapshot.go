@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot file is a fixed header followed by a gob payload:
+//
+//	magic (4) | version (1) | compression (1) | payload length (8) | CRC32 of payload (4)
+//
+// The length and CRC cover the payload as stored, i.e. after compression.
+// Versions 1 and 2 have no compression byte. Version 1 payloads, and files
+// written before the header existed, are a bare gob map of values; later
+// payloads are a snapshotData. All are still accepted on load.
+var snapshotMagic = []byte("DCSN")
+
+const snapshotVersion = 3
+
+// Compression selects how snapshot payloads are compressed on disk.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+// ParseCompression maps a name such as "gzip" to a Compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	}
+	return 0, fmt.Errorf("unsupported compression %q (want none or gzip)", name)
+}
+
+// Format selects how snapshots are written to disk: gob, the default, is
+// compact and fast, while JSON can be read and edited by other tools.
+type Format byte
+
+const (
+	FormatAuto Format = iota // by the file's extension; see WithFormat
+	FormatGob
+	FormatJSON
+)
+
+// ParseFormat maps a name such as "json" to a Format.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "", "auto":
+		return FormatAuto, nil
+	case "gob":
+		return FormatGob, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unsupported format %q (want auto, gob or json)", name)
+}
+
+type snapshotData struct {
+	Data    map[string][]byte
+	Expiry  map[string]time.Time // absolute expiry times
+	Created map[string]time.Time // absent from older version 2 files
+
+	// Versions is absent from files written before keys had versions; their
+	// keys are given new ones on load.
+	Versions map[string]uint64
+
+	// Packed holds the length of each value in Data that is stored gzipped,
+	// as WithValueCompression keeps it. It is absent from files written
+	// before values were compressed.
+	Packed map[string]int
+
+	// Sums holds the checksum of each value in Data as it was set, as
+	// WithChecksums keeps it. It is absent from files written without it.
+	Sums map[string]uint32
+}
+
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// countingHash tracks the length and CRC of the bytes passing through it.
+type countingHash struct {
+	hash.Hash32
+	n int64
+}
+
+func (h *countingHash) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	return h.Hash32.Write(p)
+}
+
+func headerLen(version byte) int64 {
+	if version < 3 {
+		return 4 + 1 + 8 + 4
+	}
+	return 4 + 1 + 1 + 8 + 4
+}
+
+// readSnapshot streams the payload of the snapshot at path through decode,
+// decompressing it as needed, and then verifies its length and checksum.
+// decode is told the format version; 0 means a headerless legacy file.
+func readSnapshot(path string, decode func(r io.Reader, version byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	if magic, _ := br.Peek(len(snapshotMagic)); !bytes.Equal(magic, snapshotMagic) {
+		if err := decode(br, 0); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, err)
+		}
+		return nil
+	}
+
+	header := make([]byte, headerLen(snapshotVersion))
+	if _, err := io.ReadFull(br, header[:len(snapshotMagic)+1]); err != nil {
+		return fmt.Errorf("%w: %s: truncated header", ErrCorruptSnapshot, path)
+	}
+	version := header[4]
+	if version == 0 || version > snapshotVersion {
+		return fmt.Errorf("%s: unsupported snapshot version %d", path, version)
+	}
+	header = header[:headerLen(version)]
+	if _, err := io.ReadFull(br, header[5:]); err != nil {
+		return fmt.Errorf("%w: %s: truncated header", ErrCorruptSnapshot, path)
+	}
+	compression := CompressionNone
+	if version >= 3 {
+		compression = Compression(header[5])
+	}
+	size := binary.BigEndian.Uint64(header[len(header)-12:])
+	sum := binary.BigEndian.Uint32(header[len(header)-4:])
+
+	h := &countingHash{Hash32: crc32.NewIEEE()}
+	stored := io.TeeReader(io.LimitReader(br, int64(size)), h)
+	var r io.Reader = stored
+	switch compression {
+	case CompressionNone:
+	case CompressionGzip:
+		gz, err := gzip.NewReader(stored)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, err)
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return fmt.Errorf("%s: unknown compression %d", path, compression)
+	}
+
+	decodeErr := decode(r, version)
+	// Hash whatever the decoder left unread before checking the sum.
+	io.Copy(io.Discard, stored)
+	if uint64(h.n) != size {
+		return fmt.Errorf("%w: %s: expected %d payload bytes, found %d", ErrCorruptSnapshot, path, size, h.n)
+	}
+	if h.Sum32() != sum {
+		return fmt.Errorf("%w: %s: checksum mismatch", ErrCorruptSnapshot, path)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, decodeErr)
+	}
+	return nil
+}
+
+// writeSnapshot replaces the file at path with a snapshot whose payload is
+// streamed out by encode, by way of replaceFile.
+func writeSnapshot(path string, compression Compression, encode func(w io.Writer) error) error {
+	return replaceFile(path, func(f *os.File) error {
+		// Reserve the header and fill it in once the payload's length and
+		// checksum are known.
+		if _, err := f.Write(make([]byte, headerLen(snapshotVersion))); err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		h := &countingHash{Hash32: crc32.NewIEEE()}
+		stored := io.MultiWriter(bw, h)
+
+		var err error
+		switch compression {
+		case CompressionNone:
+			err = encode(stored)
+		case CompressionGzip:
+			gz := gzip.NewWriter(stored)
+			if err = encode(gz); err == nil {
+				err = gz.Close()
+			}
+		default:
+			err = fmt.Errorf("unknown compression %d", compression)
+		}
+		if err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+
+		header := make([]byte, 0, headerLen(snapshotVersion))
+		header = append(header, snapshotMagic...)
+		header = append(header, snapshotVersion, byte(compression))
+		header = binary.BigEndian.AppendUint64(header, uint64(h.n))
+		header = binary.BigEndian.AppendUint32(header, h.Sum32())
+		_, err = f.WriteAt(header, 0)
+		return err
+	})
+}
+
+// replaceFile replaces the file at path with what write puts in f, without
+// ever leaving a partial file in its place: the data goes to a temp file in
+// the same directory, is fsynced, and is renamed over path. The previous
+// file is kept as path.bak.
+func replaceFile(path string, write func(f *os.File) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	defer tmp.Close()
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, path+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
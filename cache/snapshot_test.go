@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// saveTestSnapshot writes a snapshot holding key=value to path and returns
+// the file's bytes.
+func saveTestSnapshot(t *testing.T, path, key, value string) []byte {
+	t.Helper()
+	c, err := NewPersistentCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set([]byte(key), []byte(value), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCorruptSnapshotRejected(t *testing.T) {
+	good := saveTestSnapshot(t, filepath.Join(t.TempDir(), "cache.db"), "k", "v")
+	header := int(headerLen(snapshotVersion))
+
+	tests := []struct {
+		name    string
+		corrupt func([]byte) []byte
+	}{
+		{"truncated header", func(b []byte) []byte { return b[:header-3] }},
+		{"truncated payload", func(b []byte) []byte { return b[:header+(len(b)-header)/2] }},
+		{"flipped checksum byte", func(b []byte) []byte { b[header-1] ^= 0xff; return b }},
+		{"flipped payload byte", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.db")
+			data := tt.corrupt(append([]byte(nil), good...))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadSnapshot(path); !errors.Is(err, ErrCorruptSnapshot) {
+				t.Fatalf("loadSnapshot = %v, want ErrCorruptSnapshot", err)
+			}
+			if _, err := NewPersistentCache(path); !errors.Is(err, ErrCorruptSnapshot) {
+				t.Fatalf("NewPersistentCache = %v, want ErrCorruptSnapshot", err)
+			}
+		})
+	}
+}
+
+func TestCorruptSnapshotFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	saveTestSnapshot(t, path, "k", "old")
+	// Saving again keeps the first snapshot as the backup.
+	data := saveTestSnapshot(t, path, "k", "new")
+	if err := os.WriteFile(path, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewPersistentCache(path)
+	if err != nil {
+		t.Fatalf("NewPersistentCache with a good backup: %v", err)
+	}
+	defer c.Close()
+	if got, err := c.Get([]byte("k")); err != nil || string(got) != "old" {
+		t.Fatalf("Get = %q, %v; want the backup's %q", got, err, "old")
+	}
+}
+
+// BenchmarkSnapshotWriteStall saves a cache of 1M keys (100k with -short)
+// once per iteration while a writer keeps calling Set, and reports how long
+// the slowest Sets took: p99-stall-ms and max-stall-ms. It then times as many
+// Sets again with no snapshot running, for p99-baseline-ms and
+// max-baseline-ms. copyData's chunking is meant to keep writes from waiting
+// on the snapshot for more than a few milliseconds. With a single CPU the
+// writer also waits its turn to run beside the encoder, which shows up in
+// max-stall-ms; run it with -cpu 2 or more to see the locking alone.
+func BenchmarkSnapshotWriteStall(b *testing.B) {
+	keys := 1_000_000
+	if testing.Short() {
+		keys = 100_000
+	}
+	for _, wal := range []bool{false, true} {
+		name := "nowal"
+		var opts []Option
+		if wal {
+			name = "wal"
+			opts = append(opts, WithWAL(false))
+		}
+		b.Run(name, func(b *testing.B) {
+			c, err := NewPersistentCache(filepath.Join(b.TempDir(), "cache.db"), opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			value := []byte("0123456789abcdef0123456789abcdef")
+			for i := 0; i < keys; i++ {
+				c.Cache.Set([]byte("key-"+strconv.Itoa(i)), value, 0)
+			}
+			set := func(j int) time.Duration {
+				start := time.Now()
+				if err := c.Set([]byte("key-"+strconv.Itoa(j%keys)), value, 0); err != nil {
+					b.Fatal(err)
+				}
+				return time.Since(start)
+			}
+
+			var stalls []time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done := make(chan error, 1)
+				go func() { done <- c.SaveToDisk() }()
+				for j := 0; ; j++ {
+					select {
+					case err := <-done:
+						if err != nil {
+							b.Fatal(err)
+						}
+					default:
+						stalls = append(stalls, set(j))
+						continue
+					}
+					break
+				}
+			}
+			b.StopTimer()
+
+			baseline := make([]time.Duration, len(stalls))
+			for j := range baseline {
+				baseline[j] = set(j)
+			}
+			ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+			for _, m := range []struct {
+				name string
+				d    []time.Duration
+			}{{"stall", stalls}, {"baseline", baseline}} {
+				slices.Sort(m.d)
+				b.ReportMetric(ms(m.d[len(m.d)*99/100]), "p99-"+m.name+"-ms")
+				b.ReportMetric(ms(m.d[len(m.d)-1]), "max-"+m.name+"-ms")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// A JSON snapshot is newline-delimited JSON: a header line, then one line per
+// key, sorted by key so two snapshots diff cleanly.
+//
+//	{"format":"distcache-snapshot","version":1,"keys":2}
+//	{"key":"a","value":"MQ==","version":7,"created":"2024-05-01T10:00:00Z"}
+//	{"key":"b","value":"Mg==","expires":"2024-05-01T11:00:00Z"}
+//
+// Values are base64-encoded, and always stored uncompressed. Keys that aren't
+// valid UTF-8 are written base64-encoded as key_base64 instead. The header's
+// key count lets a truncated file be told apart from a smaller cache, since
+// there is no checksum; nor are the checksums kept by WithChecksums written,
+// so a value edited by hand loads with a new one.
+const jsonSnapshotFormat = "distcache-snapshot"
+
+type jsonSnapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Keys    int    `json:"keys"`
+}
+
+type jsonSnapshotEntry struct {
+	Key       string     `json:"key,omitempty"`
+	KeyBase64 []byte     `json:"key_base64,omitempty"`
+	Value     []byte     `json:"value"`
+	Version   uint64     `json:"version,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// formatFor returns the format a storage file at path is written in by
+// default.
+func formatFor(path string) Format {
+	if filepath.Ext(path) == ".json" {
+		return FormatJSON
+	}
+	return FormatGob
+}
+
+// sniffFormat reports which format the snapshot at path was written in.
+func sniffFormat(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	first := make([]byte, 1)
+	if n, _ := f.Read(first); n == 1 && first[0] == '{' {
+		return FormatJSON, nil
+	}
+	return FormatGob, nil
+}
+
+// writeJSONSnapshot replaces the file at path with snap in the JSON format,
+// by way of replaceFile. Compressed values in snap are unpacked in place;
+// any that can't be are logged and left out.
+func writeJSONSnapshot(path string, snap *snapshotData, logger *slog.Logger) error {
+	for k, size := range snap.Packed {
+		v, err := unpack(snap.Data[k], size)
+		if err != nil {
+			logger.Warn("left key with corrupt compressed value out of snapshot", "key", k, "err", err)
+			delete(snap.Data, k)
+			continue
+		}
+		snap.Data[k] = v
+	}
+	keys := make([]string, 0, len(snap.Data))
+	for k := range snap.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return replaceFile(path, func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+		enc := json.NewEncoder(bw)
+		err := enc.Encode(jsonSnapshotHeader{Format: jsonSnapshotFormat, Version: 1, Keys: len(keys)})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			e := jsonSnapshotEntry{Value: snap.Data[k], Version: snap.Versions[k]}
+			if utf8.ValidString(k) {
+				e.Key = k
+			} else {
+				e.KeyBase64 = []byte(k)
+			}
+			if created, ok := snap.Created[k]; ok {
+				e.Created = &created
+			}
+			if exp, ok := snap.Expiry[k]; ok {
+				e.Expires = &exp
+			}
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+// readJSONSnapshot loads the JSON snapshot at path.
+func readJSONSnapshot(path string) (*snapshotData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap, err := decodeJSONSnapshot(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, err)
+	}
+	return snap, nil
+}
+
+func decodeJSONSnapshot(r io.Reader) (*snapshotData, error) {
+	dec := json.NewDecoder(r)
+	var h jsonSnapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	if h.Format != jsonSnapshotFormat {
+		return nil, fmt.Errorf("not a snapshot: format is %q, want %q", h.Format, jsonSnapshotFormat)
+	}
+	if h.Version != 1 {
+		return nil, fmt.Errorf("unsupported JSON snapshot version %d", h.Version)
+	}
+
+	snap := &snapshotData{
+		Data:     make(map[string][]byte, h.Keys),
+		Expiry:   make(map[string]time.Time),
+		Created:  make(map[string]time.Time, h.Keys),
+		Versions: make(map[string]uint64, h.Keys),
+	}
+	for n := 1; ; n++ {
+		var e jsonSnapshotEntry
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", n, err)
+		}
+		k := e.Key
+		if k == "" {
+			k = string(e.KeyBase64)
+		}
+		if k == "" {
+			return nil, fmt.Errorf("entry %d: empty key", n)
+		}
+		snap.Data[k] = e.Value
+		if e.Version != 0 {
+			snap.Versions[k] = e.Version
+		}
+		if e.Created != nil {
+			snap.Created[k] = *e.Created
+		}
+		if e.Expires != nil {
+			snap.Expiry[k] = *e.Expires
+		}
+	}
+	if len(snap.Data) != h.Keys {
+		return nil, fmt.Errorf("header says %d keys, found %d; the file may be truncated", h.Keys, len(snap.Data))
+	}
+	return snap, nil
+}
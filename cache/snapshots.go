@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Named snapshots are point-in-time copies of the cache kept alongside the
+// storage file, in a directory named after it with .snapshots appended. They
+// are written in the same format, and never touched by SaveToDisk.
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ErrNoSnapshot is returned for a snapshot name with no file behind it.
+var ErrNoSnapshot = errors.New("no such snapshot")
+
+// SnapshotInfo describes a named snapshot on disk.
+type SnapshotInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func (c *PersistentCache) snapshotDir() string {
+	return c.filePath + ".snapshots"
+}
+
+func (c *PersistentCache) snapshotPath(name string) (string, error) {
+	if !snapshotName.MatchString(name) {
+		return "", fmt.Errorf("invalid snapshot name %q: use up to 64 letters, digits, - and _", name)
+	}
+	return filepath.Join(c.snapshotDir(), name), nil
+}
+
+// SaveSnapshot writes the cache to the snapshot called name, replacing any
+// snapshot already called that, and returns how many keys it holds. Like
+// SaveToDisk it only briefly holds up writes, and isn't a single
+// point-in-time view of keys written while it runs.
+func (c *PersistentCache) SaveSnapshot(name string) (int, error) {
+	path, err := c.snapshotPath(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(c.snapshotDir(), 0o755); err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	snap := c.copyData()
+	if err := c.writeData(path, snap); err != nil {
+		return 0, err
+	}
+	// writeSnapshot keeps the file it replaced as a backup, which only
+	// matters for the live file.
+	os.Remove(path + ".bak")
+	return len(snap.Data), nil
+}
+
+// Snapshots lists the named snapshots, oldest first.
+func (c *PersistentCache) Snapshots() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(c.snapshotDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []SnapshotInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !snapshotName.MatchString(e.Name()) {
+			continue // temp files from a save in progress
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue // removed since the directory was read
+		}
+		infos = append(infos, SnapshotInfo{Name: e.Name(), Size: fi.Size(), Modified: fi.ModTime()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Modified.Before(infos[j].Modified) })
+	return infos, nil
+}
+
+// RestoreSnapshot replaces everything in the cache with the snapshot called
+// name, and returns the keys it loaded and those it dropped for not being in
+// the snapshot; keys that have expired since it was taken are left out. The
+// snapshot is read in full first, so a missing or damaged one changes
+// nothing, and the swap happens with every shard locked, so no reader sees a
+// mix of the two. The restored data is then saved as the live snapshot, so
+// it is what a restart loads.
+//
+// Restored keys are given new versions, as if each had just been set, and
+// the dropped keys are reported to OnEvict as Deleted.
+func (c *PersistentCache) RestoreSnapshot(name string) (loaded, dropped [][]byte, err error) {
+	path, err := c.snapshotPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	snap, err := loadSnapshot(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w %q", ErrNoSnapshot, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	loaded, events := c.replaceData(snap, false)
+	c.notifyEvicted(events...)
+	for _, e := range events {
+		dropped = append(dropped, e.key)
+	}
+	if c.wal == nil {
+		err = c.saveSnapshot()
+	} else {
+		err = c.wal.checkpoint(c.saveSnapshot)
+	}
+	if err != nil {
+		return loaded, dropped, fmt.Errorf("restored %d keys but couldn't save them: %w", len(loaded), err)
+	}
+	return loaded, dropped, nil
+}
+
+// replaceData swaps the cache's contents for snap's under every shard's
+// write lock, then evicts down to the memory limit. It returns the keys it
+// loaded, and a Deleted event for each key it dropped that snap doesn't
+// hold. Loaded keys keep their recorded versions if keepVersions is set.
+func (c *Cache) replaceData(snap *snapshotData, keepVersions bool) ([][]byte, []evictEvent) {
+	for _, sh := range c.shards {
+		sh.lock.Lock()
+	}
+	var dropped []evictEvent
+	for _, sh := range c.shards {
+		for k := range sh.data {
+			val, _ := c.remove(sh, k)
+			if _, kept := snap.Data[k]; !kept {
+				dropped = append(dropped, evictEvent{key: []byte(k), value: val, reason: Deleted})
+			}
+		}
+	}
+	loaded := c.fill(snap, time.Now(), keepVersions)
+	for _, sh := range c.shards {
+		sh.lock.Unlock()
+	}
+	c.evictForMemory()
+	return loaded, dropped
+}
+
+// fill loads snap's keys into the cache and returns them. Keys that expired
+// while the snapshot sat on disk are dropped; the rest get their eviction
+// rescheduled for whatever TTL they have left. Callers must hold every
+// shard's lock for writing.
+func (c *Cache) fill(snap *snapshotData, now time.Time, keepVersions bool) [][]byte {
+	loaded := make([][]byte, 0, len(snap.Data))
+	for k, v := range snap.Data {
+		exp, ok := snap.Expiry[k]
+		if ok && !now.Before(exp) {
+			continue
+		}
+		// Compressed values are unpacked and packed again, which checks
+		// them and follows the current WithValueCompression setting.
+		if size, packed := snap.Packed[k]; packed {
+			var err error
+			if v, err = unpack(v, size); err != nil {
+				c.logger.Warn("dropped key with corrupt compressed value from snapshot", "key", k, "err", err)
+				continue
+			}
+		}
+		var version uint64
+		if keepVersions {
+			version = snap.Versions[k]
+		}
+		sh := c.shardFor(k)
+		c.put(sh, k, v, version)
+		// Keeping the recorded checksum rather than the one put worked out
+		// lets reads catch values damaged on disk.
+		if want, ok := snap.Sums[k]; ok && sh.sums != nil {
+			sh.sums[k] = want
+		}
+		if created, ok := snap.Created[k]; ok {
+			sh.created[k] = created
+		}
+		// Snapshots don't record the TTL keys were set with, so what is
+		// left of it stands in for Touch.
+		if ok && sh.setTTL(k, exp.Sub(now), now) {
+			go c.startEviction(k, exp.Sub(now))
+		}
+		loaded = append(loaded, []byte(k))
+	}
+	return loaded
+}
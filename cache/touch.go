@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"time"
+)
+
+// Touch marks each of keys that exists as recently used, so the eviction
+// policy passes it over, and returns how many it marked. Nothing else about
+// them changes, their TTLs included, and they don't count as hits or misses.
+// Keys that don't exist or have expired are skipped without an error.
+func (c *Cache) Touch(keys [][]byte) (int, error) {
+	n := 0
+	now := time.Now()
+	for _, key := range keys {
+		strKey := string(key)
+		sh := c.shardFor(strKey)
+		sh.lock.Lock()
+		if sh.live(strKey, now) {
+			if c.policy != nil {
+				c.policy.use(strKey)
+			}
+			sh.recordTouch(strKey, now)
+			n++
+		}
+		sh.lock.Unlock()
+	}
+	return n, nil
+}
+
+// ResetTTL pushes key's expiry back to ttl from now, keeping its value and
+// version, and returns the TTL it now has. A negative ttl reuses the TTL the
+// key was last given, and 0 removes its expiry. The key also counts as
+// recently used for eviction, as with Touch. It fails if the key doesn't
+// exist or has expired.
+func (c *Cache) ResetTTL(key []byte, ttl time.Duration) (time.Duration, error) {
+	_, ttl, err := c.resetTTL(key, ttl)
+	return ttl, err
+}
+
+// resetTTL does ResetTTL and also returns the key's value.
+func (c *Cache) resetTTL(key []byte, ttl time.Duration) ([]byte, time.Duration, error) {
+	strKey := string(key)
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	now := time.Now()
+	value, ok := sh.value(strKey)
+	if !ok {
+		sh.lock.Unlock()
+		return nil, 0, &KeyError{Key: strKey, Err: ErrKeyNotFound}
+	}
+	if !sh.live(strKey, now) {
+		sh.lock.Unlock()
+		return nil, 0, &KeyError{Key: strKey, Err: ErrKeyExpired}
+	}
+	if ttl < 0 {
+		ttl = sh.ttl[strKey]
+	}
+	if sh.setTTL(strKey, ttl, now) {
+		go c.startEviction(strKey, ttl)
+	}
+	if c.policy != nil {
+		c.policy.use(strKey)
+	}
+	sh.recordTouch(strKey, now)
+	sh.lock.Unlock()
+
+	c.logger.Debug("TOUCH", "key", strKey, "ttl", ttl)
+	return value, max(ttl, 0), nil
+}
+
+// SlideFunc is called with a key whose expiry a read has just pushed back,
+// and the TTL it was pushed back to.
+type SlideFunc func(key []byte, ttl time.Duration)
+
+// OnSlide registers fn to be called after each read that pushes a key's
+// expiry back under WithSlidingExpiration. Callbacks run on the reading
+// goroutine, outside the shard locks, so they should be quick.
+func (c *Cache) OnSlide(fn SlideFunc) {
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+	var hooks []SlideFunc
+	if p := c.slideHooks.Load(); p != nil {
+		hooks = append(hooks, *p...)
+	}
+	hooks = append(hooks, fn)
+	c.slideHooks.Store(&hooks)
+}
+
+// slide pushes back the expiry of keys reads have just found live, if
+// WithSlidingExpiration was given. Rather than start a timer per read, it
+// marks the key so the timer already running for it reschedules itself.
+func (c *Cache) slide(keys ...string) {
+	if !c.sliding {
+		return
+	}
+	var hooks []SlideFunc
+	if p := c.slideHooks.Load(); p != nil {
+		hooks = *p
+	}
+	now := time.Now()
+	for _, key := range keys {
+		sh := c.shardFor(key)
+		sh.lock.Lock()
+		ttl, ok := sh.ttl[key]
+		ok = ok && sh.live(key, now)
+		if ok {
+			sh.expiry[key] = now.Add(ttl)
+			sh.slid[key] = struct{}{}
+		}
+		sh.lock.Unlock()
+
+		if ok {
+			for _, fn := range hooks {
+				fn([]byte(key), ttl)
+			}
+		}
+	}
+}
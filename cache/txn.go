@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OpKind is what an Operation does.
+type OpKind byte
+
+const (
+	OpSet OpKind = iota
+	OpDelete
+)
+
+// Operation is one write in an ApplyBatch. A set with a Version stores its
+// value at exactly that version, or is skipped if the key is already at that
+// version or a later one, as ApplyDump does; followers apply their leader's
+// transactions this way.
+type Operation struct {
+	Kind    OpKind
+	Key     []byte
+	Value   []byte
+	TTL     time.Duration
+	Version uint64
+}
+
+// ApplyBatch applies ops in order while holding the write locks of every
+// shard they touch, so readers see all of them or none. It reports for each
+// op whether it took effect; a delete only does if its key was live. If any
+// op is invalid, none are applied.
+func (c *Cache) ApplyBatch(ops []Operation) ([]bool, error) {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = string(op.Key)
+		switch op.Kind {
+		case OpSet:
+			err := validatePair(keys[i], op.Value)
+			if err == nil {
+				err = c.checkSize(keys[i], op.Value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("key (%s): %w", keys[i], err)
+			}
+		case OpDelete:
+		default:
+			return nil, fmt.Errorf("unknown operation %d", op.Kind)
+		}
+	}
+
+	unlock := c.lockShards(keys, true)
+	now := time.Now()
+	applied := make([]bool, len(ops))
+	var events []evictEvent
+	for i, op := range ops {
+		k := keys[i]
+		sh := c.shardFor(k)
+		if op.Kind == OpDelete {
+			applied[i] = sh.live(k, now)
+			if val, ok := c.remove(sh, k); ok {
+				events = append(events, evictEvent{key: op.Key, value: val, reason: Deleted})
+			}
+			if applied[i] {
+				atomic.AddUint64(&c.metrics.Deletes, 1)
+			} else {
+				atomic.AddUint64(&c.metrics.DeleteMisses, 1)
+			}
+			continue
+		}
+		if op.Version != 0 && sh.version[k] >= op.Version {
+			continue
+		}
+		c.put(sh, k, op.Value, op.Version)
+		sh.setTTL(k, op.TTL, now)
+		atomic.AddUint64(&c.metrics.Sets, 1)
+		applied[i] = true
+	}
+	unlock()
+
+	for i, op := range ops {
+		if op.Kind == OpSet && applied[i] && op.TTL > 0 {
+			go c.startEviction(keys[i], op.TTL)
+		}
+	}
+	c.logger.Debug("APPLY BATCH", "ops", len(ops))
+	c.notifyEvicted(events...)
+	c.evictForMemory()
+	return applied, nil
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Every write that stores a value gives the key a new version, taken from a
+// counter shared by all keys. Versions therefore only ever go up, even across
+// a delete and re-create, so a stale version can never match again.
+
+func (c *Cache) nextVersion() uint64 {
+	return atomic.AddUint64(&c.version, 1)
+}
+
+// observeVersion makes sure versions handed out later are above v, which was
+// assigned elsewhere: by a leader, or before a restart.
+func (c *Cache) observeVersion(v uint64) {
+	for {
+		cur := atomic.LoadUint64(&c.version)
+		if cur >= v || atomic.CompareAndSwapUint64(&c.version, cur, v) {
+			return
+		}
+	}
+}
+
+// versionOf returns key's current version, or 0 if it is not set.
+func (c *Cache) versionOf(key string) uint64 {
+	sh := c.shardFor(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.version[key]
+}
+
+// GetWithVersion is Get, also returning the key's version for
+// CompareAndSwapVersion.
+func (c *Cache) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	strKey := string(key)
+	val, version, err := c.read(strKey)
+	if err != nil {
+		c.rememberMiss(strKey, err)
+		return nil, 0, err
+	}
+	c.slide(strKey)
+	return val, version, nil
+}
+
+// CompareAndSwapVersion sets key to value, with ttl as in Set, only if the
+// key is currently at version, and reports whether it did. A version of 0
+// means the key must not exist (or have expired).
+func (c *Cache) CompareAndSwapVersion(key []byte, version uint64, value []byte, ttl time.Duration) (bool, error) {
+	strKey := string(key)
+	if err := c.checkSize(strKey, value); err != nil {
+		return false, err
+	}
+
+	sh := c.shardFor(strKey)
+	sh.lock.Lock()
+	current := uint64(0)
+	if sh.live(strKey, time.Now()) {
+		current = sh.version[strKey]
+	}
+	if current != version {
+		sh.lock.Unlock()
+		c.logger.Debug("CASVERSION mismatch", "key", strKey, "version", version, "current", current)
+		return false, nil
+	}
+	c.put(sh, strKey, value, 0)
+	atomic.AddUint64(&c.metrics.Sets, 1)
+	if sh.setTTL(strKey, ttl, time.Now()) {
+		go c.startEviction(strKey, ttl)
+	}
+	sh.lock.Unlock()
+
+	c.logger.Debug("CASVERSION", "key", strKey, c.valueAttr(value), "ttl", ttl)
+	c.evictForMemory()
+	return true, nil
+}
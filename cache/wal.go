@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type walOp byte
+
+const (
+	walSet walOp = iota + 1
+	walDel
+	walSetVersion // walSet, plus the version the key was given
+)
+
+type walRecord struct {
+	op       walOp
+	key      string
+	value    []byte
+	expireAt int64  // unix nanoseconds, 0 for no expiry
+	version  uint64 // walSetVersion only
+}
+
+// wal is an append-only log of writes made since the last snapshot. Each
+// record is framed as a 4-byte length and a 4-byte CRC32 of the payload, so
+// a record torn by a crash is detected and discarded on replay.
+type wal struct {
+	mu     sync.Mutex
+	file   *os.File
+	sync   bool
+	logger *slog.Logger
+}
+
+func openWAL(path string, sync bool, logger *slog.Logger) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{file: file, sync: sync, logger: logger}, nil
+}
+
+func (r walRecord) encode(buf *bytes.Buffer) {
+	var payload bytes.Buffer
+	payload.WriteByte(byte(r.op))
+	binary.Write(&payload, binary.BigEndian, r.expireAt)
+	var n [binary.MaxVarintLen64]byte
+	payload.Write(n[:binary.PutUvarint(n[:], uint64(len(r.key)))])
+	payload.WriteString(r.key)
+	if r.op == walSetVersion {
+		payload.Write(n[:binary.PutUvarint(n[:], r.version)])
+	}
+	payload.Write(r.value)
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(header[:])
+	buf.Write(payload.Bytes())
+}
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	var r walRecord
+	if len(payload) < 9 {
+		return r, errors.New("short record")
+	}
+	r.op = walOp(payload[0])
+	r.expireAt = int64(binary.BigEndian.Uint64(payload[1:9]))
+	keyLen, n := binary.Uvarint(payload[9:])
+	if n <= 0 || uint64(len(payload)-9-n) < keyLen {
+		return r, errors.New("bad key length")
+	}
+	rest := payload[9+n:]
+	r.key = string(rest[:keyLen])
+	rest = rest[keyLen:]
+	if r.op == walSetVersion {
+		if r.version, n = binary.Uvarint(rest); n <= 0 {
+			return r, errors.New("bad version")
+		}
+		rest = rest[n:]
+	}
+	r.value = rest
+	return r, nil
+}
+
+// apply runs fn and appends the records it returns while still holding the
+// log lock, so the order of records in the log matches the order writes hit
+// the cache. fn reports only what it actually changed; its records are logged
+// even alongside an error, for writes that partly succeed.
+func (w *wal) apply(fn func() ([]walRecord, error)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recs, err := fn()
+	if len(recs) > 0 {
+		var buf bytes.Buffer
+		for _, r := range recs {
+			r.encode(&buf)
+		}
+		if _, werr := w.file.Write(buf.Bytes()); werr != nil {
+			return fmt.Errorf("wal append: %w", werr)
+		}
+		if w.sync {
+			if serr := w.file.Sync(); serr != nil {
+				return fmt.Errorf("wal sync: %w", serr)
+			}
+		}
+	}
+	return err
+}
+
+// replay feeds every intact record to fn in order. A torn or corrupt tail,
+// as left by a crash mid-append, is logged and cut off.
+func (w *wal) replay(fn func(walRecord)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.file)
+	var good int64
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			break
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			break
+		}
+		fn(rec)
+		good += int64(len(header) + len(payload))
+	}
+
+	w.logger.Warn("WAL has a damaged tail, truncating", "path", w.file.Name(), "offset", good)
+	return w.file.Truncate(good)
+}
+
+// checkpoint runs snapshot and then drops the records it made redundant.
+// Writes carry on while the snapshot runs: only records logged before it
+// started are dropped, and since every write is logged after it hits the
+// cache, those are all reflected in the snapshot. Replaying the rest on top of
+// it recovers everything written since.
+func (w *wal) checkpoint(snapshot func() error) error {
+	w.mu.Lock()
+	info, err := w.file.Stat()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	mark := info.Size()
+
+	if err := snapshot(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.trim(mark); err != nil {
+		return fmt.Errorf("wal trim: %w", err)
+	}
+	return nil
+}
+
+// trim discards the first n bytes of the log. Callers must hold w.mu.
+func (w *wal) trim(n int64) error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == n {
+		return w.file.Truncate(0)
+	}
+
+	// Copy the tail written during the snapshot into a fresh file and swap
+	// it in, so a crash part way leaves the old, longer log intact.
+	tail := make([]byte, info.Size()-n)
+	if _, err := w.file.ReadAt(tail, n); err != nil {
+		return err
+	}
+	path := w.file.Name()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, tail, 0o644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	w.file.Close()
+	w.file = f
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+func setRecord(key string, value []byte, ttl time.Duration, version uint64) walRecord {
+	r := walRecord{op: walSetVersion, key: key, value: value, version: version}
+	if ttl > 0 {
+		r.expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	return r
+}
@@ -0,0 +1,832 @@
+// Package client is a Go client for the cache server. A Client is safe for
+// concurrent use; each command borrows a connection from an internal pool.
+package client
+
+import (
+	"bufio"
+	"context"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for a key that does not exist or has expired.
+	ErrNotFound = errors.New("key not found")
+	// ErrKnownAbsent is returned for a key marked with MarkAbsent.
+	ErrKnownAbsent = errors.New("key is known to be absent")
+	ErrClosed      = errors.New("client is closed")
+)
+
+// Client talks to one cache server. Errors the server replies with are
+// returned as *protocol.ResponseError; any other error is a problem reaching
+// it.
+//
+// With WithReplicas, Get, GetWithVersion, MGet and Has are sent to one of
+// the server's followers instead. A follower that can't be reached is passed
+// over for the next, and the server itself is asked if none can be. Since a
+// follower may not have caught up with a write, a key it doesn't have is
+// looked for on the server too before the read reports it missing; use
+// ReadFromLeader to skip the followers altogether.
+type Client struct {
+	addr     string
+	opts     options
+	replicas *replicaSet // nil without WithReplicas
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+	done   chan struct{} // closed by Close to stop keepAlive
+}
+
+type conn struct {
+	net.Conn
+	r         *bufio.Reader
+	idleSince time.Time
+}
+
+// New connects to the server at addr, checking that it can be reached and
+// speaks the framed protocol.
+func New(addr string, opts ...Option) (*Client, error) {
+	c := &Client{addr: addr, opts: buildOptions(opts), done: make(chan struct{})}
+	cn, err := c.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c.put(cn)
+	if len(c.opts.replicas) > 0 {
+		c.replicas = newReplicaSet(c.opts.replicas, opts, c.opts.replicaSelection)
+	}
+	if c.opts.keepAlive > 0 {
+		go c.keepAlive()
+	}
+	return c, nil
+}
+
+// Close closes the idle connections. Commands still running finish, and
+// their connections are closed as they come back.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	idle := c.idle
+	c.idle, c.closed = nil, true
+	close(c.done)
+	c.mu.Unlock()
+	for _, cn := range idle {
+		cn.Close()
+	}
+	if c.replicas != nil {
+		c.replicas.close()
+	}
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	hello := &protocol.Message{Cmd: protocol.CMDHello, Version: protocol.ProtoFramed}
+	if _, err := cn.roundTrip(ctx, hello); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("handshake with %s: %w", c.addr, err)
+	}
+	if c.opts.namespace != "" {
+		sel := &protocol.Message{Cmd: protocol.CMDSelect, Namespace: c.opts.namespace}
+		if _, err := cn.roundTrip(ctx, sel); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("selecting namespace %s on %s: %w", c.opts.namespace, c.addr, err)
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	if !c.closed && len(c.idle) < c.opts.poolSize {
+		cn.idleSince = time.Now()
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+	if cn != nil {
+		cn.Close()
+	}
+}
+
+// keepAlive pings the connections that have been idle for the keepalive
+// interval, until the client is closed. They are taken out of the pool while
+// being pinged, and only the ones that answer go back.
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.opts.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-c.opts.keepAlive)
+		var stale []*conn
+		c.mu.Lock()
+		kept := c.idle[:0]
+		for _, cn := range c.idle {
+			if cn.idleSince.After(cutoff) {
+				kept = append(kept, cn)
+			} else {
+				stale = append(stale, cn)
+			}
+		}
+		c.idle = kept
+		c.mu.Unlock()
+
+		for _, cn := range stale {
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.keepAlive)
+			_, err := cn.roundTrip(ctx, &protocol.Message{Cmd: protocol.CMDPing})
+			cancel()
+			if err != nil {
+				cn.Close()
+				continue
+			}
+			c.put(cn)
+		}
+	}
+}
+
+// do sends msg on a pooled connection and returns the reply's payload.
+func (c *Client) do(ctx context.Context, msg *protocol.Message) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := cn.roundTrip(ctx, msg)
+	var respErr *protocol.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		// The connection may be part way through a reply.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return payload, err
+}
+
+// Do sends msg as it is and returns the reply's payload, for commands the
+// Client has no method of its own for.
+func (c *Client) Do(ctx context.Context, msg *protocol.Message) ([]byte, error) {
+	return c.do(ctx, msg)
+}
+
+// roundTrip writes msg and reads its reply, giving up when ctx is done.
+func (cn *conn) roundTrip(ctx context.Context, msg *protocol.Message) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		cn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	payload, err := cn.send(msg)
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case !deadline.IsZero() && errors.Is(err, os.ErrDeadlineExceeded):
+		// The connection's deadline, which is ctx's, can pass a moment
+		// before ctx notices.
+		return nil, context.DeadlineExceeded
+	}
+	return payload, err
+}
+
+func (cn *conn) send(msg *protocol.Message) ([]byte, error) {
+	if _, err := cn.Write(append(msg.ToBytes(), '\n')); err != nil {
+		return nil, err
+	}
+	return protocol.ReadFrame(cn.r)
+}
+
+// checkArg rejects keys and values the line-based protocol can't carry.
+func checkArg(what string, b []byte, reserved string) error {
+	if len(b) == 0 {
+		return fmt.Errorf("empty %s", what)
+	}
+	if strings.ContainsAny(string(b), " \t\r\n\v\f") {
+		return fmt.Errorf("%s %q contains whitespace", what, b)
+	}
+	if strings.ContainsAny(string(b), reserved) {
+		return fmt.Errorf("%s %q contains one of %q", what, b, reserved)
+	}
+	return nil
+}
+
+// isNotFound reports whether err is the server saying a key is missing or
+// expired.
+func isNotFound(err error) bool {
+	var respErr *protocol.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	return respErr.Msg == protocol.ReplyNotFound
+}
+
+// notFound maps the server's replies for a missing key to ErrNotFound or
+// ErrKnownAbsent, and returns any other err unchanged.
+func notFound(err error) error {
+	var respErr *protocol.ResponseError
+	switch {
+	case errors.As(err, &respErr) && respErr.Msg == protocol.ReplyKnownAbsent:
+		return ErrKnownAbsent
+	case isNotFound(err):
+		return ErrNotFound
+	}
+	return err
+}
+
+// Get returns key's value, or ErrNotFound, or ErrKnownAbsent if the key was
+// marked with MarkAbsent.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, err
+	}
+	var val []byte
+	err := c.read(ctx, func(cl *Client) (err error) {
+		val, err = cl.do(ctx, &protocol.Message{Cmd: protocol.CMDGet, Key: key})
+		return notFound(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// GetDel returns key's value and deletes it, or an error as Get does. Of
+// several clients racing for the same key, only one gets its value.
+func (c *Client) GetDel(ctx context.Context, key []byte) ([]byte, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, err
+	}
+	val, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDGetDel, Key: key})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return val, nil
+}
+
+// GetEx returns key's value and makes it expire after ttl from now (0 for
+// never), or an error as Get does.
+func (c *Client) GetEx(ctx context.Context, key []byte, ttl time.Duration) ([]byte, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, err
+	}
+	val, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDGetEx, Key: key, TTL: ttl})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return val, nil
+}
+
+// GetWithVersion returns key's value and version, or an error as Get does.
+// The version can be passed to CompareAndSwapVersion.
+func (c *Client) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, 0, err
+	}
+	var payload []byte
+	err := c.read(ctx, func(cl *Client) (err error) {
+		payload, err = cl.do(ctx, &protocol.Message{Cmd: protocol.CMDGet, Key: key, WithVersion: true})
+		return notFound(err)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	v, val, ok := strings.Cut(string(payload), " ")
+	version, err := strconv.ParseUint(v, 10, 64)
+	if !ok || err != nil {
+		return nil, 0, fmt.Errorf("invalid GET WITHVERSION response %q", payload)
+	}
+	return []byte(val), version, nil
+}
+
+// Ping checks that the server is answering, without touching the cache.
+func (c *Client) Ping(ctx context.Context) error {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDPing})
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(payload)) != string(protocol.CMDPong) {
+		return fmt.Errorf("unexpected PING reply %q", payload)
+	}
+	return nil
+}
+
+// MGet returns the values of keys in order, with nil for a key that was not
+// found.
+func (c *Client) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	for _, k := range keys {
+		if err := checkArg("key", k, ""); err != nil {
+			return nil, err
+		}
+	}
+	var vals [][]byte
+	err := c.read(ctx, func(cl *Client) error {
+		payload, err := cl.do(ctx, &protocol.Message{Cmd: protocol.CMDMGet, Keys: keys})
+		if err == nil {
+			vals, err = protocol.DecodeMulti(payload)
+		}
+		if err != nil {
+			return err
+		}
+		// A follower missing any of the keys sends them all to the leader.
+		for _, v := range vals {
+			if v == nil && cl != c {
+				return ErrNotFound
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// Set stores value under key. A ttl of 0 means the key never expires.
+func (c *Client) Set(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := checkArg("key", key, ""); err != nil {
+		return err
+	}
+	if err := checkArg("value", value, ""); err != nil {
+		return err
+	}
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDSet, Key: key, Value: value, TTL: ttl})
+	return err
+}
+
+// CompareAndSwapVersion sets key to value only if it is still at version,
+// as returned by GetWithVersion, and reports whether it did. A version of 0
+// means the key must not exist.
+func (c *Client) CompareAndSwapVersion(ctx context.Context, key []byte, version uint64, value []byte, ttl time.Duration) (bool, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return false, err
+	}
+	if err := checkArg("value", value, ""); err != nil {
+		return false, err
+	}
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDCasVersion, Key: key, KeyVersion: version, Value: value, TTL: ttl})
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(string(payload))
+}
+
+// BatchSet stores several pairs with one ttl. Keys may not contain ':' or ',',
+// nor values ','.
+func (c *Client) BatchSet(ctx context.Context, pairs map[string][]byte, ttl time.Duration) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	for k, v := range pairs {
+		if err := checkArg("key", []byte(k), ":,"); err != nil {
+			return err
+		}
+		if err := checkArg("value", v, ","); err != nil {
+			return err
+		}
+	}
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDBatch, Pairs: pairs, TTL: ttl})
+	return err
+}
+
+// BatchSetNX stores several pairs with one ttl, as BatchSet does, but only if
+// none of the keys exist, and reports whether it did.
+func (c *Client) BatchSetNX(ctx context.Context, pairs map[string][]byte, ttl time.Duration) (bool, error) {
+	if len(pairs) == 0 {
+		return true, nil
+	}
+	for k, v := range pairs {
+		if err := checkArg("key", []byte(k), ":,"); err != nil {
+			return false, err
+		}
+		if err := checkArg("value", v, ","); err != nil {
+			return false, err
+		}
+	}
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDMSetNX, Pairs: pairs, TTL: ttl})
+	if err != nil {
+		return false, err
+	}
+	return string(resp) == "1", nil
+}
+
+// Delete removes key and reports whether it existed. Deleting a missing key
+// is not an error.
+func (c *Client) Delete(ctx context.Context, key []byte) (bool, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDDel, Key: key})
+	if err != nil {
+		return false, err
+	}
+	return string(resp) == "1", nil
+}
+
+// Rename moves src's value and TTL to dst, replacing dst. It returns
+// ErrNotFound if src doesn't exist.
+func (c *Client) Rename(ctx context.Context, src, dst []byte) error {
+	if err := checkArg("key", src, ""); err != nil {
+		return err
+	}
+	if err := checkArg("key", dst, ""); err != nil {
+		return err
+	}
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDRename, Key: src, NewKey: dst})
+	return notFound(err)
+}
+
+// Copy sets dst to src's value, keeping src's remaining TTL, and reports
+// whether it did. Unless replace is set, a dst that exists is left alone and
+// Copy reports false. It returns ErrNotFound if src doesn't exist.
+func (c *Client) Copy(ctx context.Context, src, dst []byte, replace bool) (bool, error) {
+	return c.CopyTTL(ctx, src, dst, -1, replace)
+}
+
+// CopyTTL is Copy with dst expiring after ttl (0 for never). A negative ttl
+// keeps src's remaining TTL.
+func (c *Client) CopyTTL(ctx context.Context, src, dst []byte, ttl time.Duration, replace bool) (bool, error) {
+	if err := checkArg("key", src, ""); err != nil {
+		return false, err
+	}
+	if err := checkArg("key", dst, ""); err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDCopy, Key: src, NewKey: dst, TTL: ttl, Replace: replace})
+	if err != nil {
+		return false, notFound(err)
+	}
+	return string(resp) == "1", nil
+}
+
+// Append adds value to the end of key's value, creating the key if it
+// doesn't exist, and returns the new length. The key's expiry is unchanged.
+func (c *Client) Append(ctx context.Context, key, value []byte) (int, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return 0, err
+	}
+	if err := checkArg("value", value, ""); err != nil {
+		return 0, err
+	}
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDAppend, Key: key, Value: value})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// Touch marks keys as recently used, so eviction passes them over, without
+// counting as reads or changing their TTLs. It returns how many of them
+// exist.
+func (c *Client) Touch(ctx context.Context, keys ...[]byte) (int, error) {
+	for _, k := range keys {
+		if err := checkArg("key", k, ""); err != nil {
+			return 0, err
+		}
+	}
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDTouchKeys, Keys: keys})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// ResetTTL makes key expire after ttl from now (0 for never), as TOUCH
+// <key> TTL <ttl> does, and marks it recently used. A negative ttl restarts
+// the TTL the key was last set with, as plain TOUCH <key> does. It returns
+// ErrNotFound if the key doesn't exist.
+func (c *Client) ResetTTL(ctx context.Context, key []byte, ttl time.Duration) error {
+	if err := checkArg("key", key, ""); err != nil {
+		return err
+	}
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDTouch, Key: key, TTL: ttl})
+	return notFound(err)
+}
+
+// MarkAbsent tells the server key is missing from whatever the cache fronts,
+// so Gets for it return ErrKnownAbsent until the server's negative TTL runs
+// out or the key is set. The server must have negative caching enabled.
+func (c *Client) MarkAbsent(ctx context.Context, key []byte) error {
+	if err := checkArg("key", key, ""); err != nil {
+		return err
+	}
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDSetAbsent, Key: key})
+	return err
+}
+
+func (c *Client) Has(ctx context.Context, key []byte) (bool, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return false, err
+	}
+	var ok bool
+	err := c.read(ctx, func(cl *Client) error {
+		payload, err := cl.do(ctx, &protocol.Message{Cmd: protocol.CMDHas, Key: key})
+		if err == nil {
+			ok, err = strconv.ParseBool(string(payload))
+		}
+		if err == nil && !ok && cl != c {
+			return ErrNotFound
+		}
+		return err
+	})
+	return ok, err
+}
+
+// Keys returns the keys matching a path.Match pattern, or every key if
+// pattern is empty. Keys containing ',' come back split, since the server
+// separates keys with commas.
+func (c *Client) Keys(ctx context.Context, pattern string) ([][]byte, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDKeys, Pattern: pattern})
+	if err != nil || len(payload) == 0 {
+		return nil, err
+	}
+	parts := strings.Split(string(payload), ",")
+	keys := make([][]byte, len(parts))
+	for i, p := range parts {
+		keys[i] = []byte(p)
+	}
+	return keys, nil
+}
+
+// DBSize returns how many keys the server holds, in every namespace.
+func (c *Client) DBSize(ctx context.Context) (int, error) {
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDDBSize})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// Snapshot saves the server's cache as the snapshot called name, replacing
+// any snapshot already called that, and returns how many keys it holds.
+func (c *Client) Snapshot(ctx context.Context, name string) (int, error) {
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDSnapshot, Snapshot: name})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// SnapshotInfo describes one of the server's named snapshots.
+type SnapshotInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Snapshots lists the server's named snapshots, oldest first.
+func (c *Client) Snapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDSnapshot})
+	if err != nil {
+		return nil, err
+	}
+	var infos []SnapshotInfo
+	if err := json.Unmarshal(resp, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// RestoreSnapshot replaces everything on the server with the snapshot called
+// name, and returns how many keys it loaded. It must be sent to the leader.
+func (c *Client) RestoreSnapshot(ctx context.Context, name string) (int, error) {
+	resp, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDSnapshot, Snapshot: name, Load: true})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// RandomKey returns a random key from the client's namespace, or nil if it
+// has none.
+func (c *Client) RandomKey(ctx context.Context) ([]byte, error) {
+	key, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDRandomKey})
+	if err != nil || len(key) == 0 {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Metrics is the server's METRICS report.
+type Metrics struct {
+	cache.CacheMetrics
+	UptimeSeconds            int64                  `json:"uptimeSeconds"`
+	ConnectedClients         int                    `json:"connectedClients"`
+	TotalConnectionsAccepted uint64                 `json:"totalConnectionsAccepted"`
+	LastSaveTime             *time.Time             `json:"lastSaveTime,omitempty"`
+	LastSaveDurationMs       int64                  `json:"lastSaveDurationMs"`
+	Commands                 map[string]CommandStat `json:"commands"`
+	Replication              Replication            `json:"replication"`
+}
+
+type CommandStat struct {
+	Count              uint64 `json:"count"`
+	Errors             uint64 `json:"errors"`
+	TotalLatencyMicros uint64 `json:"totalLatencyMicros"`
+}
+
+// Replication reports a server's role. On a leader, Offset is the sequence
+// number of the last operation it replicated, and FollowerLag how far
+// behind it each follower is.
+type Replication struct {
+	Role        string        `json:"role"`
+	Followers   int           `json:"followers"`
+	Offset      uint64        `json:"offset"`
+	FollowerLag []FollowerLag `json:"followerLag"`
+}
+
+type FollowerLag struct {
+	Addr        string  `json:"addr"`
+	AckedOffset uint64  `json:"ackedOffset"` // sequence number of the last operation applied
+	LagOps      uint64  `json:"lagOps"`
+	LagSeconds  float64 `json:"lagSeconds"`
+}
+
+func (c *Client) Metrics(ctx context.Context) (*Metrics, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDMetrics})
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{}
+	if err := json.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Stats is the server's STATS report on the protocol and replication.
+type Stats struct {
+	Commands    map[string]CommandCount `json:"commands"`
+	ParseErrors uint64                  `json:"parseErrors"`
+	BytesIn     uint64                  `json:"bytesIn"`
+	BytesOut    uint64                  `json:"bytesOut"`
+	Replication struct {
+		Replicated       uint64 `json:"replicated"`
+		Failures         uint64 `json:"failures"`
+		FollowersDropped uint64 `json:"followersDropped"`
+	} `json:"replication"`
+	Process struct {
+		Goroutines     uint64  `json:"goroutines"`
+		GCCycles       uint64  `json:"gcCycles"`
+		GCPauses       uint64  `json:"gcPauses"`
+		GCPauseSeconds float64 `json:"gcPauseSeconds"`
+		HeapLiveBytes  uint64  `json:"heapLiveBytes"`
+	} `json:"process"`
+}
+
+type CommandCount struct {
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+}
+
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDStats})
+	if err != nil {
+		return nil, err
+	}
+	st := &Stats{}
+	if err := json.Unmarshal(payload, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// FollowerStatus is one follower's entry in a leader's FOLLOWERS report.
+type FollowerStatus struct {
+	Addr           string     `json:"addr"`            // the follower's end of its link
+	AdvertisedAddr string     `json:"advertised_addr"` // where other nodes reach it
+	Joined         time.Time  `json:"joined"`
+	LastHeartbeat  time.Time  `json:"last_heartbeat"`
+	LastAck        *time.Time `json:"last_ack,omitempty"`
+	MissedPongs    int        `json:"missed_pongs"`
+	QueueDepth     int        `json:"queue_depth"`
+	LagOps         uint64     `json:"lag_ops"`      // operations sent but not yet acknowledged
+	LagSeconds     float64    `json:"lag_seconds"`  // how long it has had some outstanding without acknowledging any
+	AckedOffset    uint64     `json:"acked_offset"` // sequence number of the last operation applied
+}
+
+// Followers reports on each follower attached to the server, which must be
+// the leader to have any.
+func (c *Client) Followers(ctx context.Context) ([]FollowerStatus, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDFollowers})
+	if err != nil {
+		return nil, err
+	}
+	var followers []FollowerStatus
+	if err := json.Unmarshal(payload, &followers); err != nil {
+		return nil, err
+	}
+	return followers, nil
+}
+
+// Latency is one command's entry in the server's LATENCY report.
+type Latency struct {
+	CommandStat
+	MaxLatencyMicros uint64          `json:"maxLatencyMicros"`
+	P50Micros        uint64          `json:"p50Micros"`
+	P95Micros        uint64          `json:"p95Micros"`
+	P99Micros        uint64          `json:"p99Micros"`
+	Histogram        []LatencyBucket `json:"histogram"`
+}
+
+type LatencyBucket struct {
+	Le    string `json:"le"` // upper bound, such as "250us", or "+Inf"
+	Count uint64 `json:"count"`
+}
+
+// Latency returns each command's latency percentiles and histogram, keyed
+// by command name, since the server started or last had them reset.
+func (c *Client) Latency(ctx context.Context) (map[string]Latency, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDLatency})
+	if err != nil {
+		return nil, err
+	}
+	var report map[string]Latency
+	if err := json.Unmarshal(payload, &report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ResetLatency clears the server's latency histograms.
+func (c *Client) ResetLatency(ctx context.Context) error {
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDLatency, Reset: true})
+	return err
+}
+
+// ConfigSet changes one of the server's settings, such as "ratelimit", until
+// it restarts.
+func (c *Client) ConfigSet(ctx context.Context, param, value string) error {
+	_, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDConfig, Param: param, Value: []byte(value)})
+	return err
+}
+
+// Validate asks the server to parse command without running it. It returns
+// the fields the command was parsed into, by Message field name, or the
+// server's parse error.
+func (c *Client) Validate(ctx context.Context, command string) (map[string]any, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDValidate, Value: []byte(command)})
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// ConfigGet returns the server's settings whose names match pattern, which
+// may be a single name or a pattern such as "*".
+func (c *Client) ConfigGet(ctx context.Context, pattern string) (map[string]string, error) {
+	payload, err := c.do(ctx, &protocol.Message{Cmd: protocol.CMDConfig, Param: pattern})
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
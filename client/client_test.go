@@ -0,0 +1,253 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"distributedCache/cache"
+	cacheclient "distributedCache/client"
+	"distributedCache/protocol"
+	"distributedCache/server"
+)
+
+// startServer starts a leader on a free loopback port and returns its
+// address. It is closed when the test ends.
+func startServer(t *testing.T) string {
+	t.Helper()
+	s := server.New(server.Options{
+		ListenAddr: "127.0.0.1:0",
+		IsLeader:   true,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, cache.NewCache())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	t.Cleanup(func() {
+		s.Close()
+		<-errc
+	})
+	for deadline := time.Now().Add(5 * time.Second); s.Addr() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s.Addr().String()
+}
+
+func newClient(t *testing.T, addr string, opts ...cacheclient.Option) *cacheclient.Client {
+	t.Helper()
+	c, err := cacheclient.New(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientCommands(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, startServer(t))
+
+	if err := c.Set(ctx, []byte("a"), []byte("1"), 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if v, err := c.Get(ctx, []byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get = %q, %v; want %q", v, err, "1")
+	}
+	if ok, err := c.Has(ctx, []byte("a")); err != nil || !ok {
+		t.Fatalf("Has = %v, %v; want true", ok, err)
+	}
+
+	if err := c.BatchSet(ctx, map[string][]byte{"b": []byte("2"), "c": []byte("3")}, 0); err != nil {
+		t.Fatalf("BatchSet: %v", err)
+	}
+	keys, err := c.Keys(ctx, "")
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	var got []string
+	for _, k := range keys {
+		got = append(got, string(k))
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[a b c]" {
+		t.Fatalf("Keys = %v, want [a b c]", got)
+	}
+
+	if ok, err := c.Delete(ctx, []byte("a")); err != nil || !ok {
+		t.Fatalf("Delete = %v, %v; want true", ok, err)
+	}
+	if ok, err := c.Delete(ctx, []byte("a")); err != nil || ok {
+		t.Fatalf("second Delete = %v, %v; want false", ok, err)
+	}
+	if _, err := c.Get(ctx, []byte("a")); !errors.Is(err, cacheclient.ErrNotFound) {
+		t.Fatalf("Get of a deleted key = %v, want ErrNotFound", err)
+	}
+	if ok, err := c.Has(ctx, []byte("a")); err != nil || ok {
+		t.Fatalf("Has of a deleted key = %v, %v; want false", ok, err)
+	}
+
+	m, err := c.Metrics(ctx)
+	if err != nil {
+		t.Fatalf("Metrics: %v", err)
+	}
+	if m.Sets != 3 || m.Hits != 1 || m.Misses != 1 {
+		t.Fatalf("Metrics sets/hits/misses = %d/%d/%d, want 3/1/1", m.Sets, m.Hits, m.Misses)
+	}
+}
+
+// TestClientLargeValue stores and reads back a 1 MB value, far more than
+// one read off the connection returns, and checks the reply after it isn't
+// thrown off by any of it left unread.
+func TestClientLargeValue(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, startServer(t), cacheclient.WithPoolSize(1))
+
+	// Printable and without spaces, as values on the line protocol must be.
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte('!' + i%('~'-'!'+1))
+	}
+	if err := c.Set(ctx, []byte("big"), big, 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	got, err := c.Get(ctx, []byte("big"))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, big) {
+		t.Fatalf("Get returned %d bytes that don't match the %d set", len(got), len(big))
+	}
+	if err := c.Set(ctx, []byte("small"), []byte("v"), 0); err != nil {
+		t.Fatalf("Set after the large Get: %v", err)
+	}
+	if v, err := c.Get(ctx, []byte("small")); err != nil || string(v) != "v" {
+		t.Fatalf("Get after the large Get = %q, %v; want %q", v, err, "v")
+	}
+}
+
+func TestClientServerErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, startServer(t))
+
+	// A reply that is an error is not a missing key, and leaves the
+	// connection usable.
+	_, err := c.Do(ctx, &protocol.Message{Cmd: "FOOBAR"})
+	var respErr *protocol.ResponseError
+	if !errors.As(err, &respErr) || errors.Is(err, cacheclient.ErrNotFound) {
+		t.Fatalf("unknown command = %v, want a *protocol.ResponseError", err)
+	}
+	if err := c.Set(ctx, []byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("Set after an error reply: %v", err)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = cacheclient.New(addr, cacheclient.WithDialTimeout(time.Second))
+	if err == nil || errors.Is(err, cacheclient.ErrNotFound) {
+		t.Fatalf("New to a closed port = %v, want a transport error", err)
+	}
+}
+
+// TestClientDeadline talks to a server that completes the handshake and then
+// never answers.
+func TestClientDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				nc.Write(protocol.EncodeFrame([]byte("OK"), nil))
+				io.Copy(io.Discard, r)
+			}()
+		}
+	}()
+
+	c := newClient(t, ln.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.Get(ctx, []byte("k"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Get took %v to give up on a 100ms deadline", d)
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	const (
+		workers = 32
+		ops     = 200
+	)
+	ctx := context.Background()
+	c := newClient(t, startServer(t), cacheclient.WithPoolSize(workers))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := []byte(fmt.Sprintf("w%d-%d", w, i))
+				val := []byte(fmt.Sprint(i))
+				if err := c.Set(ctx, key, val, 0); err != nil {
+					errs <- err
+					return
+				}
+				got, err := c.Get(ctx, key)
+				if err == nil && string(got) != string(val) {
+					err = fmt.Errorf("Get(%s) = %q, want %q", key, got, val)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	m, err := c.Metrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalConnectionsAccepted > workers+1 {
+		t.Fatalf("%d connections accepted for %d workers; the pool isn't reusing them", m.TotalConnectionsAccepted, workers)
+	}
+}
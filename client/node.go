@@ -0,0 +1,55 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// nodeRetryInterval is how long a node that couldn't be connected to is
+// left alone, so commands for it fail at once rather than each waiting out
+// a dial.
+const nodeRetryInterval = time.Second
+
+// node is a connection to one of several servers a client uses, such as a
+// ShardedClient's nodes or a Client's replicas, opened when it is first
+// needed, so a server that is down when the client is made can still be
+// used once it is back.
+type node struct {
+	addr string
+	opts []Option
+
+	mu       sync.Mutex
+	client   *Client
+	closed   bool
+	dialErr  error
+	failedAt time.Time
+}
+
+func (n *node) get() (*Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case n.closed:
+		return nil, ErrClosed
+	case n.client != nil:
+		return n.client, nil
+	case n.dialErr != nil && time.Since(n.failedAt) < nodeRetryInterval:
+		return nil, n.dialErr
+	}
+	c, err := New(n.addr, n.opts...)
+	if err != nil {
+		n.dialErr, n.failedAt = err, time.Now()
+		return nil, err
+	}
+	n.client, n.dialErr = c, nil
+	return c, nil
+}
+
+func (n *node) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	if n.client != nil {
+		n.client.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import "time"
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	poolSize    int
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+	namespace   string
+
+	replicas         []string
+	replicaSelection ReplicaSelection
+
+	shardStrategy ShardStrategy
+	onNodeError   func(addr string, err error)
+}
+
+func buildOptions(opts []Option) options {
+	o := options{poolSize: 4, dialTimeout: 5 * time.Second, keepAlive: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithPoolSize sets how many idle connections are kept for reuse (4 by
+// default). Busy periods may open more; those beyond n are closed once they
+// are done.
+func WithPoolSize(n int) Option {
+	return func(o *options) {
+		o.poolSize = n
+	}
+}
+
+// WithDialTimeout bounds how long opening a connection may take when the
+// command's context has no earlier deadline (5s by default).
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithKeepAlive pings connections that have sat idle in the pool for d (30s
+// by default), so middleboxes don't drop them and a dead server is noticed
+// before a command has to wait on it. Connections that fail the ping are
+// closed. A d of 0 turns this off.
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = d
+	}
+}
+
+// WithNamespace scopes every command to the named namespace, selected on each
+// connection as it is opened. Without it the server's default namespace is
+// used.
+func WithNamespace(name string) Option {
+	return func(o *options) {
+		o.namespace = name
+	}
+}
+
+// WithReplicas sends reads to the followers at addrs, spreading them as
+// WithReplicaSelection says, while writes and everything else still go to
+// the address given to New. See Client for how stale and failed reads are
+// handled.
+func WithReplicas(addrs ...string) Option {
+	return func(o *options) {
+		o.replicas = addrs
+	}
+}
+
+// WithReplicaSelection chooses how reads are spread across WithReplicas
+// (ReplicaRoundRobin by default).
+func WithReplicaSelection(sel ReplicaSelection) Option {
+	return func(o *options) {
+		o.replicaSelection = sel
+	}
+}
+
+// WithShardStrategy makes a ShardedClient assign keys to nodes with st
+// rather than the consistent-hash ring of the ring package. It has no effect
+// on a Client.
+func WithShardStrategy(st ShardStrategy) Option {
+	return func(o *options) {
+		o.shardStrategy = st
+	}
+}
+
+// WithNodeErrorHandler has a ShardedClient call fn whenever it fails to reach
+// a node, as distinct from the node replying with an error, such as to
+// MarkDown a node that keeps failing. fn must not block. It has no effect on
+// a Client.
+func WithNodeErrorHandler(fn func(addr string, err error)) Option {
+	return func(o *options) {
+		o.onNodeError = fn
+	}
+}
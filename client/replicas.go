@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"distributedCache/protocol"
+	"errors"
+	"sync/atomic"
+)
+
+// ReplicaSelection chooses which replica a read goes to first.
+type ReplicaSelection int
+
+const (
+	// ReplicaRoundRobin takes the replicas in turn.
+	ReplicaRoundRobin ReplicaSelection = iota
+	// ReplicaLeastLoaded picks the replica with the fewest reads in flight
+	// from this client.
+	ReplicaLeastLoaded
+)
+
+type leaderReadKey struct{}
+
+// ReadFromLeader returns a context that sends reads made with it to the
+// leader even if the Client has replicas, for when a follower's copy may be
+// too stale, such as straight after a write.
+func ReadFromLeader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, leaderReadKey{}, true)
+}
+
+type replicaSet struct {
+	nodes     []*node
+	inflight  []atomic.Int64
+	next      atomic.Uint64
+	selection ReplicaSelection
+}
+
+func newReplicaSet(addrs []string, opts []Option, selection ReplicaSelection) *replicaSet {
+	// Replicas don't have replicas of their own.
+	opts = append(opts[:len(opts):len(opts)], WithReplicas())
+	rs := &replicaSet{
+		nodes:     make([]*node, len(addrs)),
+		inflight:  make([]atomic.Int64, len(addrs)),
+		selection: selection,
+	}
+	for i, addr := range addrs {
+		rs.nodes[i] = &node{addr: addr, opts: opts}
+	}
+	return rs
+}
+
+// order returns the indexes of the replicas in the order a read should try
+// them.
+func (rs *replicaSet) order() []int {
+	n := len(rs.nodes)
+	start := int(rs.next.Add(1) % uint64(n))
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = (start + i) % n
+	}
+	if rs.selection == ReplicaLeastLoaded {
+		// Starting from a rotating point breaks ties in turn.
+		least := 0
+		for i := range idx {
+			if rs.inflight[idx[i]].Load() < rs.inflight[idx[least]].Load() {
+				least = i
+			}
+		}
+		idx[0], idx[least] = idx[least], idx[0]
+	}
+	return idx
+}
+
+func (rs *replicaSet) close() {
+	for _, n := range rs.nodes {
+		n.close()
+	}
+}
+
+// fromServer reports whether err is the server's reply, rather than a
+// failure to reach it.
+func fromServer(err error) bool {
+	var respErr *protocol.ResponseError
+	return errors.As(err, &respErr) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrKnownAbsent)
+}
+
+// read calls fn with a replica's client, moving on to the next replica if
+// one can't be reached, and with c itself, the leader's, if there are no
+// replicas, none can be reached, or one reports a miss with ErrNotFound or
+// ErrKnownAbsent. fn can tell it has a replica by it not being c, and
+// should report a miss it would otherwise return as a result, such as Has
+// returning false, as ErrNotFound.
+func (c *Client) read(ctx context.Context, fn func(cl *Client) error) error {
+	if c.replicas == nil || ctx.Value(leaderReadKey{}) != nil {
+		return fn(c)
+	}
+	for _, i := range c.replicas.order() {
+		rc, err := c.replicas.nodes[i].get()
+		if err == nil {
+			c.replicas.inflight[i].Add(1)
+			err = fn(rc)
+			c.replicas.inflight[i].Add(-1)
+		}
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrKnownAbsent):
+			return fn(c)
+		case fromServer(err), ctx.Err() != nil:
+			return err
+		}
+	}
+	return fn(c)
+}
@@ -0,0 +1,439 @@
+package client
+
+import (
+	"context"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"distributedCache/ring"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoNodes is returned by a ShardedClient whose nodes are all marked down.
+var ErrNoNodes = errors.New("no healthy nodes")
+
+// ShardStrategy decides which node owns a key. *ring.Ring, the default, is
+// one. Add and Remove are called as nodes are marked up and down, never
+// concurrently with each other or with Owner.
+type ShardStrategy interface {
+	Add(node string) bool
+	Remove(node string) bool
+	Owner(key []byte) string
+}
+
+// NodeError is a ShardedClient failing to reach one of its nodes. Errors
+// the node replies with are returned as they are.
+type NodeError struct {
+	Addr string
+	Err  error
+}
+
+func (e *NodeError) Error() string { return e.Addr + ": " + e.Err.Error() }
+func (e *NodeError) Unwrap() error { return e.Err }
+
+// ShardedClient spreads keys across several independent servers, each of
+// which holds only the keys it owns, without the servers knowing about each
+// other. Commands for one key go to the node that owns it; those for many
+// keys are split by node and sent concurrently, and those about the servers
+// as a whole go to every node. A node that can't be reached only fails the
+// commands for its keys, as a *NodeError; MarkDown takes it out of the
+// rotation so its keys go to the other nodes instead.
+//
+// With the default strategy, keys are assigned as a cluster of servers
+// started with the same -clusterpeers assigns them, so the two can be used
+// together without commands being proxied. A MOVED reply is followed once,
+// to a node the client knows.
+type ShardedClient struct {
+	nodes       map[string]*node
+	addrs       []string
+	onNodeError func(addr string, err error)
+
+	mu       sync.RWMutex // guards strategy and down
+	strategy ShardStrategy
+	down     map[string]bool
+}
+
+// NewSharded returns a client for the servers at addrs, trying to connect
+// to each of them. Unlike New, it doesn't fail if some can't be reached;
+// they are tried again as commands need them. opts apply to every node.
+func NewSharded(addrs []string, opts ...Option) (*ShardedClient, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to shard across")
+	}
+	o := buildOptions(opts)
+	s := &ShardedClient{
+		nodes:       make(map[string]*node, len(addrs)),
+		onNodeError: o.onNodeError,
+		strategy:    o.shardStrategy,
+		down:        make(map[string]bool),
+	}
+	if s.strategy == nil {
+		s.strategy = ring.New(0)
+	}
+	// Each node is a server of its own, with no replicas.
+	opts = append(opts[:len(opts):len(opts)], WithReplicas())
+	for _, addr := range addrs {
+		if _, ok := s.nodes[addr]; ok {
+			continue
+		}
+		s.nodes[addr] = &node{addr: addr, opts: opts}
+		s.addrs = append(s.addrs, addr)
+		s.strategy.Add(addr)
+	}
+	s.fanOut(context.Background(), s.addrs, func(string, *Client) error { return nil })
+	return s, nil
+}
+
+// Close closes the connections to every node.
+func (s *ShardedClient) Close() error {
+	for _, n := range s.nodes {
+		n.close()
+	}
+	return nil
+}
+
+// MarkDown takes the node at addr out of the rotation: its keys are owned by
+// the other nodes until MarkUp puts it back. Use it, for instance, from
+// WithNodeErrorHandler, once a node has failed often enough.
+func (s *ShardedClient) MarkDown(addr string) error {
+	if s.nodes[addr] == nil {
+		return fmt.Errorf("%s is not one of this client's nodes", addr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.down[addr] {
+		s.strategy.Remove(addr)
+		s.down[addr] = true
+	}
+	return nil
+}
+
+// MarkUp puts a node taken out with MarkDown back into the rotation.
+func (s *ShardedClient) MarkUp(addr string) error {
+	if s.nodes[addr] == nil {
+		return fmt.Errorf("%s is not one of this client's nodes", addr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down[addr] {
+		s.strategy.Add(addr)
+		delete(s.down, addr)
+	}
+	return nil
+}
+
+// healthy returns the nodes not marked down.
+func (s *ShardedClient) healthy() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]string, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		if !s.down[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (s *ShardedClient) owner(key []byte) (string, error) {
+	s.mu.RLock()
+	addr := s.strategy.Owner(key)
+	s.mu.RUnlock()
+	if addr == "" {
+		return "", ErrNoNodes
+	}
+	return addr, nil
+}
+
+// Node returns the client for the node that owns key, for commands the
+// ShardedClient has no method of its own for.
+func (s *ShardedClient) Node(key []byte) (*Client, error) {
+	addr, err := s.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.nodes[addr].get()
+	if err != nil {
+		return nil, &NodeError{Addr: addr, Err: err}
+	}
+	return c, nil
+}
+
+// run calls fn with the client for the node at addr.
+func (s *ShardedClient) run(ctx context.Context, addr string, fn func(c *Client) error) error {
+	c, err := s.nodes[addr].get()
+	if err == nil {
+		err = fn(c)
+	}
+	if err == nil || fromServer(err) || ctx.Err() != nil {
+		return err
+	}
+	if s.onNodeError != nil {
+		s.onNodeError(addr, err)
+	}
+	return &NodeError{Addr: addr, Err: err}
+}
+
+// route calls fn with the client for the node that owns key, following a
+// MOVED reply once.
+func (s *ShardedClient) route(ctx context.Context, key []byte, fn func(c *Client) error) error {
+	addr, err := s.owner(key)
+	if err != nil {
+		return err
+	}
+	err = s.run(ctx, addr, fn)
+	if moved, ok := protocol.Moved(err); ok && moved != addr && s.nodes[moved] != nil {
+		err = s.run(ctx, moved, fn)
+	}
+	return err
+}
+
+// fanOut calls fn concurrently with each node in addrs and its client, and
+// returns their errors joined.
+func (s *ShardedClient) fanOut(ctx context.Context, addrs []string, fn func(addr string, c *Client) error) error {
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.run(ctx, addr, func(c *Client) error { return fn(addr, c) })
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Get returns key's value from the node that owns it, as Client.Get does.
+func (s *ShardedClient) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, err
+	}
+	var val []byte
+	err := s.route(ctx, key, func(c *Client) (err error) {
+		val, err = c.Get(ctx, key)
+		return err
+	})
+	return val, err
+}
+
+// GetWithVersion returns key's value and version, as Client.GetWithVersion
+// does.
+func (s *ShardedClient) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return nil, 0, err
+	}
+	var (
+		val     []byte
+		version uint64
+	)
+	err := s.route(ctx, key, func(c *Client) (err error) {
+		val, version, err = c.GetWithVersion(ctx, key)
+		return err
+	})
+	return val, version, err
+}
+
+// Set stores value under key on the node that owns it.
+func (s *ShardedClient) Set(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := checkArg("key", key, ""); err != nil {
+		return err
+	}
+	if err := checkArg("value", value, ""); err != nil {
+		return err
+	}
+	return s.route(ctx, key, func(c *Client) error {
+		return c.Set(ctx, key, value, ttl)
+	})
+}
+
+// Delete removes key and reports whether it existed.
+func (s *ShardedClient) Delete(ctx context.Context, key []byte) (bool, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return false, err
+	}
+	var existed bool
+	err := s.route(ctx, key, func(c *Client) (err error) {
+		existed, err = c.Delete(ctx, key)
+		return err
+	})
+	return existed, err
+}
+
+// Has reports whether key exists.
+func (s *ShardedClient) Has(ctx context.Context, key []byte) (bool, error) {
+	if err := checkArg("key", key, ""); err != nil {
+		return false, err
+	}
+	var ok bool
+	err := s.route(ctx, key, func(c *Client) (err error) {
+		ok, err = c.Has(ctx, key)
+		return err
+	})
+	return ok, err
+}
+
+// MGet returns the values of keys in order, with nil for a key that was not
+// found, asking each node for its keys at once. The keys of a node that
+// can't be reached come back nil, alongside its *NodeError.
+func (s *ShardedClient) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	for _, k := range keys {
+		if err := checkArg("key", k, ""); err != nil {
+			return nil, err
+		}
+	}
+	// The index in keys of each node's keys.
+	groups := make(map[string][]int)
+	for i, k := range keys {
+		addr, err := s.owner(k)
+		if err != nil {
+			return nil, err
+		}
+		groups[addr] = append(groups[addr], i)
+	}
+	vals := make([][]byte, len(keys))
+	err := s.fanOut(ctx, mapKeys(groups), func(addr string, c *Client) error {
+		idx := groups[addr]
+		own := make([][]byte, len(idx))
+		for j, i := range idx {
+			own[j] = keys[i]
+		}
+		got, err := c.MGet(ctx, own)
+		if err == nil && len(got) != len(own) {
+			err = fmt.Errorf("MGET of %d keys returned %d values", len(own), len(got))
+		}
+		if err != nil {
+			return err
+		}
+		for j, i := range idx {
+			vals[i] = got[j]
+		}
+		return nil
+	})
+	return vals, err
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// BatchSet stores several pairs with one ttl, as Client.BatchSet does,
+// sending each node its share concurrently. If some nodes fail, the pairs
+// the others own are still set.
+func (s *ShardedClient) BatchSet(ctx context.Context, pairs map[string][]byte, ttl time.Duration) error {
+	groups := make(map[string]map[string][]byte)
+	for k, v := range pairs {
+		if err := checkArg("key", []byte(k), ":,"); err != nil {
+			return err
+		}
+		if err := checkArg("value", v, ","); err != nil {
+			return err
+		}
+		addr, err := s.owner([]byte(k))
+		if err != nil {
+			return err
+		}
+		if groups[addr] == nil {
+			groups[addr] = make(map[string][]byte)
+		}
+		groups[addr][k] = v
+	}
+	return s.fanOut(ctx, mapKeys(groups), func(addr string, c *Client) error {
+		return c.BatchSet(ctx, groups[addr], ttl)
+	})
+}
+
+// Keys returns the keys matching pattern on every node not marked down, as
+// Client.Keys does. Those of nodes that answered are returned even if
+// others failed.
+func (s *ShardedClient) Keys(ctx context.Context, pattern string) ([][]byte, error) {
+	var (
+		mu   sync.Mutex
+		keys [][]byte
+	)
+	err := s.fanOut(ctx, s.healthy(), func(_ string, c *Client) error {
+		own, err := c.Keys(ctx, pattern)
+		mu.Lock()
+		keys = append(keys, own...)
+		mu.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+// DBSize returns how many keys the nodes not marked down hold between them,
+// counting only those that answered if some failed.
+func (s *ShardedClient) DBSize(ctx context.Context) (int, error) {
+	var (
+		mu    sync.Mutex
+		total int
+	)
+	err := s.fanOut(ctx, s.healthy(), func(_ string, c *Client) error {
+		n, err := c.DBSize(ctx)
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return err
+	})
+	return total, err
+}
+
+// Ping checks that every node not marked down is answering.
+func (s *ShardedClient) Ping(ctx context.Context) error {
+	return s.fanOut(ctx, s.healthy(), func(_ string, c *Client) error {
+		return c.Ping(ctx)
+	})
+}
+
+// ShardedMetrics is the METRICS report of each node not marked down, by
+// address, and the cache counters summed across them.
+type ShardedMetrics struct {
+	Total cache.CacheMetrics
+	Nodes map[string]*Metrics
+}
+
+// Metrics returns every node's METRICS report, and their totals. Nodes that
+// fail are left out.
+func (s *ShardedClient) Metrics(ctx context.Context) (*ShardedMetrics, error) {
+	sm := &ShardedMetrics{Nodes: make(map[string]*Metrics)}
+	var mu sync.Mutex
+	err := s.fanOut(ctx, s.healthy(), func(addr string, c *Client) error {
+		m, err := c.Metrics(ctx)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		sm.Nodes[addr] = m
+		addMetrics(&sm.Total, &m.CacheMetrics)
+		mu.Unlock()
+		return nil
+	})
+	return sm, err
+}
+
+func addMetrics(dst, m *cache.CacheMetrics) {
+	dst.Hits += m.Hits
+	dst.Misses += m.Misses
+	dst.Sets += m.Sets
+	dst.Deletes += m.Deletes
+	dst.ExpiredKeys += m.ExpiredKeys
+	dst.EvictedKeys += m.EvictedKeys
+	dst.KeyCount += m.KeyCount
+	dst.DBSize += m.DBSize
+	dst.ApproxMemoryBytes += m.ApproxMemoryBytes
+	dst.MaxBytes += m.MaxBytes
+	dst.NegativeHits += m.NegativeHits
+	dst.MissFilterHits += m.MissFilterHits
+	dst.RejectedSets += m.RejectedSets
+	dst.DeleteMisses += m.DeleteMisses
+	dst.Loads += m.Loads
+	dst.LoadErrors += m.LoadErrors
+	dst.CompressionSaved += m.CompressionSaved
+	dst.ChecksumFailures += m.ChecksumFailures
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"distributedCache/protocol"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tx is a list of writes for Exec to apply in one step.
+type Tx struct {
+	ops []*protocol.Message
+	err error
+}
+
+// Set queues storing value under key, as in Client.Set.
+func (tx *Tx) Set(key, value []byte, ttl time.Duration) {
+	if err := checkArg("key", key, ""); err != nil {
+		tx.fail(err)
+	}
+	if err := checkArg("value", value, ""); err != nil {
+		tx.fail(err)
+	}
+	tx.ops = append(tx.ops, &protocol.Message{Cmd: protocol.CMDSet, Key: key, Value: value, TTL: ttl})
+}
+
+// Delete queues removing key, as in Client.Delete.
+func (tx *Tx) Delete(key []byte) {
+	if err := checkArg("key", key, ""); err != nil {
+		tx.fail(err)
+	}
+	tx.ops = append(tx.ops, &protocol.Message{Cmd: protocol.CMDDel, Key: key})
+}
+
+func (tx *Tx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// Exec applies tx's writes in order as one step: no other command sees some
+// of them applied but not others. It returns each write's reply, "OK" for a
+// Set and "1" or "0" for a Delete as to whether the key existed. If any
+// write is rejected, none are applied.
+func (c *Client) Exec(ctx context.Context, tx *Tx) ([][]byte, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results, err := cn.exec(ctx, tx.ops)
+	var respErr *protocol.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return results, err
+}
+
+func (cn *conn) exec(ctx context.Context, ops []*protocol.Message) ([][]byte, error) {
+	if _, err := cn.roundTrip(ctx, &protocol.Message{Cmd: protocol.CMDMulti}); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		resp, err := cn.roundTrip(ctx, op)
+		if err == nil && string(resp) != protocol.Queued {
+			err = fmt.Errorf("unexpected reply %q to a queued %s", resp, op.Cmd)
+		}
+		var respErr *protocol.ResponseError
+		if err != nil {
+			if errors.As(err, &respErr) {
+				// Leave the connection out of the transaction for whoever
+				// uses it next.
+				if _, derr := cn.roundTrip(ctx, &protocol.Message{Cmd: protocol.CMDDiscard}); derr != nil && !errors.As(derr, &respErr) {
+					return nil, derr
+				}
+			}
+			return nil, err
+		}
+	}
+	payload, err := cn.roundTrip(ctx, &protocol.Message{Cmd: protocol.CMDExec})
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeMulti(payload)
+}
@@ -0,0 +1,266 @@
+// Command cachebench measures throughput and latency of a cache server under
+// a configurable mix of GETs and SETs.
+package main
+
+import (
+	"context"
+	"distributedCache/client"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type config struct {
+	addr     string
+	clients  int
+	requests int
+	keys     int
+	size     int
+	reads    float64
+	conns    int
+	ttl      time.Duration
+	fill     bool
+	format   string
+}
+
+// result is the summary for one command type.
+type result struct {
+	Command   string  `json:"command"`
+	Ops       int     `json:"ops"`
+	Errors    int     `json:"errors"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	P50Micros int64   `json:"p50_us"`
+	P95Micros int64   `json:"p95_us"`
+	P99Micros int64   `json:"p99_us"`
+}
+
+// sample is what one worker measured for one command type.
+type sample struct {
+	latencies []time.Duration
+	errors    int
+}
+
+const fillBatch = 500
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", "localhost:3000", "Address of the cache server")
+	flag.IntVar(&cfg.clients, "clients", 50, "Number of clients, each with its own connections")
+	flag.IntVar(&cfg.requests, "requests", 100000, "Total number of requests across all clients")
+	flag.IntVar(&cfg.keys, "keys", 10000, "Number of distinct keys requests are spread over")
+	flag.IntVar(&cfg.size, "size", 100, "Value size in bytes")
+	flag.Float64Var(&cfg.reads, "reads", 0.8, "Fraction of requests that are GETs; the rest are SETs")
+	flag.IntVar(&cfg.conns, "conns", 1, "Connections per client, each with one request in flight at a time")
+	flag.DurationVar(&cfg.ttl, "ttl", 0, "TTL for keys written (0 for none)")
+	flag.BoolVar(&cfg.fill, "fill", true, "Write every key once before measuring, so GETs hit")
+	flag.StringVar(&cfg.format, "format", "text", "Output format: text, csv or json")
+	flag.Parse()
+
+	if err := validate(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	clients := make([]*client.Client, cfg.clients)
+	for i := range clients {
+		c, err := client.New(cfg.addr, client.WithPoolSize(cfg.conns), client.WithKeepAlive(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to %s: %v\n", cfg.addr, err)
+			os.Exit(1)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	value := randomValue(cfg.size)
+	if cfg.fill {
+		if err := fill(clients, cfg, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fill keys: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	results, elapsed := run(clients, cfg, value)
+	if err := report(os.Stdout, cfg.format, results, elapsed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func validate(cfg config) error {
+	switch {
+	case cfg.clients < 1, cfg.requests < 1, cfg.keys < 1, cfg.size < 1, cfg.conns < 1:
+		return errors.New("-clients, -requests, -keys, -size and -conns must be at least 1")
+	case cfg.reads < 0 || cfg.reads > 1:
+		return errors.New("-reads must be between 0 and 1")
+	case cfg.format != "text" && cfg.format != "csv" && cfg.format != "json":
+		return fmt.Errorf("unknown -format %q", cfg.format)
+	}
+	return nil
+}
+
+// randomValue returns n letters, since values can't contain whitespace or
+// the separators BATCH uses.
+func randomValue(n int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return b
+}
+
+func key(i int) []byte {
+	return []byte("bench-" + strconv.Itoa(i))
+}
+
+// fill writes every key in batches, spread over the clients.
+func fill(clients []*client.Client, cfg config, value []byte) error {
+	var (
+		next     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				start := int(next.Add(fillBatch)) - fillBatch
+				if start >= cfg.keys {
+					return
+				}
+				pairs := make(map[string][]byte, fillBatch)
+				for i := start; i < min(start+fillBatch, cfg.keys); i++ {
+					pairs[string(key(i))] = value
+				}
+				if err := c.BatchSet(context.Background(), pairs, cfg.ttl); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// run issues cfg.requests requests from cfg.conns workers per client, one per
+// pooled connection, and returns a result per command type.
+func run(clients []*client.Client, cfg config, value []byte) ([]result, time.Duration) {
+	var (
+		remaining atomic.Int64
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		samples   = map[string]*sample{"GET": {}, "SET": {}}
+	)
+	remaining.Store(int64(cfg.requests))
+
+	start := time.Now()
+	for _, c := range clients {
+		for range cfg.conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				local := map[string]*sample{"GET": {}, "SET": {}}
+				for remaining.Add(-1) >= 0 {
+					k := key(rand.IntN(cfg.keys))
+					cmd, t := "SET", time.Now()
+					var err error
+					if rand.Float64() < cfg.reads {
+						cmd = "GET"
+						if _, err = c.Get(context.Background(), k); errors.Is(err, client.ErrNotFound) {
+							err = nil // a miss is still a successful GET
+						}
+					} else {
+						err = c.Set(context.Background(), k, value, cfg.ttl)
+					}
+					s := local[cmd]
+					s.latencies = append(s.latencies, time.Since(t))
+					if err != nil {
+						s.errors++
+					}
+				}
+
+				mu.Lock()
+				for cmd, s := range local {
+					samples[cmd].latencies = append(samples[cmd].latencies, s.latencies...)
+					samples[cmd].errors += s.errors
+				}
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var results []result
+	for _, cmd := range []string{"GET", "SET"} {
+		if s := samples[cmd]; len(s.latencies) > 0 {
+			results = append(results, summarize(cmd, s, elapsed))
+		}
+	}
+	return results, elapsed
+}
+
+func summarize(cmd string, s *sample, elapsed time.Duration) result {
+	slices.Sort(s.latencies)
+	pct := func(p float64) int64 {
+		i := int(p * float64(len(s.latencies)-1))
+		return s.latencies[i].Microseconds()
+	}
+	return result{
+		Command:   cmd,
+		Ops:       len(s.latencies),
+		Errors:    s.errors,
+		OpsPerSec: float64(len(s.latencies)) / elapsed.Seconds(),
+		P50Micros: pct(0.50),
+		P95Micros: pct(0.95),
+		P99Micros: pct(0.99),
+	}
+}
+
+func report(f *os.File, format string, results []result, elapsed time.Duration) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv":
+		w := csv.NewWriter(f)
+		w.Write([]string{"command", "ops", "errors", "ops_per_sec", "p50_us", "p95_us", "p99_us"})
+		for _, r := range results {
+			w.Write([]string{
+				r.Command, strconv.Itoa(r.Ops), strconv.Itoa(r.Errors),
+				strconv.FormatFloat(r.OpsPerSec, 'f', 1, 64),
+				strconv.FormatInt(r.P50Micros, 10), strconv.FormatInt(r.P95Micros, 10), strconv.FormatInt(r.P99Micros, 10),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	var total int
+	for _, r := range results {
+		total += r.Ops
+		fmt.Fprintf(f, "%-4s %9d ops %11.1f ops/s   p50 %7.3fms   p95 %7.3fms   p99 %7.3fms   %d errors\n",
+			r.Command, r.Ops, r.OpsPerSec, ms(r.P50Micros), ms(r.P95Micros), ms(r.P99Micros), r.Errors)
+	}
+	fmt.Fprintf(f, "total %d ops in %s, %.1f ops/s\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	return nil
+}
+
+func ms(us int64) float64 {
+	return float64(us) / 1000
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// jsonReply is how -json prints the outcome of a command.
+type jsonReply struct {
+	Status string `json:"status"` // ok, not_found or error
+	Value  any    `json:"value,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// printJSON writes the outcome of command to stdout as one line of JSON.
+func printJSON(command string, reply []byte, err error) {
+	out := jsonReply{Status: "ok"}
+	switch {
+	case isNotFound(err):
+		out = jsonReply{Status: "not_found", Error: errorText(err)}
+	case err != nil:
+		out = jsonReply{Status: "error", Error: errorText(err)}
+	default:
+		out.Value = replyValue(command, reply)
+	}
+	data, _ := json.Marshal(out)
+	os.Stdout.Write(append(data, '\n'))
+}
+
+func errorText(err error) string {
+	var respErr *protocol.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.Msg
+	}
+	return err.Error()
+}
+
+// replyValue turns reply into the JSON value it stands for: an array for
+// the several values of MGET, EXEC and KEYS, an object for SCAN, the reply
+// as it is for commands that already answer in JSON, and a string
+// otherwise.
+func replyValue(command string, reply []byte) any {
+	msg, err := protocol.ParseCommand([]byte(command))
+	if err != nil {
+		return string(reply)
+	}
+	switch msg.Cmd {
+	case protocol.CMDMGet, protocol.CMDExec:
+		vals, err := protocol.DecodeMulti(reply)
+		if err != nil {
+			return string(reply)
+		}
+		out := make([]*string, len(vals))
+		for i, v := range vals {
+			if v != nil {
+				s := string(v)
+				out[i] = &s
+			}
+		}
+		return out
+	case protocol.CMDKeys:
+		return splitKeys(string(reply))
+	case protocol.CMDScan:
+		cursor, keys, _ := strings.Cut(string(reply), " ")
+		next, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return string(reply)
+		}
+		return map[string]any{"cursor": next, "keys": splitKeys(keys)}
+	case protocol.CMDMetrics, protocol.CMDStats, protocol.CMDClients, protocol.CMDReplicas, protocol.CMDFollowers, protocol.CMDInspect,
+		protocol.CMDInfoKey, protocol.CMDHotKeys, protocol.CMDLatency, protocol.CMDValidate, protocol.CMDConfig, protocol.CMDSnapshot:
+		if json.Valid(reply) {
+			return json.RawMessage(reply)
+		}
+	}
+	return string(reply)
+}
+
+// splitKeys splits the comma-separated keys of a KEYS or SCAN reply.
+func splitKeys(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
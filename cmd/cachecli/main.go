@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"distributedCache/protocol"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit statuses, so scripts can tell a missing key from a server that
+// couldn't be reached.
+const (
+	exitError      = 1 // the server rejected the command
+	exitUsage      = 2
+	exitNotFound   = 3
+	exitConnFailed = 4
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: cachecli [-addr host:port[,host:port...]] [-timeout d] [-json] [-f script] [command [args...] | dump | restore]")
+	fmt.Fprintln(out, "  command  run one command, print its reply and exit")
+	fmt.Fprintln(out, "  dump     write every key to stdout as newline-delimited JSON")
+	fmt.Fprintln(out, "  restore  load keys from newline-delimited JSON on stdin")
+	fmt.Fprintln(out, "With no command, commands piped on stdin are run in order with one reply")
+	fmt.Fprintln(out, "printed per line (blank for a failed command; the error goes to stderr),")
+	fmt.Fprintln(out, "and a terminal gets an interactive prompt. -f runs the commands in a file the")
+	fmt.Fprintln(out, "same way. Blank lines and lines starting with # are skipped in both.")
+	fmt.Fprintln(out, "With -json, each reply is printed as a JSON object, {\"status\":\"ok\",\"value\":...},")
+	fmt.Fprintln(out, "with errors in the object rather than on stderr. Piped commands default to it.")
+	fmt.Fprintln(out, "A dropped connection is redialled before the next command, failing over")
+	fmt.Fprintln(out, "to the other addresses given; the command it interrupted is not retried.")
+	fmt.Fprintln(out, "Exit status: 0 ok, 1 error reply, 2 bad usage, 3 key not found, 4 connection failed.")
+	flag.PrintDefaults()
+}
+
+func main() {
+	addrs := flag.String("addr", "localhost:3000", "Address of the cache server, or a comma-separated list to fail over between")
+	timeout := flag.Duration("timeout", 5*time.Second, "Give up on a command that gets no reply within this long (0 to wait forever)")
+	jsonOut := flag.Bool("json", false, "Print each reply as a JSON object (the default for commands piped on stdin)")
+	script := flag.String("f", "", "Run the commands in this file, one per line, and exit")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	jsonSet := false
+	flag.Visit(func(f *flag.Flag) {
+		jsonSet = jsonSet || f.Name == "json"
+	})
+
+	s := &session{addrs: strings.Split(*addrs, ","), timeout: *timeout, framed: true}
+	if len(args) == 1 && (args[0] == "dump" || args[0] == "restore") {
+		var err error
+		if args[0] == "dump" {
+			s.framed = false
+			err = dump(s, os.Stdout)
+		} else {
+			err = restore(s, os.Stdin)
+		}
+		s.close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if err := s.connect(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+	defer s.close()
+	switch {
+	case *script != "":
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		status := pipe(s, f, *jsonOut)
+		f.Close()
+		os.Exit(status)
+	case len(args) > 0:
+		os.Exit(oneShot(s, strings.Join(args, " "), *jsonOut))
+	case !isTerminal(os.Stdin):
+		os.Exit(pipe(s, os.Stdin, *jsonOut || !jsonSet))
+	default:
+		repl(s)
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// exitCode picks the exit status for err.
+func exitCode(err error) int {
+	var respErr *protocol.ResponseError
+	switch {
+	case err == nil:
+		return 0
+	case isNotFound(err):
+		return exitNotFound
+	case errors.As(err, &respErr):
+		return exitError
+	default:
+		return exitConnFailed
+	}
+}
+
+// isNotFound reports whether err is the server saying a key doesn't exist.
+func isNotFound(err error) bool {
+	var respErr *protocol.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	return respErr.Msg == protocol.ReplyNotFound || respErr.Msg == protocol.ReplyKnownAbsent
+}
+
+func isSubscribe(command string) bool {
+	return strings.HasPrefix(command, string(protocol.CMDSubscribe)+" ")
+}
+
+func oneShot(s *session, command string, asJSON bool) int {
+	if isSubscribe(command) {
+		err := subscribe(s, command, "")
+		fmt.Fprintln(os.Stderr, err)
+		return exitConnFailed
+	}
+	reply, err := s.send(command)
+	if asJSON {
+		printJSON(command, reply, err)
+		return exitCode(err)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return exitCode(err)
+	}
+	fmt.Println(strings.TrimSpace(string(reply)))
+	return 0
+}
+
+// pipe runs each line of in as a command. It carries on past failed
+// commands, returning the status of the first, but stops if no server can be
+// reached. Replies are printed as JSON if asJSON is set.
+func pipe(s *session, in io.Reader, asJSON bool) int {
+	status := 0
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		command := strings.TrimSpace(sc.Text())
+		if command == "" || strings.HasPrefix(command, "#") {
+			continue
+		}
+		if isSubscribe(command) {
+			fmt.Fprintln(os.Stderr, subscribe(s, command, ""))
+			return exitConnFailed
+		}
+		reply, err := s.send(command)
+		if asJSON {
+			printJSON(command, reply, err)
+		}
+		if err != nil {
+			if !asJSON {
+				fmt.Println()
+				fmt.Fprintln(os.Stderr, "ERROR:", err)
+			}
+			if status == 0 {
+				status = exitCode(err)
+			}
+			if s.conn == nil && s.ensure() != nil {
+				return exitConnFailed
+			}
+			continue
+		}
+		if !asJSON {
+			fmt.Println(strings.TrimSpace(string(reply)))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	return status
+}
+
+func repl(s *session) {
+	fmt.Printf("✅ Connected to distributed cache at %s\n", s.conn.RemoteAddr())
+	fmt.Println("Available commands: SET <key> <value> <ttl>, CAS <key> <expected|\"\"> <new> <ttl>, CASVERSION <key> <version> <new> <ttl>, GET <key> [WITHVERSION], GETDEL <key>, GETEX <key> <ttl>, MGET <key1> <key2> ..., DEL <key>, MDEL <key1> <key2> ..., RENAME <src> <dst>, COPY <src> <dst> [ttl] [REPLACE], TOUCH <key> [TTL <ttl>], TOUCHKEYS <key1> <key2> ..., APPEND <key> <value>, SELECT|USE <namespace>, HAS <key>, SETABSENT <key>, INSPECT|INFOKEY <key>, HOTKEYS [n], DUMP [key], RESTORE <key> <payload> [REPLACE], KEYS [pattern] (prefer SCAN on large caches), SCAN <cursor> [count], DBSIZE, RANDOMKEY, METRICS, STATS, LATENCY [RESET], CONFIG GET <param|pattern>, CONFIG SET <param> <value>, VALIDATE <command>, CLIENTS, REPLICAS|FOLLOWERS, SAVE, BGSAVE, SNAPSHOT <name>|LIST|RESTORE <name>, ADDNODE <addr>, REMOVENODE <addr>, BATCH <key1:value1,key2:value2> <ttl>, MSETNX <key1:value1,key2:value2> <ttl>, MULTI (queue SETs and DELs), EXEC, DISCARD, SUBSCRIBE <pattern> (prints events until you quit)")
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Print(">> ")
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Printf("Error reading input: %v\n", err)
+			break
+		}
+
+		command := strings.TrimSpace(input)
+		if command == "" {
+			continue
+		}
+
+		if strings.EqualFold(command, "exit") {
+			fmt.Println("👋 Exiting client...")
+			break
+		}
+
+		if isSubscribe(command) {
+			if err := subscribe(s, command, "<< "); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			break
+		}
+
+		reply, err := s.send(command)
+		var respErr *protocol.ResponseError
+		if errors.As(err, &respErr) {
+			fmt.Println("<< ERROR:", respErr.Msg)
+			continue
+		}
+		if err != nil {
+			// The next command reconnects.
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+
+		fmt.Println("<<", strings.TrimSpace(string(reply)))
+	}
+}
+
+// subscribe sends a SUBSCRIBE and prints each event it pushes, after prefix,
+// until the connection closes. Subscriptions aren't available on a framed
+// connection, so it switches back to raw responses first.
+func subscribe(s *session, command, prefix string) error {
+	msg := &protocol.Message{Cmd: protocol.CMDHello, Version: protocol.ProtoRaw}
+	if _, err := s.send(string(msg.ToBytes())); err != nil {
+		return err
+	}
+	// Events can be any time apart, so only the write is bounded.
+	s.deadline()
+	if _, err := s.conn.Write(append([]byte(command), '\n')); err != nil {
+		return err
+	}
+	s.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			if line != "" {
+				fmt.Println(prefix + line) // an ERROR reply, which has no newline
+			}
+			return err
+		}
+		fmt.Print(prefix + line)
+	}
+}
+
+// dump copies the server's whole-cache export to w, without the line that
+// ends it. The timeout applies to each line rather than the whole export.
+func dump(s *session, w io.Writer) error {
+	if err := s.ensure(); err != nil {
+		return err
+	}
+	s.deadline()
+	if _, err := s.conn.Write([]byte("DUMP\n")); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for {
+		s.deadline()
+		line, err := s.r.ReadBytes('\n')
+		if err != nil {
+			if msg, ok := strings.CutPrefix(string(line), "ERROR: "); ok {
+				return &protocol.ResponseError{Msg: msg}
+			}
+			return fmt.Errorf("dump cut short: %w", err)
+		}
+		if strings.TrimSpace(string(line)) == protocol.StreamEnd {
+			return bw.Flush()
+		}
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// restore sends the entries read from in to the server to import and prints
+// how many keys were set. It waits as long as the import takes.
+func restore(s *session, in io.Reader) error {
+	if err := s.ensure(); err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+	if _, err := s.conn.Write([]byte("RESTORE\n")); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(s.conn)
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		bw.Write(sc.Bytes())
+		bw.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	bw.WriteString(protocol.StreamEnd + "\n")
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := protocol.ReadFrame(s.r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %s keys\n", reply)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"distributedCache/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Backoff between rounds of dialling every server in the list.
+const (
+	reconnectRounds   = 5
+	reconnectDelay    = 100 * time.Millisecond
+	maxReconnectDelay = 2 * time.Second
+)
+
+// session is a connection to one of several interchangeable servers. When the
+// connection fails it is dropped, and the next command dials again, starting
+// with the server that last worked and failing over to the others.
+type session struct {
+	addrs   []string
+	timeout time.Duration // per command; 0 waits forever
+	framed  bool          // switch to framed responses with HELLO on connect
+
+	// selected is the last namespace SELECTed, chosen again on reconnect.
+	selected string
+
+	next int // index in addrs to dial first
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *session) connect() error {
+	delay := reconnectDelay
+	var err error
+	for round := 0; round < reconnectRounds; round++ {
+		if round > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, maxReconnectDelay)
+		}
+		for i := range s.addrs {
+			n := (s.next + i) % len(s.addrs)
+			if err = s.dial(s.addrs[n]); err == nil {
+				s.next = n
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func (s *session) dial(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, s.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to server at %s: %w", addr, err)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if !s.framed {
+		return nil
+	}
+	msg := &protocol.Message{Cmd: protocol.CMDHello, Version: protocol.ProtoFramed}
+	if _, err := s.roundTrip(string(msg.ToBytes())); err != nil {
+		s.close()
+		return fmt.Errorf("failed to set up connection to %s: %w", addr, err)
+	}
+	if s.selected != "" {
+		msg := &protocol.Message{Cmd: protocol.CMDSelect, Namespace: s.selected}
+		if _, err := s.roundTrip(string(msg.ToBytes())); err != nil {
+			s.close()
+			return fmt.Errorf("failed to select namespace %s on %s: %w", s.selected, addr, err)
+		}
+	}
+	return nil
+}
+
+func (s *session) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// deadline bounds the next exchange by the command timeout.
+func (s *session) deadline() {
+	if s.timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+}
+
+// ensure connects if there is no connection.
+func (s *session) ensure() error {
+	if s.conn != nil {
+		return nil
+	}
+	return s.connect()
+}
+
+// send runs one command and returns its reply. A *protocol.ResponseError is
+// the server rejecting the command. Any other error, a timeout included,
+// drops the connection, since part of the reply may still be on its way.
+func (s *session) send(command string) ([]byte, error) {
+	if err := s.ensure(); err != nil {
+		return nil, err
+	}
+	reply, err := s.roundTrip(command)
+	var respErr *protocol.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		addr := s.conn.RemoteAddr()
+		s.close()
+		return nil, fmt.Errorf("lost connection to %s, the command may not have run: %w", addr, err)
+	}
+	if err == nil {
+		if msg, perr := protocol.ParseCommand([]byte(command)); perr == nil && (msg.Cmd == protocol.CMDSelect || msg.Cmd == protocol.CMDUse) {
+			s.selected = msg.Namespace
+		}
+	}
+	return reply, err
+}
+
+func (s *session) roundTrip(command string) ([]byte, error) {
+	s.deadline()
+	if _, err := s.conn.Write(append([]byte(command), '\n')); err != nil {
+		return nil, err
+	}
+	return protocol.ReadFrame(s.r)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"distributedCache/server"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// flagAliases maps the flags that are only another name for one the server
+// knows a setting by to that name.
+var flagAliases = map[string]string{
+	"save-interval":    "saveinterval",
+	"max-ops-per-conn": "ratelimit",
+}
+
+func canonicalFlag(name string) string {
+	if alias, ok := flagAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// readConfigFile reads a JSON object of flag names, without the leading
+// dash, to their values, e.g. {"maxbytes": "512mb", "ratelimit": 100}.
+// Values may be strings, numbers or booleans, and are checked as they
+// would be on the command line. Every name must be a flag.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		switch v := v.(type) {
+		case string, json.Number, bool:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, name)
+		}
+		if err := checkFlagValue(f, values[name]); err != nil {
+			return nil, fmt.Errorf("%s: invalid %s %q: %w", path, name, values[name], err)
+		}
+	}
+	return values, nil
+}
+
+// checkFlagValue reports whether f would accept value, parsing it into a
+// scratch flag of the same type so f itself keeps its value.
+func checkFlagValue(f *flag.Flag, value string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		fs.Bool("v", false, "")
+	case int:
+		fs.Int("v", 0, "")
+	case int64:
+		fs.Int64("v", 0, "")
+	case float64:
+		fs.Float64("v", 0, "")
+	case time.Duration:
+		fs.Duration("v", 0, "")
+	default:
+		return nil
+	}
+	return fs.Set("v", value)
+}
+
+// setFromCommandLine returns the flags given on the command line, by the
+// name the server knows them by, which take precedence over the config
+// file.
+func setFromCommandLine() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[canonicalFlag(f.Name)] = true })
+	return set
+}
+
+// applyConfigFile sets every flag in values that wasn't given on the
+// command line.
+func applyConfigFile(values map[string]string, explicit map[string]bool) error {
+	for name, value := range values {
+		if explicit[canonicalFlag(name)] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfigFile re-reads the config file and applies what can change while
+// the server runs, all or nothing. Settings given on the command line keep
+// their value, and changes to any other setting wait for a restart; both are
+// logged as ignored. loaded is the file's settings now in effect, and the
+// result is loaded updated with the ones the reload applied.
+func reloadConfigFile(s *server.Server, path string, loaded map[string]string, explicit map[string]bool, logger *slog.Logger) map[string]string {
+	values, err := readConfigFile(path)
+	if err != nil {
+		logger.Error("config reload failed, nothing changed", "err", err)
+		return loaded
+	}
+	reload := make(map[string]string)
+	var ignored []string
+	for name, value := range values {
+		canonical := canonicalFlag(name)
+		switch {
+		case explicit[canonical]:
+			if value != loaded[name] {
+				ignored = append(ignored, name+" (set on the command line)")
+			}
+		case server.Reloadable(canonical):
+			reload[canonical] = value
+		case value != loaded[name]:
+			ignored = append(ignored, name+" (needs a restart)")
+		}
+	}
+	for name := range loaded {
+		if _, ok := values[name]; !ok && !explicit[canonicalFlag(name)] {
+			ignored = append(ignored, name+" (removed; keeps its value until a restart)")
+		}
+	}
+	changed, err := s.Reconfigure(reload)
+	if err != nil {
+		logger.Error("config reload failed, nothing changed", "err", err)
+		return loaded
+	}
+	slices.Sort(ignored)
+	logger.Info("config reloaded", "path", path, "changed", changed, "ignored", ignored)
+
+	// Settings that were ignored keep the value they had, so later reloads
+	// still report them.
+	next := maps.Clone(loaded)
+	if next == nil {
+		next = make(map[string]string)
+	}
+	for name, value := range values {
+		if canonical := canonicalFlag(name); !explicit[canonical] && server.Reloadable(canonical) {
+			next[name] = value
+		}
+	}
+	return next
+}
@@ -5,6 +5,12 @@ import (
 	"distributedCache/server"
 	"flag"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -12,30 +18,251 @@ func main() {
 		listenAddr  = flag.String("listenaddr", ":3000", "Address this server listens on")
 		leaderAddr  = flag.String("leaderaddr", "", "Address of the leader (leave blank if this is the leader)")
 		storagePath = flag.String("storage", "cache.db", "Path to store persistent cache data")
+		compression = flag.String("storage-compression", "none", "Compress snapshots on disk: none or gzip")
+		format      = flag.String("storage-format", "auto", "Snapshot format on disk: gob, json, or auto to use json if -storage ends in .json")
+		saveEvery   = flag.Duration("saveinterval", 5*time.Minute, "Longest time between snapshots while there are unsaved writes")
+		saveRules   = flag.String("save", "", "Also snapshot after N writes within a duration, e.g. 1000/1m,10/5m")
+		heartbeat   = flag.Duration("heartbeat", 3*time.Second, "Interval between leader/follower heartbeats")
+		concern     = flag.String("writeconcern", "async", "Followers that must acknowledge a write before the leader replies: async, one, quorum or all")
+		ackTimeout  = flag.Duration("acktimeout", time.Second, "How long a write waits for -writeconcern before replying with an error")
+		reconnect   = flag.Duration("reconnectmax", 30*time.Second, "Maximum backoff between follower reconnect attempts")
+		maxFollower = flag.Int("maxfollowers", 0, "Followers a leader takes at once; more are refused (0 for no limit)")
+		minRepLag   = flag.Duration("min-replicas-max-lag", 0, "Refuse writes on the leader unless a follower is no more than this far behind (0 disables)")
+		priority    = flag.Int("failover-priority", 0, "Priority for self-promotion when the leader dies (0 disables)")
+		advertise   = flag.String("advertiseaddr", "", "Address other nodes use to reach this one (defaults to listenaddr)")
+		httpAddr    = flag.String("httpaddr", "", "Address for the HTTP listener serving /metrics, /healthz, /readyz and the /keys REST gateway (off if blank)")
+		maxBytes    = flag.Int64("maxbytes", 0, "Evict keys beyond this many bytes of keys and values (0 for no limit)")
+		maxKeyBytes = flag.Int("maxkeybytes", 0, "Reject keys longer than this many bytes (0 for no limit)")
+		maxValBytes = flag.Int("maxvaluebytes", 0, "Reject values longer than this many bytes (0 for no limit)")
+		latencyBkts = flag.String("latencybuckets", "", "Upper bounds of the per-command latency histogram buckets, e.g. 100us,1ms,10ms (default 50us to 1s)")
+		rateLimit   = flag.Float64("ratelimit", 0, "Commands per second allowed on each client connection (0 for no limit)")
+		rateBurst   = flag.Int("rateburst", 100, "Commands a client connection may send at once before -ratelimit applies")
+		globalRate  = flag.Float64("globalratelimit", 0, "Commands per second allowed across all client connections (0 for no limit)")
+		rateWait    = flag.Duration("ratelimitwait", 0, "How long a command over a rate limit may be held back before it is refused")
+		maxCmdBytes = flag.Int("maxcommandbytes", 64<<20, "Reject command lines longer than this many bytes (0 for no limit)")
+		maxBatch    = flag.Int("maxbatchpairs", 100000, "Reject BATCH and MSETNX commands with more pairs than this (0 for no limit)")
+		cmdTimeout  = flag.Duration("commandtimeout", 0, "Abandon a command with an error once it has run this long (0 for no limit)")
+		evictPolicy = flag.String("evictionpolicy", "lru", "Which keys -maxbytes evicts: lru, lfu, fifo or random")
+		atomicBatch = flag.Bool("atomicbatch", false, "Reject a whole BATCH if any pair is invalid")
+		useWAL      = flag.Bool("wal", false, "Log every write next to the storage file so it survives a crash")
+		walSync     = flag.Bool("walsync", false, "fsync the write-ahead log after every write")
+		logLevel    = flag.String("loglevel", "info", "Minimum log level: debug, info, warn or error")
+		logFile     = flag.String("logfile", "", "Append logs to this file instead of writing them to stderr")
+		logValues   = flag.Bool("logvalues", false, "Include values in debug logs (may leak sensitive data)")
+		trackAccess = flag.Bool("trackaccess", false, "Count reads per key for HOTKEYS (adds overhead to reads)")
+		shards      = flag.Int("shards", 16, "Number of independently locked shards the cache is split into")
+		negativeTTL = flag.Duration("negativettl", 0, "How long a GET miss or SETABSENT marks a key as known to be absent (0 disables negative caching)")
+		sliding     = flag.Bool("slidingexpiration", false, "Push a key's expiry back to its full TTL whenever it is read")
+		compressMin = flag.Int("compressabove", 0, "Store values longer than this many bytes gzipped (0 disables)")
+		missFilter  = flag.Int("missfilter", 0, "Keep a Bloom filter sized for this many keys to answer misses faster (0 disables)")
+		checksums   = flag.Bool("checksums", false, "Keep a CRC32 of every value and refuse reads of values that no longer match it")
+		clusterPeer = flag.String("clusterpeers", "", "Comma-separated addresses of the other nodes to shard keys across, as each advertises itself (off if blank)")
+		clusterVNum = flag.Int("clustervnodes", 0, "Points each node gets on the cluster's hash ring (default 160)")
+		clusterRedr = flag.Bool("clusterredirect", false, "Answer commands for keys another node owns with MOVED <addr> instead of proxying them")
+		preload     = flag.String("preload", "", "Seed the cache from this file before accepting connections: one JSON entry as EXPORT writes them, SET or BATCH command per line")
+		strict      = flag.Bool("strict", false, "Refuse to start if a -preload line is malformed, instead of skipping it")
+		configPath  = flag.String("config", "", "JSON file of flag names to values, read at startup and again on SIGHUP; flags on the command line take precedence")
 	)
+	flag.DurationVar(saveEvery, "save-interval", *saveEvery, "Alias for -saveinterval")
+	flag.Float64Var(rateLimit, "max-ops-per-conn", *rateLimit, "Alias for -ratelimit")
 	flag.Parse()
 
+	explicit := setFromCommandLine()
+	var loaded map[string]string
+	if *configPath != "" {
+		var err error
+		if loaded, err = readConfigFile(*configPath); err == nil {
+			err = applyConfigFile(loaded, explicit)
+		}
+		if err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("Invalid -loglevel: %v", err)
+	}
+	logOut := os.Stderr
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Invalid -logfile: %v", err)
+		}
+		defer f.Close()
+		logOut = f
+	}
+	logger := slog.New(slog.NewTextHandler(logOut, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	rules, err := server.ParseSaveRules(*saveRules)
+	if err != nil {
+		logger.Error("invalid -save", "err", err)
+		os.Exit(1)
+	}
+
+	buckets, err := server.ParseLatencyBuckets(*latencyBkts)
+	if err != nil {
+		logger.Error("invalid -latencybuckets", "err", err)
+		os.Exit(1)
+	}
+	writeConcern, err := server.ParseWriteConcern(*concern)
+	if err != nil {
+		logger.Error("invalid -writeconcern", "err", err)
+		os.Exit(1)
+	}
+
 	isLeader := *leaderAddr == ""
 	opts := server.Options{
 		ListenAddr:  *listenAddr,
 		IsLeader:    isLeader,
 		LeaderAddr:  *leaderAddr,
 		StoragePath: *storagePath,
+		HTTPAddr:    *httpAddr,
+
+		SaveInterval:      *saveEvery,
+		SaveRules:         rules,
+		HeartbeatInterval: *heartbeat,
+		WriteConcern:      writeConcern,
+		AckTimeout:        *ackTimeout,
+		ReconnectMaxDelay: *reconnect,
+		MaxFollowers:      *maxFollower,
+		MinReplicasMaxLag: *minRepLag,
+		FailoverPriority:  *priority,
+		AdvertiseAddr:     *advertise,
+		MaxCommandBytes:   *maxCmdBytes,
+		MaxBatchPairs:     *maxBatch,
+		CommandTimeout:    *cmdTimeout,
+		ClusterVNodes:     *clusterVNum,
+		ClusterRedirect:   *clusterRedr,
+		RateLimit:         *rateLimit,
+		LatencyBuckets:    buckets,
+		RateBurst:         *rateBurst,
+		GlobalRateLimit:   *globalRate,
+		RateLimitWait:     *rateWait,
+		Logger:            logger,
+		LogLevel:          level,
+	}
+	if *maxCmdBytes == 0 {
+		opts.MaxCommandBytes = -1
+	}
+	if *clusterPeer != "" {
+		opts.ClusterPeers = strings.Split(*clusterPeer, ",")
+	}
+	if *maxBatch == 0 {
+		opts.MaxBatchPairs = -1
+	}
+
+	cacheOpts := []cache.Option{cache.WithLogger(logger), cache.WithShards(*shards)}
+	if *atomicBatch {
+		cacheOpts = append(cacheOpts, cache.WithAtomicBatches())
+	}
+	if *maxKeyBytes > 0 {
+		cacheOpts = append(cacheOpts, cache.WithMaxKeyBytes(*maxKeyBytes))
+	}
+	if *maxValBytes > 0 {
+		cacheOpts = append(cacheOpts, cache.WithMaxValueBytes(*maxValBytes))
+	}
+	if *maxBytes > 0 {
+		policy, err := cache.ParseEvictionPolicy(*evictPolicy)
+		if err != nil {
+			logger.Error("invalid -evictionpolicy", "err", err)
+			os.Exit(1)
+		}
+		cacheOpts = append(cacheOpts, cache.WithMaxBytes(*maxBytes), cache.WithEvictionPolicy(policy))
+	}
+	if *logValues {
+		cacheOpts = append(cacheOpts, cache.WithLogValues())
+	}
+	if *trackAccess {
+		cacheOpts = append(cacheOpts, cache.WithAccessTracking())
+	}
+	if *negativeTTL > 0 {
+		cacheOpts = append(cacheOpts, cache.WithNegativeCaching(*negativeTTL))
+	}
+	if *sliding {
+		cacheOpts = append(cacheOpts, cache.WithSlidingExpiration())
+	}
+	if *missFilter > 0 {
+		cacheOpts = append(cacheOpts, cache.WithMissFilter(*missFilter))
+	}
+	if *compressMin > 0 {
+		cacheOpts = append(cacheOpts, cache.WithValueCompression(*compressMin))
+	}
+	if *checksums {
+		cacheOpts = append(cacheOpts, cache.WithChecksums())
+	}
+	if *storagePath != "" {
+		comp, err := cache.ParseCompression(*compression)
+		if err != nil {
+			logger.Error("invalid -storage-compression", "err", err)
+			os.Exit(1)
+		}
+		cacheOpts = append(cacheOpts, cache.WithCompression(comp))
+		f, err := cache.ParseFormat(*format)
+		if err != nil {
+			logger.Error("invalid -storage-format", "err", err)
+			os.Exit(1)
+		}
+		cacheOpts = append(cacheOpts, cache.WithFormat(f))
+	}
+	if *useWAL {
+		cacheOpts = append(cacheOpts, cache.WithWAL(*walSync))
 	}
 
 	var c cache.Cacher
-	var err error
 	if *storagePath != "" {
-		c, err = cache.NewPersistentCache(*storagePath)
+		c, err = cache.NewPersistentCache(*storagePath, cacheOpts...)
 		if err != nil {
-			log.Fatalf("Failed to create persistent cache: %v", err)
+			logger.Error("failed to create persistent cache", "err", err)
+			os.Exit(1)
 		}
 	} else {
-		c = cache.NewCache()
+		c = cache.NewCache(cacheOpts...)
 	}
 
 	s := server.New(opts, c)
+	if *preload != "" {
+		if err := preloadFile(s, *preload, *strict); err != nil {
+			logger.Error("preload failed", "path", *preload, "err", err)
+			os.Exit(1)
+		}
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		logger.Info("shutting down")
+		if err := s.Close(); err != nil {
+			logger.Error("shutdown failed", "err", err)
+		}
+	}()
+	if *configPath != "" {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				loaded = reloadConfigFile(s, *configPath, loaded, explicit, logger)
+			}
+		}()
+	}
 	if err := s.Start(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		logger.Error("failed to start server", "err", err)
+		os.Exit(1)
+	}
+}
+
+func preloadFile(s *server.Server, path string, strict bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := time.Now()
+	n, err := s.Preload(f, strict)
+	if err != nil {
+		return err
 	}
+	slog.Info("preloaded cache", "path", path, "keys", n, "took", time.Since(start))
+	return nil
 }
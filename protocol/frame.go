@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Protocol versions negotiated with HELLO. Version 1 writes each response as
+// raw bytes with no terminator, which is fine for a person at a prompt but
+// leaves a program no way to tell where a response ends. Version 2 frames
+// every response.
+const (
+	ProtoRaw    = 1
+	ProtoFramed = 2
+)
+
+// A framed response is a header line of '+' (success) or '-' (error) and the
+// payload length, then the payload and a newline: "+2\nOK\n".
+const (
+	frameOK  = '+'
+	frameErr = '-'
+)
+
+// ResponseError is an error reply from the server, as opposed to a failure
+// to talk to it.
+type ResponseError struct {
+	Msg string
+}
+
+func (e *ResponseError) Error() string { return e.Msg }
+
+// EncodeFrame frames payload, or err's message if err is non-nil.
+func EncodeFrame(payload []byte, err error) []byte {
+	kind := byte(frameOK)
+	if err != nil {
+		kind, payload = frameErr, []byte(err.Error())
+	}
+	b := make([]byte, 0, len(payload)+24)
+	b = append(b, kind)
+	b = strconv.AppendInt(b, int64(len(payload)), 10)
+	b = append(b, '\n')
+	b = append(b, payload...)
+	return append(b, '\n')
+}
+
+// ReadFrame reads one framed response. An error reply is returned as a
+// *ResponseError; any other error means the connection is no longer usable.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 3 || (header[0] != frameOK && header[0] != frameErr) {
+		return nil, fmt.Errorf("invalid frame header %q", header)
+	}
+	n, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid frame length %q", header[1:len(header)-1])
+	}
+	buf := make([]byte, n+1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\n' {
+		return nil, fmt.Errorf("frame not terminated")
+	}
+	if header[0] == frameErr {
+		return nil, &ResponseError{Msg: string(buf[:n])}
+	}
+	return buf[:n], nil
+}
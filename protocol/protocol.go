@@ -1,8 +1,11 @@
 package protocol
 
 import (
+	"bufio"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -11,51 +14,479 @@ import (
 type Command string
 
 const (
-	CMDGet     Command = "GET"
-	CMDSet     Command = "SET"
-	CMDDel     Command = "DEL"
-	CMDHas     Command = "HAS"
-	CMDKeys    Command = "KEYS"
-	CMDMetrics Command = "METRICS"
-	CMDBatch   Command = "BATCH"
+	CMDGet        Command = "GET"
+	CMDSet        Command = "SET"
+	CMDDel        Command = "DEL"
+	CMDHas        Command = "HAS"
+	CMDKeys       Command = "KEYS"
+	CMDMetrics    Command = "METRICS"
+	CMDBatch      Command = "BATCH"
+	CMDMSetNX     Command = "MSETNX"
+	CMDScan       Command = "SCAN"
+	CMDMGet       Command = "MGET"
+	CMDMDel       Command = "MDEL"
+	CMDSave       Command = "SAVE"
+	CMDBgsave     Command = "BGSAVE"
+	CMDClients    Command = "CLIENTS"
+	CMDDump       Command = "DUMP"
+	CMDRestore    Command = "RESTORE"
+	CMDInspect    Command = "INSPECT"
+	CMDInfoKey    Command = "INFOKEY" // alias of INSPECT
+	CMDHotKeys    Command = "HOTKEYS"
+	CMDLatency    Command = "LATENCY"
+	CMDConfig     Command = "CONFIG"
+	CMDValidate   Command = "VALIDATE"
+	CMDStats      Command = "STATS"
+	CMDSnapshot   Command = "SNAPSHOT"
+	CMDAddNode    Command = "ADDNODE"
+	CMDRemoveNode Command = "REMOVENODE"
+	CMDCas        Command = "CAS"
+	CMDCasVersion Command = "CASVERSION"
+	CMDSetAbsent  Command = "SETABSENT"
+	CMDRename     Command = "RENAME"
+	CMDCopy       Command = "COPY"
+	CMDTouch      Command = "TOUCH"
+	CMDTouchKeys  Command = "TOUCHKEYS"
+	CMDAppend     Command = "APPEND"
+	CMDGetDel     Command = "GETDEL"
+	CMDGetEx      Command = "GETEX"
+	CMDDBSize     Command = "DBSIZE"
+	CMDRandomKey  Command = "RANDOMKEY"
+	CMDMulti      Command = "MULTI"
+	CMDExec       Command = "EXEC"
+	CMDDiscard    Command = "DISCARD"
+	CMDHello      Command = "HELLO"
+	CMDSelect     Command = "SELECT"
+	CMDUse        Command = "USE" // alias of SELECT
+
+	// Keyspace notifications
+	CMDSubscribe   Command = "SUBSCRIBE"
+	CMDUnsubscribe Command = "UNSUBSCRIBE"
+
+	// Replication link commands
+	CMDJoin      Command = "JOIN"
+	CMDPing      Command = "PING"
+	CMDPong      Command = "PONG"
+	CMDAck       Command = "ACK"
+	CMDReplicas  Command = "REPLICAS"
+	CMDFollowers Command = "FOLLOWERS" // alias of REPLICAS
+	CMDPeers     Command = "PEERS"
+	CMDPromote   Command = "PROMOTE"
+)
+
+// Event kinds pushed to subscribers as "EVENT <kind> <key>".
+const (
+	EventSet    = "SET"
+	EventDel    = "DEL"
+	EventExpire = "EXPIRE"
+)
+
+// Queued is the reply to each command sent between MULTI and EXEC.
+const Queued = "QUEUED"
+
+// StreamEnd is the line that ends a whole-cache DUMP, and the stream of
+// entries sent after a bare RESTORE.
+const StreamEnd = "END"
+
+// emptyValue stands in for an empty CAS expected value, which can't be
+// written as a space-separated field.
+const emptyValue = `""`
+
+// EmptyReply is sent on an unframed connection in place of an empty
+// response, such as GET of an empty value or KEYS matching nothing, since
+// writing nothing at all would leave the client waiting for a reply.
+const EmptyReply = emptyValue
+
+// withVersion is the GET option that asks for the key's version, returned as
+// "<version> <value>".
+const withVersion = "WITHVERSION"
+
+// ReplicationTag prefixes operations the leader forwards to its followers so
+// they can be told apart from client commands on the wire. It is followed by
+// the operation's sequence number, then the operation, as in
+// "REPL 42 SET k v 0".
+const ReplicationTag = "REPL"
+
+// ForwardTag prefixes commands a cluster node proxies to the node that owns
+// their keys. The owner always runs a forwarded command itself, or replies
+// MOVED, so a command is never passed along twice, even while nodes
+// disagree about who owns what.
+const ForwardTag = "FWD"
+
+// MovedPrefix starts the error a cluster node replies with for a key another
+// node owns, followed by that node's address.
+const MovedPrefix = "MOVED "
+
+// Error replies for a read of a key that isn't there: ReplyNotFound for one
+// that doesn't exist or has expired, ReplyKnownAbsent for one marked with
+// SETABSENT. Unlike other errors, which are meant to be read, each is the
+// whole message, so clients can compare against it exactly.
+const (
+	ReplyNotFound    = "NOTFOUND"
+	ReplyKnownAbsent = "KNOWNABSENT"
 )
 
+// Moved reports whether err is a MOVED reply, and if so, the address of the
+// node to send the command to instead.
+func Moved(err error) (string, bool) {
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return "", false
+	}
+	return strings.CutPrefix(respErr.Msg, MovedPrefix)
+}
+
 type Message struct {
 	Cmd   Command
 	Key   []byte
 	Value []byte
 	TTL   time.Duration
 	Pairs map[string][]byte // For batch operations
+	Keys  [][]byte          // For multi-key reads
+
+	// NewKey is where RENAME and COPY put Key. A COPY with no TTL has a
+	// negative one, to keep the source key's.
+	NewKey []byte
+
+	// Pattern filters KEYS and SUBSCRIBE using path.Match syntax.
+	Pattern string
+
+	// Cursor and Count page through the keyspace for SCAN. Count also
+	// limits HOTKEYS.
+	Cursor uint64
+	Count  int
+
+	// Addr and Priority describe a follower in JOIN; PEERS carries the
+	// recipient's own address in Addr.
+	Addr     string
+	Priority int
+	Peers    []Peer
+
+	// Replace lets RESTORE or COPY overwrite a live key.
+	Replace bool
+
+	// Reset makes LATENCY clear the histograms instead of reporting them.
+	Reset bool
+
+	// Param is the setting CONFIG SET changes to Value, or with no Value, the
+	// settings CONFIG GET reads, as a path.Match pattern.
+	Param string
+
+	// Snapshot names the snapshot SNAPSHOT writes, or with Load, the one it
+	// restores. SNAPSHOT LIST leaves it empty.
+	Snapshot string
+	Load     bool
+
+	// Version is the protocol version requested by HELLO.
+	Version int
+
+	// Namespace is the namespace SELECT switches the connection to.
+	Namespace string
+
+	// Expected is the value CAS requires the key to hold; empty means the
+	// key must be absent.
+	Expected []byte
+
+	// KeyVersion is the version CASVERSION requires the key to be at; 0
+	// means the key must be absent. WithVersion asks GET to return the
+	// key's version along with its value.
+	KeyVersion  uint64
+	WithVersion bool
+
+	// Replicated marks an operation forwarded by the leader, and Seq is its
+	// place in the leader's stream of replicated operations, which counts
+	// up from 1. In an ACK, Seq is the last one the follower applied.
+	Replicated bool
+	Seq        uint64
+
+	// Forwarded marks a command proxied by another cluster node.
+	Forwarded bool
+
+	// Offset is how many replicated operations a follower has applied
+	// since joining, in the ACK it sends the leader.
+	Offset uint64
+
+	// Ops are the writes of a transaction the leader replicates as one
+	// EXEC.
+	Ops []*Message
+}
+
+// Peer is a follower as advertised to the rest of the cluster for failover.
+type Peer struct {
+	Addr     string
+	Priority int
 }
 
 func (m *Message) ToBytes() []byte {
+	if m.Replicated {
+		op := *m
+		op.Replicated = false
+		op.Seq = 0
+		return append([]byte(fmt.Sprintf("%s %d ", ReplicationTag, m.Seq)), op.ToBytes()...)
+	}
+	if m.Forwarded {
+		op := *m
+		op.Forwarded = false
+		return append([]byte(ForwardTag+" "), op.ToBytes()...)
+	}
+
 	switch m.Cmd {
 	case CMDSet:
 		return []byte(fmt.Sprintf("SET %s %s %d", m.Key, m.Value, m.TTL))
-	case CMDGet, CMDHas, CMDDel:
+	case CMDCas:
+		expected := string(m.Expected)
+		if expected == "" {
+			expected = emptyValue
+		}
+		return []byte(fmt.Sprintf("CAS %s %s %s %d", m.Key, expected, m.Value, m.TTL))
+	case CMDCasVersion:
+		return []byte(fmt.Sprintf("CASVERSION %s %d %s %d", m.Key, m.KeyVersion, m.Value, m.TTL))
+	case CMDGet:
+		if m.WithVersion {
+			return []byte(fmt.Sprintf("GET %s %s", m.Key, withVersion))
+		}
+		return []byte(fmt.Sprintf("GET %s", m.Key))
+	case CMDHas, CMDDel, CMDInspect, CMDInfoKey, CMDSetAbsent, CMDGetDel:
 		return []byte(fmt.Sprintf("%s %s", m.Cmd, m.Key))
+	case CMDDump:
+		if m.Key == nil {
+			return []byte("DUMP")
+		}
+		return []byte(fmt.Sprintf("DUMP %s", m.Key))
+	case CMDRestore:
+		if m.Key == nil {
+			return []byte("RESTORE")
+		}
+		b := fmt.Sprintf("RESTORE %s %s", m.Key, base64.StdEncoding.EncodeToString(m.Value))
+		if m.Replace {
+			b += " REPLACE"
+		}
+		return []byte(b)
 	case CMDKeys:
+		if m.Pattern != "" {
+			return []byte(fmt.Sprintf("KEYS %s", m.Pattern))
+		}
 		return []byte("KEYS")
-	case CMDMetrics:
-		return []byte("METRICS")
-	case CMDBatch:
+	case CMDMetrics, CMDStats, CMDSave, CMDBgsave, CMDClients, CMDDBSize, CMDRandomKey, CMDMulti, CMDDiscard:
+		return []byte(m.Cmd)
+	case CMDExec:
+		if len(m.Ops) == 0 {
+			return []byte("EXEC")
+		}
+		// The ops travel as one base64 field so the whole transaction is a
+		// single line.
+		lines := make([]string, len(m.Ops))
+		for i, op := range m.Ops {
+			lines[i] = string(op.ToBytes())
+		}
+		return []byte("EXEC " + base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n"))))
+	case CMDAddNode, CMDRemoveNode:
+		return []byte(fmt.Sprintf("%s %s", m.Cmd, m.Addr))
+	case CMDJoin:
+		if m.Addr == "" {
+			return []byte("JOIN")
+		}
+		return []byte(fmt.Sprintf("JOIN %s %d", m.Addr, m.Priority))
+	case CMDPeers:
+		peers := make([]string, len(m.Peers))
+		for i, p := range m.Peers {
+			peers[i] = fmt.Sprintf("%s=%d", p.Addr, p.Priority)
+		}
+		return []byte(strings.TrimSpace(fmt.Sprintf("PEERS %s %s", m.Addr, strings.Join(peers, ","))))
+	case CMDPing:
+		if m.Value != nil {
+			return []byte(fmt.Sprintf("PING %s", m.Value))
+		}
+		return []byte("PING")
+	case CMDPong, CMDReplicas, CMDFollowers, CMDPromote, CMDUnsubscribe:
+		return []byte(m.Cmd)
+	case CMDSubscribe:
+		return []byte(fmt.Sprintf("SUBSCRIBE %s", m.Pattern))
+	case CMDBatch, CMDMSetNX:
 		pairs := make([]string, 0, len(m.Pairs))
 		for k, v := range m.Pairs {
 			pairs = append(pairs, fmt.Sprintf("%s:%s", k, v))
 		}
-		return []byte(fmt.Sprintf("BATCH %s %d", strings.Join(pairs, ","), m.TTL))
+		return []byte(fmt.Sprintf("%s %s %d", m.Cmd, strings.Join(pairs, ","), m.TTL))
+	case CMDScan:
+		return []byte(fmt.Sprintf("SCAN %d %d", m.Cursor, m.Count))
+	case CMDAck:
+		return []byte(fmt.Sprintf("ACK %d %d", m.Offset, m.Seq))
+	case CMDRename:
+		return []byte(fmt.Sprintf("RENAME %s %s", m.Key, m.NewKey))
+	case CMDCopy:
+		b := fmt.Sprintf("COPY %s %s", m.Key, m.NewKey)
+		if m.TTL >= 0 {
+			b += fmt.Sprintf(" %d", m.TTL)
+		}
+		if m.Replace {
+			b += " REPLACE"
+		}
+		return []byte(b)
+	case CMDGetEx:
+		return []byte(fmt.Sprintf("GETEX %s %d", m.Key, m.TTL))
+	case CMDAppend:
+		return []byte(fmt.Sprintf("APPEND %s %s", m.Key, m.Value))
+	case CMDTouch:
+		if m.TTL < 0 {
+			return []byte(fmt.Sprintf("TOUCH %s", m.Key))
+		}
+		return []byte(fmt.Sprintf("TOUCH %s TTL %d", m.Key, m.TTL))
+	case CMDTouchKeys:
+		keys := make([]string, len(m.Keys))
+		for i, k := range m.Keys {
+			keys[i] = string(k)
+		}
+		return []byte(fmt.Sprintf("TOUCHKEYS %s", strings.Join(keys, " ")))
+	case CMDSelect, CMDUse:
+		return []byte(fmt.Sprintf("%s %s", m.Cmd, m.Namespace))
+	case CMDHello:
+		return []byte(fmt.Sprintf("HELLO %d", m.Version))
+	case CMDHotKeys:
+		if m.Count > 0 {
+			return []byte(fmt.Sprintf("HOTKEYS %d", m.Count))
+		}
+		return []byte("HOTKEYS")
+	case CMDConfig:
+		if m.Value == nil {
+			return []byte("CONFIG GET " + m.Param)
+		}
+		return []byte(fmt.Sprintf("CONFIG SET %s %s", m.Param, m.Value))
+	case CMDValidate:
+		return append([]byte("VALIDATE "), m.Value...)
+	case CMDSnapshot:
+		switch {
+		case m.Load:
+			return []byte("SNAPSHOT RESTORE " + m.Snapshot)
+		case m.Snapshot == "":
+			return []byte("SNAPSHOT LIST")
+		}
+		return []byte("SNAPSHOT " + m.Snapshot)
+	case CMDLatency:
+		if m.Reset {
+			return []byte("LATENCY RESET")
+		}
+		return []byte("LATENCY")
+	case CMDMGet, CMDMDel:
+		keys := make([]string, len(m.Keys))
+		for i, k := range m.Keys {
+			keys[i] = string(k)
+		}
+		return []byte(fmt.Sprintf("%s %s", m.Cmd, strings.Join(keys, " ")))
 	}
 	return nil
 }
 
+// EncodeMulti frames several values for a multi-key response: a "*<n>" header
+// line, then each value as a "$<len>" line followed by the raw bytes, or
+// "$-1" for a key that was not found.
+func EncodeMulti(vals [][]byte, found []bool) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\n", len(vals))
+	for i, v := range vals {
+		if !found[i] {
+			b.WriteString("$-1\n")
+			continue
+		}
+		fmt.Fprintf(&b, "$%d\n%s\n", len(v), v)
+	}
+	return []byte(b.String())
+}
+
+// DecodeMulti parses a response built by EncodeMulti. A key that was not
+// found has a nil value.
+func DecodeMulti(b []byte) ([][]byte, error) {
+	line, rest, ok := strings.Cut(string(b), "\n")
+	if !ok || !strings.HasPrefix(line, "*") {
+		return nil, errors.New("invalid multi-value header")
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid multi-value count %q", line[1:])
+	}
+	vals := make([][]byte, n)
+	for i := range vals {
+		line, rest, ok = strings.Cut(rest, "\n")
+		if !ok || !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("invalid header for value %d", i)
+		}
+		if line == "$-1" {
+			continue
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || len(rest) < size+1 || rest[size] != '\n' {
+			return nil, fmt.Errorf("invalid value %d", i)
+		}
+		vals[i], rest = []byte(rest[:size]), rest[size+1:]
+	}
+	return vals, nil
+}
+
+// EncodeEvent builds the newline-terminated notification pushed to
+// subscribers when key changes.
+func EncodeEvent(kind string, key []byte) []byte {
+	return []byte(fmt.Sprintf("EVENT %s %s\n", kind, key))
+}
+
+// ErrCommandTooLong is returned by ReadCommand for a line over its limit.
+var ErrCommandTooLong = errors.New("command too long")
+
+// ReadCommand reads one newline-terminated command, returning it and the
+// number of bytes consumed. A command longer than max bytes is read to its
+// end and dropped with ErrCommandTooLong, so no more than max bytes are ever
+// buffered and the next command is read from the right place. A max of 0
+// means no limit.
+func ReadCommand(r *bufio.Reader, max int) ([]byte, int, error) {
+	var (
+		line []byte
+		n    int
+	)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += len(chunk)
+		if max <= 0 || n <= max {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return line, n, err
+		case max > 0 && n > max:
+			return nil, n, fmt.Errorf("%w: over %d bytes", ErrCommandTooLong, max)
+		}
+		return line, n, nil
+	}
+}
+
 func ParseCommand(raw []byte) (*Message, error) {
 	parts := strings.Fields(string(raw))
+	replicated := len(parts) > 0 && parts[0] == ReplicationTag
+	var seq uint64
+	if replicated {
+		parts = parts[1:]
+		// Command names are never numbers, so one here is the sequence
+		// number, which a leader from before they were added leaves out.
+		if len(parts) > 1 {
+			if n, err := strconv.ParseUint(parts[0], 10, 64); err == nil {
+				seq = n
+				parts = parts[1:]
+			}
+		}
+	}
+	forwarded := !replicated && len(parts) > 0 && parts[0] == ForwardTag
+	if forwarded {
+		parts = parts[1:]
+	}
 	if len(parts) < 1 {
 		return nil, errors.New("invalid command")
 	}
 
 	msg := &Message{
-		Cmd: Command(parts[0]),
+		Cmd:        Command(parts[0]),
+		Replicated: replicated,
+		Seq:        seq,
+		Forwarded:  forwarded,
 	}
 
 	switch msg.Cmd {
@@ -71,27 +502,122 @@ func ParseCommand(raw []byte) (*Message, error) {
 		}
 		msg.TTL = time.Duration(ttl)
 
-	case CMDGet, CMDHas, CMDDel:
+	case CMDCas:
+		if len(parts) != 5 {
+			return nil, errors.New("invalid CAS command format")
+		}
+		msg.Key = []byte(parts[1])
+		if parts[2] != emptyValue {
+			msg.Expected = []byte(parts[2])
+		}
+		msg.Value = []byte(parts[3])
+		ttl, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL: %w", err)
+		}
+		msg.TTL = time.Duration(ttl)
+
+	case CMDCasVersion:
+		if len(parts) != 5 {
+			return nil, errors.New("invalid CASVERSION command format")
+		}
+		version, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version: %w", err)
+		}
+		msg.Key = []byte(parts[1])
+		msg.KeyVersion = version
+		msg.Value = []byte(parts[3])
+		ttl, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL: %w", err)
+		}
+		msg.TTL = time.Duration(ttl)
+
+	case CMDGet:
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != withVersion) {
+			return nil, errors.New("invalid GET command format")
+		}
+		msg.Key = []byte(parts[1])
+		msg.WithVersion = len(parts) == 3
+
+	case CMDHas, CMDDel, CMDInspect, CMDInfoKey, CMDSetAbsent, CMDGetDel:
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid %s command format", msg.Cmd)
 		}
 		msg.Key = []byte(parts[1])
 
-	case CMDKeys, CMDMetrics:
+	case CMDDump:
+		// Without a key, DUMP exports the whole cache.
+		if len(parts) > 2 {
+			return nil, errors.New("invalid DUMP command format")
+		}
+		if len(parts) == 2 {
+			msg.Key = []byte(parts[1])
+		}
+
+	case CMDRestore:
+		// Without arguments, RESTORE is followed by entries to import.
+		if len(parts) == 1 {
+			break
+		}
+		// The payload travels base64-encoded since it is arbitrary binary.
+		if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "REPLACE") {
+			return nil, errors.New("invalid RESTORE command format")
+		}
+		payload, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		msg.Key = []byte(parts[1])
+		msg.Value = payload
+		msg.Replace = len(parts) == 4
+
+	case CMDKeys:
+		if len(parts) > 2 {
+			return nil, errors.New("invalid KEYS command format")
+		}
+		if len(parts) == 2 {
+			if _, err := path.Match(parts[1], ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern: %w", err)
+			}
+			msg.Pattern = parts[1]
+		}
+
+	case CMDSubscribe:
+		if len(parts) != 2 {
+			return nil, errors.New("invalid SUBSCRIBE command format")
+		}
+		if _, err := path.Match(parts[1], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		msg.Pattern = parts[1]
+
+	case CMDPing:
+		// PING with a payload echoes it back instead of PONG.
+		if len(parts) > 2 {
+			return nil, errors.New("invalid PING command format")
+		}
+		if len(parts) == 2 {
+			msg.Value = []byte(parts[1])
+		}
+
+	case CMDMetrics, CMDStats, CMDSave, CMDBgsave, CMDClients, CMDDBSize, CMDRandomKey, CMDMulti, CMDDiscard, CMDPong, CMDReplicas, CMDFollowers, CMDPromote, CMDUnsubscribe:
 		if len(parts) != 1 {
 			return nil, fmt.Errorf("invalid %s command format", msg.Cmd)
 		}
 
-	case CMDBatch:
+	case CMDBatch, CMDMSetNX:
 		if len(parts) < 3 {
-			return nil, errors.New("invalid BATCH command format")
+			return nil, fmt.Errorf("invalid %s command format", msg.Cmd)
 		}
+		// A key repeated within one batch takes its last value.
 		pairs := strings.Split(parts[1], ",")
 		msg.Pairs = make(map[string][]byte)
-		for _, pair := range pairs {
+		for i, pair := range pairs {
 			kv := strings.SplitN(pair, ":", 2)
 			if len(kv) != 2 {
-				return nil, errors.New("invalid key-value pair in BATCH")
+				return nil, fmt.Errorf("invalid key-value pair %d in %s: expected key:value", i+1, msg.Cmd)
 			}
 			msg.Pairs[kv[0]] = []byte(kv[1])
 		}
@@ -100,6 +626,238 @@ func ParseCommand(raw []byte) (*Message, error) {
 			return nil, fmt.Errorf("invalid TTL: %w", err)
 		}
 		msg.TTL = time.Duration(ttl)
+
+	case CMDExec:
+		if len(parts) > 2 {
+			return nil, errors.New("invalid EXEC command format")
+		}
+		if len(parts) == 1 {
+			break
+		}
+		ops, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXEC operations: %w", err)
+		}
+		for _, line := range strings.Split(string(ops), "\n") {
+			op, err := ParseCommand([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXEC operation: %w", err)
+			}
+			msg.Ops = append(msg.Ops, op)
+		}
+
+	case CMDMGet, CMDMDel:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid %s command format", msg.Cmd)
+		}
+		for _, k := range parts[1:] {
+			msg.Keys = append(msg.Keys, []byte(k))
+		}
+
+	case CMDAddNode, CMDRemoveNode:
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s command format: expected %s <addr>", msg.Cmd, msg.Cmd)
+		}
+		msg.Addr = parts[1]
+	case CMDJoin:
+		if len(parts) != 1 && len(parts) != 3 {
+			return nil, errors.New("invalid JOIN command format")
+		}
+		if len(parts) == 3 {
+			priority, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority: %w", err)
+			}
+			msg.Addr = parts[1]
+			msg.Priority = priority
+		}
+
+	case CMDPeers:
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, errors.New("invalid PEERS command format")
+		}
+		msg.Addr = parts[1]
+		if len(parts) == 3 {
+			for _, entry := range strings.Split(parts[2], ",") {
+				addr, prio, ok := strings.Cut(entry, "=")
+				if !ok {
+					return nil, errors.New("invalid peer in PEERS")
+				}
+				priority, err := strconv.Atoi(prio)
+				if err != nil {
+					return nil, fmt.Errorf("invalid priority: %w", err)
+				}
+				msg.Peers = append(msg.Peers, Peer{Addr: addr, Priority: priority})
+			}
+		}
+
+	case CMDScan:
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, errors.New("invalid SCAN command format")
+		}
+		cursor, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		msg.Cursor = cursor
+		if len(parts) == 3 {
+			count, err := strconv.Atoi(parts[2])
+			if err != nil || count <= 0 {
+				return nil, fmt.Errorf("invalid count: %s", parts[2])
+			}
+			msg.Count = count
+		}
+
+	case CMDRename:
+		if len(parts) != 3 {
+			return nil, errors.New("invalid RENAME command format")
+		}
+		msg.Key = []byte(parts[1])
+		msg.NewKey = []byte(parts[2])
+
+	case CMDCopy:
+		if n := len(parts); n > 3 && parts[n-1] == "REPLACE" {
+			msg.Replace = true
+			parts = parts[:n-1]
+		}
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, errors.New("invalid COPY command format")
+		}
+		msg.Key = []byte(parts[1])
+		msg.NewKey = []byte(parts[2])
+		msg.TTL = -1
+		if len(parts) == 4 {
+			ttl, err := strconv.ParseInt(parts[3], 10, 64)
+			if err != nil || ttl < 0 {
+				return nil, fmt.Errorf("invalid TTL: %s", parts[3])
+			}
+			msg.TTL = time.Duration(ttl)
+		}
+
+	case CMDGetEx:
+		if len(parts) != 3 {
+			return nil, errors.New("invalid GETEX command format")
+		}
+		msg.Key = []byte(parts[1])
+		ttl, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid TTL: %s", parts[2])
+		}
+		msg.TTL = time.Duration(ttl)
+
+	case CMDAppend:
+		if len(parts) != 3 {
+			return nil, errors.New("invalid APPEND command format")
+		}
+		msg.Key = []byte(parts[1])
+		msg.Value = []byte(parts[2])
+
+	case CMDTouch:
+		// TOUCH <key> restarts the key's TTL from the one it was set with;
+		// TOUCH <key> TTL <ttl> gives it a new one, and is how the leader
+		// replicates every TTL it restarts.
+		if len(parts) != 2 && (len(parts) != 4 || parts[2] != "TTL") {
+			return nil, errors.New("invalid TOUCH command format")
+		}
+		msg.Key = []byte(parts[1])
+		msg.TTL = -1
+		if len(parts) == 4 {
+			ttl, err := strconv.ParseInt(parts[3], 10, 64)
+			if err != nil || ttl < 0 {
+				return nil, fmt.Errorf("invalid TTL: %s", parts[3])
+			}
+			msg.TTL = time.Duration(ttl)
+		}
+
+	case CMDTouchKeys:
+		// Marking keys recently used is never replicated.
+		if len(parts) < 2 || replicated {
+			return nil, errors.New("invalid TOUCHKEYS command format")
+		}
+		for _, k := range parts[1:] {
+			msg.Keys = append(msg.Keys, []byte(k))
+		}
+
+	case CMDSelect, CMDUse:
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s command format", msg.Cmd)
+		}
+		msg.Namespace = parts[1]
+
+	case CMDAck:
+		// The sequence number is left out by followers from before they
+		// were added.
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, errors.New("invalid ACK command format")
+		}
+		offset, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset: %w", err)
+		}
+		msg.Offset = offset
+		if len(parts) == 3 {
+			if msg.Seq, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid sequence number: %w", err)
+			}
+		}
+
+	case CMDHello:
+		if len(parts) != 2 {
+			return nil, errors.New("invalid HELLO command format")
+		}
+		v, err := strconv.Atoi(parts[1])
+		if err != nil || (v != ProtoRaw && v != ProtoFramed) {
+			return nil, fmt.Errorf("unsupported protocol version: %s", parts[1])
+		}
+		msg.Version = v
+
+	case CMDHotKeys:
+		if len(parts) > 2 {
+			return nil, errors.New("invalid HOTKEYS command format")
+		}
+		if len(parts) == 2 {
+			count, err := strconv.Atoi(parts[1])
+			if err != nil || count <= 0 {
+				return nil, fmt.Errorf("invalid count: %s", parts[1])
+			}
+			msg.Count = count
+		}
+	case CMDValidate:
+		// Value is the command to check, which ParseCommand would split on
+		// whitespace anyway.
+		if len(parts) < 2 {
+			return nil, errors.New("invalid VALIDATE command format: expected VALIDATE <command>")
+		}
+		msg.Value = []byte(strings.Join(parts[1:], " "))
+	case CMDConfig:
+		switch {
+		case len(parts) == 3 && strings.ToUpper(parts[1]) == "GET":
+			msg.Param = strings.ToLower(parts[2])
+		case len(parts) == 4 && strings.ToUpper(parts[1]) == "SET":
+			msg.Param = strings.ToLower(parts[2])
+			msg.Value = []byte(parts[3])
+		default:
+			return nil, errors.New("invalid CONFIG command format: expected CONFIG GET <param|pattern> or CONFIG SET <param> <value>")
+		}
+	case CMDSnapshot:
+		// LIST and RESTORE can't be used as snapshot names.
+		switch {
+		case len(parts) == 2 && strings.ToUpper(parts[1]) == "LIST":
+		case len(parts) == 3 && strings.ToUpper(parts[1]) == "RESTORE":
+			msg.Snapshot = parts[2]
+			msg.Load = true
+		case len(parts) == 2 && strings.ToUpper(parts[1]) != "RESTORE":
+			msg.Snapshot = parts[1]
+		default:
+			return nil, errors.New("invalid SNAPSHOT command format: expected SNAPSHOT <name>, SNAPSHOT LIST or SNAPSHOT RESTORE <name>")
+		}
+	case CMDLatency:
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "RESET") {
+			return nil, errors.New("invalid LATENCY command format")
+		}
+		msg.Reset = len(parts) == 2
+	default:
+		return nil, fmt.Errorf("unknown command %q", parts[0])
 	}
 
 	return msg, nil
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCommandRejectsUnknown(t *testing.T) {
+	for _, line := range []string{"FOOBAR key", "FOOBAR", "GETT key"} {
+		msg, err := ParseCommand([]byte(line))
+		if err == nil {
+			t.Errorf("ParseCommand(%q) = %+v, want an unknown command error", line, msg)
+		}
+	}
+}
+
+func TestParseTouch(t *testing.T) {
+	tests := []struct {
+		line string
+		key  string
+		ttl  time.Duration
+	}{
+		// Plain TOUCH restarts the TTL the key was set with, whatever the
+		// key looks like.
+		{"TOUCH k", "k", -1},
+		{"TOUCH 30", "30", -1},
+		{"TOUCH k TTL 30", "k", 30},
+		{"TOUCH k TTL 0", "k", 0},
+		{"TOUCH TTL TTL 5", "TTL", 5},
+		{"REPL 7 TOUCH k TTL 30", "k", 30},
+	}
+	for _, tt := range tests {
+		msg, err := ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", tt.line, err)
+			continue
+		}
+		if msg.Cmd != CMDTouch || string(msg.Key) != tt.key || msg.TTL != tt.ttl || msg.Keys != nil {
+			t.Errorf("ParseCommand(%q) = %s key %q ttl %d keys %q, want TOUCH key %q ttl %d",
+				tt.line, msg.Cmd, msg.Key, msg.TTL, msg.Keys, tt.key, tt.ttl)
+		}
+		// What the leader sends its followers must parse back the same.
+		again, err := ParseCommand(msg.ToBytes())
+		if err != nil || string(again.Key) != tt.key || again.TTL != tt.ttl {
+			t.Errorf("%q round-tripped as %q: %+v, %v", tt.line, msg.ToBytes(), again, err)
+		}
+	}
+
+	for _, line := range []string{
+		"TOUCH",
+		"TOUCH k 30", // a TTL needs its keyword
+		"TOUCH a b",
+		"TOUCH k TTL",
+		"TOUCH k TTL -1",
+		"TOUCH k TTL soon",
+		"TOUCH k ttl 30",
+		"TOUCH k TTL 30 extra",
+	} {
+		if msg, err := ParseCommand([]byte(line)); err == nil {
+			t.Errorf("ParseCommand(%q) = %+v, want an error", line, msg)
+		}
+	}
+}
+
+func TestParseTouchKeys(t *testing.T) {
+	tests := []struct {
+		line string
+		keys string
+	}{
+		{"TOUCHKEYS k", "[k]"},
+		// Numbers are keys like any other.
+		{"TOUCHKEYS a 30", "[a 30]"},
+		{"TOUCHKEYS a TTL 30", "[a TTL 30]"},
+	}
+	for _, tt := range tests {
+		msg, err := ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", tt.line, err)
+			continue
+		}
+		if got := fmt.Sprintf("%s", msg.Keys); msg.Cmd != CMDTouchKeys || got != tt.keys || msg.Key != nil {
+			t.Errorf("ParseCommand(%q) = %s keys %s key %q, want TOUCHKEYS keys %s", tt.line, msg.Cmd, got, msg.Key, tt.keys)
+		}
+		if again := string(msg.ToBytes()); again != tt.line {
+			t.Errorf("ParseCommand(%q).ToBytes() = %q", tt.line, again)
+		}
+	}
+
+	// Recency isn't replicated, so a follower has no business being sent it.
+	for _, line := range []string{"TOUCHKEYS", "REPL 7 TOUCHKEYS k"} {
+		if msg, err := ParseCommand([]byte(line)); err == nil {
+			t.Errorf("ParseCommand(%q) = %+v, want an error", line, msg)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Package ring assigns keys to nodes by consistent hashing, so adding or
+// removing a node only moves the keys on its share of the ring. Servers in
+// cluster mode and clients that shard for themselves use the same ring, so
+// they agree on which node owns a key as long as they know the same nodes.
+package ring
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVNodes is how many points each node gets on the ring unless New is
+// told otherwise. More points spread keys more evenly, at the cost of memory
+// and a slightly slower lookup.
+const DefaultVNodes = 160
+
+// Ring is safe for concurrent use.
+type Ring struct {
+	vnodes int
+
+	mu     sync.RWMutex
+	nodes  []string // sorted
+	points []point  // sorted by hash
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns a ring of nodes, each given vnodes points, or DefaultVNodes if
+// vnodes isn't positive. Duplicate nodes are only added once.
+func New(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	r := &Ring{vnodes: vnodes}
+	for _, n := range nodes {
+		r.Add(n)
+	}
+	return r
+}
+
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	// FNV alone leaves similar inputs, such as a node's point labels, on
+	// nearby hashes; this finalizer (from MurmurHash3) spreads them out.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add puts node on the ring and reports whether it wasn't already there.
+func (r *Ring) Add(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, found := slices.BinarySearch(r.nodes, node)
+	if found {
+		return false
+	}
+	r.nodes = slices.Insert(r.nodes, i, node)
+	for v := range r.vnodes {
+		r.points = append(r.points, point{hash([]byte(node + "#" + strconv.Itoa(v))), node})
+	}
+	// Ties, however unlikely, are broken by node so every ring of the same
+	// nodes agrees.
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || (a.hash == b.hash && a.node < b.node)
+	})
+	return true
+}
+
+// Remove takes node off the ring and reports whether it was there.
+func (r *Ring) Remove(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, found := slices.BinarySearch(r.nodes, node)
+	if !found {
+		return false
+	}
+	r.nodes = slices.Delete(r.nodes, i, i+1)
+	r.points = slices.DeleteFunc(r.points, func(p point) bool { return p.node == node })
+	return true
+}
+
+// Owner returns the node that owns key: the one with the first point at or
+// after the key's hash, wrapping around. It returns "" if the ring is empty.
+func (r *Ring) Owner(key []byte) string {
+	h := hash(key)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.nodes)
+}
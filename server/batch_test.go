@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"distributedCache/protocol"
+)
+
+// batchLine is a BATCH of pairs pairs, keyed prefix-00000 upwards.
+func batchLine(prefix string, pairs int) string {
+	msg := &protocol.Message{Cmd: protocol.CMDBatch, Pairs: make(map[string][]byte, pairs)}
+	for i := 0; i < pairs; i++ {
+		msg.Pairs[fmt.Sprintf("%s-%05d", prefix, i)] = []byte(fmt.Sprintf("value-%05d", i))
+	}
+	return string(msg.ToBytes())
+}
+
+func dbSize(t *testing.T, c *testConn) int {
+	t.Helper()
+	payload, err := c.do(t, "DBSIZE")
+	if err != nil {
+		t.Fatalf("DBSIZE: %v", err)
+	}
+	n, err := strconv.Atoi(string(payload))
+	if err != nil {
+		t.Fatalf("DBSIZE replied %q", payload)
+	}
+	return n
+}
+
+func TestBatchLargerThanOldBuffer(t *testing.T) {
+	const pairs = 1000
+	s := startTestServer(t, Options{})
+	c := dialTestServer(t, s)
+
+	line := batchLine("key", pairs)
+	if len(line) <= 2048 {
+		t.Fatalf("batch is only %d bytes", len(line))
+	}
+	if _, err := c.do(t, line); err != nil {
+		t.Fatalf("BATCH of %d bytes: %v", len(line), err)
+	}
+	if n := dbSize(t, c); n != pairs {
+		t.Fatalf("DBSIZE = %d after the batch, want %d", n, pairs)
+	}
+	// Spot-check the pairs at both ends arrived whole.
+	for _, i := range []int{0, pairs - 1} {
+		want := fmt.Sprintf("value-%05d", i)
+		if got, err := c.do(t, fmt.Sprintf("GET key-%05d", i)); err != nil || string(got) != want {
+			t.Fatalf("GET key-%05d = %q, %v; want %q", i, got, err, want)
+		}
+	}
+}
+
+func TestBatchOverPairLimit(t *testing.T) {
+	const limit = 100
+	s := startTestServer(t, Options{MaxBatchPairs: limit})
+	c := dialTestServer(t, s)
+
+	if _, err := c.do(t, batchLine("ok", limit)); err != nil {
+		t.Fatalf("BATCH of exactly %d pairs: %v", limit, err)
+	}
+
+	_, err := c.do(t, batchLine("over", limit+1))
+	if err == nil || !strings.Contains(err.Error(), "more than the limit of 100") {
+		t.Fatalf("BATCH of %d pairs replied %v, want the pair limit error", limit+1, err)
+	}
+	// None of a rejected batch is stored, and the connection carries on.
+	if n := dbSize(t, c); n != limit {
+		t.Fatalf("DBSIZE = %d after a rejected batch, want %d", n, limit)
+	}
+}
+
+// TestBatchRepeatedKey sends a BATCH naming a key twice, which the wire
+// format allows and a map can't hold: the last value wins.
+func TestBatchRepeatedKey(t *testing.T) {
+	s := startTestServer(t, Options{})
+	c := dialTestServer(t, s)
+	if _, err := c.do(t, "BATCH k:first,j:1,k:last 0"); err != nil {
+		t.Fatalf("BATCH: %v", err)
+	}
+	if got, err := c.do(t, "GET k"); err != nil || string(got) != "last" {
+		t.Fatalf("GET k = %q, %v; want %q", got, err, "last")
+	}
+	if n := dbSize(t, c); n != 2 {
+		t.Fatalf("DBSIZE = %d, want 2", n)
+	}
+}
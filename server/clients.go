@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"distributedCache/protocol"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// client is the server's state for one accepted connection. It wraps the
+// net.Conn so that everything written to it is counted, and it is the key
+// used for the connection in the follower and subscription maps.
+type client struct {
+	net.Conn
+	id          uint64
+	connectedAt time.Time
+
+	// ctx is cancelled when the connection closes, abandoning any of its
+	// commands still in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	commands atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	lastCmd  atomic.Value // protocol.Command
+
+	framed atomic.Bool  // responses are framed; see HELLO
+	ns     atomic.Value // string; the namespace chosen with SELECT, "" for the default
+
+	limiter   tokenBucket
+	throttled atomic.Uint64
+
+	tx *transaction // nil unless inside MULTI; see inTransaction
+}
+
+func (c *client) namespace() string {
+	ns, _ := c.ns.Load().(string)
+	return ns
+}
+
+func (c *client) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+// reply writes a complete response, in the connection's framing, for work
+// done outside handleCommand.
+func (c *client) reply(payload []byte, err error) {
+	switch {
+	case c.framed.Load():
+		c.Write(protocol.EncodeFrame(payload, err))
+	case err != nil:
+		c.Write([]byte("ERROR: " + err.Error()))
+	default:
+		c.Write(payload)
+	}
+}
+
+// rawResponse counts what a command writes on an unframed connection, so
+// handleCommand can tell if it wrote nothing.
+type rawResponse struct {
+	*client
+	n int
+}
+
+func (r *rawResponse) Write(p []byte) (int, error) {
+	n, err := r.client.Write(p)
+	r.n += n
+	return n, err
+}
+
+// response collects what a command writes, so handleCommand can send it as
+// one frame.
+type response struct {
+	*client
+	buf bytes.Buffer
+}
+
+func (r *response) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+// handleHello switches the connection between raw and framed responses.
+func (s *Server) handleHello(conn *client, w net.Conn, msg *protocol.Message) error {
+	conn.framed.Store(msg.Version == protocol.ProtoFramed)
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+type clientStatus struct {
+	ID          uint64    `json:"id"`
+	Addr        string    `json:"addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Commands    uint64    `json:"commands"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	LastCommand string    `json:"last_command,omitempty"`
+	Throttled   uint64    `json:"throttled,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Follower    bool      `json:"follower,omitempty"`
+}
+
+func (s *Server) addClient(conn net.Conn) *client {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c := &client{
+		Conn:        conn,
+		id:          s.accepted.Add(1),
+		connectedAt: time.Now(),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	s.connsMu.Lock()
+	s.conns[c] = struct{}{}
+	s.connsMu.Unlock()
+	return c
+}
+
+func (s *Server) removeClient(c *client) {
+	c.cancel()
+	s.connsMu.Lock()
+	delete(s.conns, c)
+	s.connsMu.Unlock()
+	s.closedBytesIn.Add(c.bytesIn.Load())
+	s.closedBytesOut.Add(c.bytesOut.Load())
+}
+
+// connectedClients counts open connections, excluding followers' replication
+// links.
+func (s *Server) connectedClients() int {
+	s.connsMu.RLock()
+	n := len(s.conns)
+	s.connsMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n - len(s.followers)
+}
+
+func (s *Server) handleClients(conn net.Conn, msg *protocol.Message) error {
+	s.mu.Lock()
+	followers := make(map[net.Conn]bool, len(s.followers))
+	for fc := range s.followers {
+		followers[fc] = true
+	}
+	s.mu.Unlock()
+
+	s.connsMu.RLock()
+	clients := make([]clientStatus, 0, len(s.conns))
+	for c := range s.conns {
+		st := clientStatus{
+			ID:          c.id,
+			Addr:        c.RemoteAddr().String(),
+			ConnectedAt: c.connectedAt,
+			Commands:    c.commands.Load(),
+			BytesIn:     c.bytesIn.Load(),
+			BytesOut:    c.bytesOut.Load(),
+			Throttled:   c.throttled.Load(),
+			Follower:    followers[c],
+			Namespace:   c.namespace(),
+		}
+		if cmd, ok := c.lastCmd.Load().(protocol.Command); ok {
+			st.LastCommand = string(cmd)
+		}
+		clients = append(clients, st)
+	}
+	s.connsMu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	data, err := json.Marshal(clients)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
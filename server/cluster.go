@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	cacheclient "distributedCache/client"
+	"distributedCache/protocol"
+	"distributedCache/ring"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In cluster mode, keys are sharded across the nodes in Options.ClusterPeers
+// by consistent hashing, rather than every node holding every key. A command
+// for keys another node owns is proxied to it, or with ClusterRedirect,
+// answered with MOVED and the owner's address so the client can resend it
+// there. Commands without keys, such as KEYS and DBSIZE, only cover the node
+// they are sent to, and so does the HTTP gateway.
+//
+// The ring only changes with ADDNODE and REMOVENODE, which must be sent to
+// every node. Keys aren't moved when it changes: those a node no longer owns
+// stay where they are, unreachable through the cluster, until they expire
+// or are written again through their new owner.
+
+const clusterDialTimeout = 2 * time.Second
+
+type cluster struct {
+	ring     *ring.Ring
+	self     string
+	redirect bool
+
+	mu    sync.Mutex
+	peers map[peerKey]*cacheclient.Client
+}
+
+// peerKey picks the connections to a peer for one namespace, since they
+// are scoped with SELECT when they are opened.
+type peerKey struct {
+	addr string
+	ns   string
+}
+
+func newCluster(opts Options) *cluster {
+	if len(opts.ClusterPeers) == 0 {
+		return nil
+	}
+	r := ring.New(opts.ClusterVNodes, opts.ClusterPeers...)
+	r.Add(opts.AdvertiseAddr)
+	return &cluster{
+		ring:     r,
+		self:     opts.AdvertiseAddr,
+		redirect: opts.ClusterRedirect,
+		peers:    make(map[peerKey]*cacheclient.Client),
+	}
+}
+
+// messageKeys returns the keys msg names, as the client sent them.
+func messageKeys(msg *protocol.Message) [][]byte {
+	var keys [][]byte
+	if msg.Key != nil {
+		keys = append(keys, msg.Key)
+	}
+	if msg.NewKey != nil {
+		keys = append(keys, msg.NewKey)
+	}
+	keys = append(keys, msg.Keys...)
+	for k := range msg.Pairs {
+		keys = append(keys, []byte(k))
+	}
+	return keys
+}
+
+// owner returns the node that owns every key msg names, or "" if it names
+// none. Keys owned by different nodes can't be served by one command.
+func (c *cluster) owner(msg *protocol.Message) (string, error) {
+	owner := ""
+	for _, key := range messageKeys(msg) {
+		switch o := c.ring.Owner(key); {
+		case owner == "":
+			owner = o
+		case o != owner:
+			return "", fmt.Errorf("the keys of this %s belong to different nodes; send one command per node", msg.Cmd)
+		}
+	}
+	return owner, nil
+}
+
+func movedError(addr string) error {
+	return errors.New(protocol.MovedPrefix + addr)
+}
+
+// checkOwner returns MOVED if msg's keys belong to another node, for
+// commands that must run here or not at all, such as those queued in a
+// transaction.
+func (s *Server) checkOwner(msg *protocol.Message) error {
+	if s.cluster == nil {
+		return nil
+	}
+	owner, err := s.cluster.owner(msg)
+	if err != nil || owner == "" || owner == s.cluster.self {
+		return err
+	}
+	return movedError(owner)
+}
+
+// route sends msg on to the node that owns its keys, writing the owner's
+// reply to w, or returns MOVED, and reports whether it did either. Commands
+// for this node's own keys, or with no keys, are left to runCommand.
+func (s *Server) route(ctx context.Context, conn *client, w net.Conn, msg *protocol.Message) (bool, error) {
+	if s.cluster == nil {
+		return false, nil
+	}
+	owner, err := s.cluster.owner(msg)
+	if err != nil {
+		return true, err
+	}
+	if owner == "" || owner == s.cluster.self {
+		return false, nil
+	}
+	if msg.Forwarded || s.cluster.redirect {
+		return true, movedError(owner)
+	}
+	payload, err := s.cluster.forward(ctx, owner, conn.namespace(), msg)
+	if err != nil {
+		return true, err
+	}
+	_, err = w.Write(payload)
+	return true, err
+}
+
+// forward runs msg on the node at addr, in namespace ns.
+func (c *cluster) forward(ctx context.Context, addr, ns string, msg *protocol.Message) ([]byte, error) {
+	peer, err := c.peer(addr, ns)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach %s, which owns this key: %w", addr, err)
+	}
+	fwd := *msg
+	fwd.Forwarded = true
+	payload, err := peer.Do(ctx, &fwd)
+	var respErr *protocol.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		return nil, fmt.Errorf("forwarding to %s: %w", addr, err)
+	}
+	return payload, err
+}
+
+// peer returns the pool of connections to addr for namespace ns, connecting
+// the first time it is needed.
+func (c *cluster) peer(addr, ns string) (*cacheclient.Client, error) {
+	key := peerKey{addr, ns}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.peers[key]; ok {
+		return p, nil
+	}
+	opts := []cacheclient.Option{cacheclient.WithDialTimeout(clusterDialTimeout)}
+	if ns != "" {
+		opts = append(opts, cacheclient.WithNamespace(ns))
+	}
+	p, err := cacheclient.New(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.peers[key] = p
+	return p, nil
+}
+
+// dropPeer closes every connection to addr.
+func (c *cluster) dropPeer(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, p := range c.peers {
+		if key.addr == addr {
+			p.Close()
+			delete(c.peers, key)
+		}
+	}
+}
+
+func (c *cluster) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, p := range c.peers {
+		p.Close()
+		delete(c.peers, key)
+	}
+}
+
+// handleAddNode and handleRemoveNode change this node's view of the ring.
+func (s *Server) handleAddNode(conn net.Conn, msg *protocol.Message) error {
+	if s.cluster == nil {
+		return errNotClustered
+	}
+	if !s.cluster.ring.Add(msg.Addr) {
+		return fmt.Errorf("%s is already in the cluster", msg.Addr)
+	}
+	s.logger.Info("node added to cluster", "node", msg.Addr, "nodes", s.cluster.ring.Nodes())
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
+
+func (s *Server) handleRemoveNode(conn net.Conn, msg *protocol.Message) error {
+	if s.cluster == nil {
+		return errNotClustered
+	}
+	if msg.Addr == s.cluster.self {
+		return errors.New("a node can't remove itself from the cluster; send REMOVENODE to the others")
+	}
+	if !s.cluster.ring.Remove(msg.Addr) {
+		return fmt.Errorf("%s is not in the cluster", msg.Addr)
+	}
+	s.cluster.dropPeer(msg.Addr)
+	s.logger.Info("node removed from cluster", "node", msg.Addr, "nodes", s.cluster.ring.Nodes())
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
+
+var errNotClustered = errors.New("this server isn't in cluster mode (start it with -clusterpeers)")
+
+// clusterNodes lists the nodes on the ring for CONFIG GET clusterpeers.
+func (s *Server) clusterNodes() string {
+	if s.cluster == nil {
+		return ""
+	}
+	return strings.Join(s.cluster.ring.Nodes(), ",")
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is one of the settings CONFIG GET reports, named after the flag
+// that sets it at startup. prepare checks a new value and returns what
+// applies it, which can't fail; settings without it can only be changed by
+// restarting with a different flag.
+type setting struct {
+	get     func(s *Server) string
+	prepare func(s *Server, value string) (func(), error)
+}
+
+var settings = map[string]setting{
+	"ratelimit": {
+		get: func(s *Server) string { return formatFloat(s.limits.Load().perConn) },
+		prepare: func(s *Server, v string) (func(), error) {
+			rate, err := parseRate(v)
+			return s.setLimits(err, func(lim *rateLimits) { lim.perConn = rate })
+		},
+	},
+	"globalratelimit": {
+		get: func(s *Server) string { return formatFloat(s.limits.Load().global) },
+		prepare: func(s *Server, v string) (func(), error) {
+			rate, err := parseRate(v)
+			return s.setLimits(err, func(lim *rateLimits) { lim.global = rate })
+		},
+	},
+	"rateburst": {
+		get: func(s *Server) string { return strconv.Itoa(s.limits.Load().burst) },
+		prepare: func(s *Server, v string) (func(), error) {
+			burst, err := strconv.Atoi(v)
+			if err == nil && burst < 1 {
+				err = errors.New("want a positive number of commands")
+			}
+			return s.setLimits(err, func(lim *rateLimits) { lim.burst = burst })
+		},
+	},
+	"ratelimitwait": {
+		get: func(s *Server) string { return s.limits.Load().wait.String() },
+		prepare: func(s *Server, v string) (func(), error) {
+			wait, err := parseDuration(v)
+			return s.setLimits(err, func(lim *rateLimits) { lim.wait = wait })
+		},
+	},
+	"saveinterval": {
+		get: func(s *Server) string { return time.Duration(s.saveInterval.Load()).String() },
+		prepare: func(s *Server, v string) (func(), error) {
+			d, err := parseDuration(v)
+			if err == nil && d == 0 {
+				err = errors.New("want a positive duration")
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.saveInterval.Store(int64(d)) }, nil
+		},
+	},
+	"maxfollowers": {
+		get: func(s *Server) string { return strconv.FormatInt(s.maxFollowers.Load(), 10) },
+		prepare: func(s *Server, v string) (func(), error) {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err == nil && n < 0 {
+				err = errors.New("want a number of followers, or 0 for no limit")
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Followers already attached beyond a lowered limit stay.
+			return func() { s.maxFollowers.Store(n) }, nil
+		},
+	},
+	"maxbytes": {
+		get: func(s *Server) string { return strconv.FormatInt(s.cache.MaxBytes(), 10) },
+		prepare: func(s *Server, v string) (func(), error) {
+			n, err := parseSize(v)
+			if err != nil {
+				return nil, err
+			}
+			if !s.memoryLimited {
+				return nil, errors.New("the cache was started without a memory limit, so one can't be set at runtime")
+			}
+			return func() { s.cache.SetMaxBytes(n) }, nil
+		},
+	},
+	"loglevel": {
+		get: func(s *Server) string {
+			if s.opts.LogLevel == nil {
+				return "unknown"
+			}
+			return strings.ToLower(s.opts.LogLevel.Level().String())
+		},
+		prepare: func(s *Server, v string) (func(), error) {
+			if s.opts.LogLevel == nil {
+				return nil, errors.New("this server's logger has a fixed level")
+			}
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(v)); err != nil {
+				return nil, errors.New("want debug, info, warn or error")
+			}
+			return func() { s.opts.LogLevel.Set(level) }, nil
+		},
+	},
+
+	"listenaddr":        {get: func(s *Server) string { return s.opts.ListenAddr }},
+	"advertiseaddr":     {get: func(s *Server) string { return s.opts.AdvertiseAddr }},
+	"httpaddr":          {get: func(s *Server) string { return s.opts.HTTPAddr }},
+	"leaderaddr":        {get: func(s *Server) string { return s.opts.LeaderAddr }},
+	"storage":           {get: func(s *Server) string { return s.opts.StoragePath }},
+	"writeconcern":      {get: func(s *Server) string { return s.opts.WriteConcern.String() }},
+	"acktimeout":        {get: func(s *Server) string { return s.opts.AckTimeout.String() }},
+	"minreplicasmaxlag": {get: func(s *Server) string { return s.opts.MinReplicasMaxLag.String() }},
+	"heartbeat":         {get: func(s *Server) string { return s.opts.HeartbeatInterval.String() }},
+	"maxcommandbytes":   {get: func(s *Server) string { return strconv.Itoa(max(s.opts.MaxCommandBytes, 0)) }},
+	"maxbatchpairs":     {get: func(s *Server) string { return strconv.Itoa(max(s.opts.MaxBatchPairs, 0)) }},
+	"commandtimeout":    {get: func(s *Server) string { return s.opts.CommandTimeout.String() }},
+	"clusterpeers":      {get: (*Server).clusterNodes},
+	"clusterredirect":   {get: func(s *Server) string { return strconv.FormatBool(s.opts.ClusterRedirect) }},
+}
+
+// Reloadable reports whether the setting with the given flag name can be
+// changed while the server runs, by CONFIG SET or Reconfigure.
+func Reloadable(name string) bool {
+	return settings[name].prepare != nil
+}
+
+// Reconfigure changes the settings in values, keyed by flag name, all or
+// none: every value is checked before any is applied. It returns the names
+// of the settings whose value changed.
+func (s *Server) Reconfigure(values map[string]string) ([]string, error) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	var applies []func()
+	for name, value := range values {
+		if !Reloadable(name) {
+			return nil, fmt.Errorf("%s can't be changed at runtime", name)
+		}
+		apply, err := settings[name].prepare(s, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		applies = append(applies, apply)
+	}
+	before := make(map[string]string, len(values))
+	for name := range values {
+		before[name] = settings[name].get(s)
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	var changed []string
+	for name := range values {
+		if settings[name].get(s) != before[name] {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// setLimits returns what applies change to a copy of the rate limits in
+// force and puts the copy in their place, unless parsing the new value
+// failed with err. Callers apply it holding s.configMu.
+func (s *Server) setLimits(err error, change func(*rateLimits)) (func(), error) {
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		lim := *s.limits.Load()
+		change(&lim)
+		s.limits.Store(&lim)
+	}, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseRate(v string) (float64, error) {
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 {
+		return 0, errors.New("want a number of commands a second, 0 for no limit")
+	}
+	return rate, nil
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("want a duration such as 500ms or 5m")
+	}
+	return d, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"t", 1 << 40}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1},
+}
+
+// parseSize parses a byte count such as "512mb" or "2g", in powers of 1024,
+// or a plain number of bytes.
+func parseSize(v string) (int64, error) {
+	lower := strings.ToLower(v)
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, unit = strings.TrimSuffix(lower, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/unit {
+		return 0, errors.New("want a number of bytes such as 1048576 or 512mb")
+	}
+	return n * unit, nil
+}
+
+// handleConfig reads settings with CONFIG GET, as a JSON object of the
+// settings matching the pattern, or changes one with CONFIG SET. Settings
+// belong to this node alone and aren't replicated.
+func (s *Server) handleConfig(conn net.Conn, msg *protocol.Message) error {
+	if msg.Value == nil {
+		return s.handleConfigGet(conn, msg.Param)
+	}
+	if _, ok := settings[msg.Param]; !ok {
+		return fmt.Errorf("unknown setting %q", msg.Param)
+	}
+	if !Reloadable(msg.Param) {
+		return fmt.Errorf("%s can't be changed at runtime; restart the server with -%s instead", msg.Param, msg.Param)
+	}
+	value := string(msg.Value)
+	if _, err := s.Reconfigure(map[string]string{msg.Param: value}); err != nil {
+		return err
+	}
+	s.logger.Info("setting changed", "param", msg.Param, "value", value)
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
+
+func (s *Server) handleConfigGet(conn net.Conn, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	values := make(map[string]string)
+	for name, st := range settings {
+		if ok, _ := path.Match(pattern, name); ok {
+			values[name] = st.get(s)
+		}
+	}
+	if len(values) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return fmt.Errorf("unknown setting %q", pattern)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
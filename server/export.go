@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// handleExport streams the whole cache as newline-delimited JSON, ending with
+// a StreamEnd line.
+func (s *Server) handleExport(conn net.Conn) error {
+	if err := s.cache.ExportJSON(conn); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte(protocol.StreamEnd + "\n"))
+	return err
+}
+
+// isImport reports whether line is a bare RESTORE, which is followed on the
+// same connection by the entries to import.
+func isImport(line []byte) bool {
+	return string(bytes.TrimSpace(line)) == string(protocol.CMDRestore)
+}
+
+// handleImport reads entries in the ExportJSON format up to a StreamEnd line
+// and applies each as a RESTORE, so followers and subscribers see them like
+// any other write. It runs on the connection's read loop, since the entries
+// must be consumed in order. The reply is the number of keys set, or the
+// first error; later entries are still read, but not applied.
+func (s *Server) handleImport(conn *client, r *bufio.Reader) {
+	conn.commands.Add(1)
+	conn.lastCmd.Store(protocol.CMDRestore)
+	start := time.Now()
+
+	n, err := s.importEntries(conn, r)
+	if err == nil && n > 0 {
+		ctx, cancel := s.commandContext(conn.ctx)
+		err = s.awaitWriteConcern(ctx)
+		cancel()
+		err = s.timeoutError(protocol.CMDRestore, err)
+	}
+	s.stats.record(protocol.CMDRestore, time.Since(start), err)
+	conn.reply([]byte(strconv.Itoa(n)), err)
+}
+
+func (s *Server) importEntries(conn *client, r *bufio.Reader) (int, error) {
+	var (
+		n        int
+		firstErr error
+	)
+	for i := 1; ; i++ {
+		line, size, err := protocol.ReadCommand(r, s.opts.MaxCommandBytes)
+		conn.bytesIn.Add(uint64(size))
+		if errors.Is(err, protocol.ErrCommandTooLong) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("entry %d: %w", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("import cut short: %w", err)
+		}
+		line = bytes.TrimSpace(line)
+		if string(line) == protocol.StreamEnd {
+			return n, firstErr
+		}
+		if firstErr != nil || len(line) == 0 {
+			continue
+		}
+
+		var e cache.JSONEntry
+		err = json.Unmarshal(line, &e)
+		if err == nil {
+			err = e.Validate()
+		}
+		if err == nil {
+			err = s.importEntry(e)
+		}
+		if err != nil {
+			firstErr = fmt.Errorf("entry %d: %w", i, err)
+			continue
+		}
+		n++
+	}
+}
+
+func (s *Server) importEntry(e cache.JSONEntry) error {
+	key := []byte(e.Key)
+	if err := s.cache.Restore(key, cache.EncodeDump(e.Value, e.TTL()), true); err != nil {
+		return err
+	}
+	s.publish(protocol.EventSet, key)
+	if s.isLeader() {
+		s.replicateKeys(key)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"distributedCache/protocol"
+	"errors"
+	"net"
+	"sort"
+)
+
+// advertisedAddr fills in the host of a follower's advertised address from
+// the connection when it only gave a port (e.g. ":4000").
+func advertisedAddr(conn net.Conn, addr string) string {
+	if addr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	remote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(remote, port)
+}
+
+// broadcastPeers tells every follower who else is replicating, in election
+// order: highest priority first, earliest join breaking ties.
+func (s *Server) broadcastPeers() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.followers))
+	for conn, f := range s.followers {
+		if f.addr != "" {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		a, b := s.followers[conns[i]], s.followers[conns[j]]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.joined.Before(b.joined)
+	})
+	peers := make([]protocol.Peer, len(conns))
+	for i, conn := range conns {
+		f := s.followers[conn]
+		peers[i] = protocol.Peer{Addr: f.addr, Priority: f.priority}
+	}
+	// Like pings, the list queues behind the follower's sync. A follower
+	// with no room for it is too far behind to be elected anyway.
+	for _, conn := range conns {
+		f := s.followers[conn]
+		msg := &protocol.Message{Cmd: protocol.CMDPeers, Addr: f.addr, Peers: peers}
+		if !f.enqueue(append(msg.ToBytes(), '\n')) {
+			s.logger.Warn("failed to send peers, follower's queue is full", "follower", conn.RemoteAddr())
+		}
+	}
+	s.mu.Unlock()
+}
+
+// elect picks a replacement for a leader that can no longer be reached, using
+// the peer list the leader last advertised. Every follower holds the same
+// ordered list, so they all settle on the same candidate: the winner promotes
+// itself and the rest re-point to it. It reports whether a candidate was found.
+func (s *Server) elect(dead string) bool {
+	s.mu.Lock()
+	var next *protocol.Peer
+	peers := s.leader.peers[:0]
+	for _, p := range s.leader.peers {
+		if p.Addr == dead {
+			continue
+		}
+		peers = append(peers, p)
+		if next == nil && p.Priority > 0 {
+			next = &p
+		}
+	}
+	s.leader.peers = peers
+	if next == nil {
+		s.mu.Unlock()
+		return false
+	}
+	self := next.Addr == s.leader.self
+	if !self {
+		s.leader.addr = next.Addr
+		s.leader.attempts = 0
+	}
+	s.mu.Unlock()
+
+	if self {
+		s.logger.Warn("leader unreachable, promoting self", "leader", dead)
+		return s.promote() == nil
+	}
+	s.logger.Warn("leader unreachable, following new leader", "leader", dead, "next", next.Addr)
+	return true
+}
+
+// promote turns a follower into the leader without restarting: the link to
+// the old leader is closed, and the server starts accepting joins, pinging
+// followers and replicating its writes.
+func (s *Server) promote() error {
+	s.mu.Lock()
+	if s.leading {
+		s.mu.Unlock()
+		return errors.New("already the leader")
+	}
+	s.leading = true
+	// Carry on from the old leader's offset, so that it keeps counting up
+	// across a failover.
+	s.replOffset = s.leader.appliedSeq
+	conn := s.leader.conn
+	s.leader = leaderLink{}
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	go s.heartbeatFollowers()
+	s.logger.Info("promoted to leader")
+	return nil
+}
+
+func (s *Server) handlePromote(conn net.Conn, msg *protocol.Message) error {
+	if err := s.promote(); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
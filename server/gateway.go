@@ -0,0 +1,171 @@
+package server
+
+import (
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The HTTP gateway lets tools that can't speak the TCP protocol read and
+// write keys in the default namespace. Writes go through the same path as
+// SET and DEL, so they are published, replicated and held to the write
+// concern in the same way.
+func (s *Server) routeGateway(mux *http.ServeMux) {
+	mux.HandleFunc("GET /keys", s.handleHTTPKeys)
+	mux.HandleFunc("GET /keys/{key...}", s.handleHTTPGet)
+	mux.HandleFunc("PUT /keys/{key...}", s.handleHTTPPut)
+	mux.HandleFunc("DELETE /keys/{key...}", s.handleHTTPDelete)
+	mux.HandleFunc("GET /metrics-json", s.handleHTTPMetrics)
+}
+
+// gatewayKey returns the key named in r's path, or an error if it is one the
+// TCP protocol, and so replication, couldn't carry.
+func gatewayKey(r *http.Request) ([]byte, error) {
+	key := r.PathValue("key")
+	switch {
+	case key == "":
+		return nil, errors.New("missing key")
+	case key[0] == nsSep:
+		return nil, errReservedKey
+	case strings.ContainsFunc(key, unicode.IsSpace):
+		return nil, errors.New("keys may not contain whitespace")
+	}
+	return []byte(key), nil
+}
+
+// httpError replies with err's message and the status that best fits it.
+func httpError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, cache.ErrKeyNotFound), errors.Is(err, cache.ErrKeyExpired), errors.Is(err, cache.ErrKnownAbsent):
+		status = http.StatusNotFound
+	case errors.Is(err, cache.ErrKeyTooLarge), errors.Is(err, cache.ErrValueTooLarge),
+		errors.Is(err, cache.ErrEntryTooLarge), errors.As(err, &tooBig):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errTimedOut):
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// missError names key in a miss the cache reported with a bare sentinel, so
+// the reply says which key is missing.
+func missError(key []byte, err error) error {
+	if err == cache.ErrKeyNotFound || err == cache.ErrKeyExpired || err == cache.ErrKnownAbsent {
+		return &cache.KeyError{Key: string(key), Err: err}
+	}
+	return err
+}
+
+// handleHTTPGet serves a key's value as it was stored, so it is always sent
+// as application/octet-stream.
+func (s *Server) handleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	key, err := gatewayKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+	val, err := s.cache.GetCtx(ctx, key)
+	if err != nil {
+		httpError(w, s.timeoutError(protocol.CMDGet, missError(key, err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(val)
+}
+
+// handleHTTPPut stores the request body as a key's value, expiring after the
+// optional ttl query parameter, such as ?ttl=30s.
+func (s *Server) handleHTTPPut(w http.ResponseWriter, r *http.Request) {
+	key, err := gatewayKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		if ttl, err = time.ParseDuration(t); err != nil || ttl < 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q: want a duration such as 30s", t), http.StatusBadRequest)
+			return
+		}
+	}
+	body := r.Body
+	if s.opts.MaxCommandBytes > 0 {
+		body = http.MaxBytesReader(w, body, int64(s.opts.MaxCommandBytes))
+	}
+	value, err := io.ReadAll(body)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := s.checkReplicaLag(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+	if err := s.set(ctx, key, value, ttl); err != nil {
+		httpError(w, s.timeoutError(protocol.CMDSet, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHTTPDelete replies 204 if the key was removed and 404 if there was
+// nothing to remove.
+func (s *Server) handleHTTPDelete(w http.ResponseWriter, r *http.Request) {
+	key, err := gatewayKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkReplicaLag(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := s.commandContext(r.Context())
+	defer cancel()
+	existed, err := s.del(ctx, key)
+	if err != nil {
+		httpError(w, s.timeoutError(protocol.CMDDel, err))
+		return
+	}
+	if !existed {
+		httpError(w, &cache.KeyError{Key: string(key), Err: cache.ErrKeyNotFound})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHTTPKeys lists the default namespace's keys as a sorted JSON array,
+// only those starting with the prefix query parameter if there is one. Like
+// KEYS, it lists the whole cache to do so.
+func (s *Server) handleHTTPKeys(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for _, k := range keysIn("", s.cache.Keys()) {
+		if strings.HasPrefix(string(k), prefix) {
+			keys = append(keys, string(k))
+		}
+	}
+	slices.Sort(keys)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleHTTPMetrics serves the same JSON as METRICS.
+func (s *Server) handleHTTPMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.metrics())
+}
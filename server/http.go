@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const healthTimeout = time.Second
+
+func (s *Server) serveHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handlePrometheus)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	s.routeGateway(mux)
+
+	s.logger.Info("HTTP listener started", "addr", s.opts.HTTPAddr)
+	if err := http.ListenAndServe(s.opts.HTTPAddr, mux); err != nil {
+		s.logger.Error("HTTP listener stopped", "err", err)
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// handlePrometheus serves metrics in the Prometheus text exposition format.
+func (s *Server) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	m := s.cache.Metrics()
+
+	s.mu.Lock()
+	leader := 0
+	if s.leading {
+		leader = 1
+	}
+	followers := len(s.followers)
+	depths := make(map[string]int, followers)
+	for conn, f := range s.followers {
+		depths[conn.RemoteAddr().String()] = len(f.queue)
+	}
+	s.mu.Unlock()
+	repl := s.replicationMetrics()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "distcache_hits_total", "counter", "Cache lookups that found a live key.", m.Hits)
+	writeMetric(w, "distcache_misses_total", "counter", "Cache lookups that found nothing.", m.Misses)
+	writeMetric(w, "distcache_negative_hits_total", "counter", "Cache lookups of keys marked as known to be absent.", m.NegativeHits)
+	writeMetric(w, "distcache_miss_filter_hits_total", "counter", "Cache lookups the key filter ruled out.", m.MissFilterHits)
+	writeMetric(w, "distcache_sets_total", "counter", "Keys written.", m.Sets)
+	writeMetric(w, "distcache_deletes_total", "counter", "Keys removed by DEL or expiry.", m.Deletes)
+	writeMetric(w, "distcache_delete_misses_total", "counter", "Deletes of keys that didn't exist.", m.DeleteMisses)
+	writeMetric(w, "distcache_expired_keys_total", "counter", "Keys removed because their TTL ran out.", m.ExpiredKeys)
+	writeMetric(w, "distcache_evicted_keys_total", "counter", "Keys evicted to stay within memory limits.", m.EvictedKeys)
+	writeMetric(w, "distcache_checksum_failures_total", "counter", "Reads refused because the value didn't match its checksum.", m.ChecksumFailures)
+	writeMetric(w, "distcache_rejected_sets_total", "counter", "Writes rejected for a key, value or entry over its size limit.", m.RejectedSets)
+	writeMetric(w, "distcache_keys", "gauge", "Keys currently stored.", m.KeyCount)
+	writeMetric(w, "distcache_memory_bytes", "gauge", "Approximate bytes held by keys and values.", m.ApproxMemoryBytes)
+	writeMetric(w, "distcache_compression_saved_bytes", "gauge", "Bytes saved by storing large values compressed.", m.CompressionSaved)
+	writeMetric(w, "distcache_connected_clients", "gauge", "Open client connections, excluding replication links.", s.connectedClients())
+	writeMetric(w, "distcache_connections_accepted_total", "counter", "Connections accepted since startup.", s.accepted.Load())
+	writeMetric(w, "distcache_throttled_commands_total", "counter", "Commands refused by a rate limit.", s.throttled.Load())
+	writeMetric(w, "distcache_delayed_commands_total", "counter", "Commands held back by a rate limit, then run.", s.delayed.Load())
+	writeMetric(w, "distcache_uptime_seconds", "gauge", "Seconds since the server started.", int64(time.Since(s.started).Seconds()))
+	writeMetric(w, "distcache_is_leader", "gauge", "Whether this node is currently the leader.", leader)
+	writeMetric(w, "distcache_followers", "gauge", "Followers attached to this leader.", followers)
+
+	s.writeCommandMetrics(w)
+
+	fmt.Fprintf(w, "# HELP distcache_replication_queue_depth Operations waiting to be sent to a follower.\n")
+	fmt.Fprintf(w, "# TYPE distcache_replication_queue_depth gauge\n")
+	for addr, depth := range depths {
+		fmt.Fprintf(w, "distcache_replication_queue_depth{follower=%q} %d\n", addr, depth)
+	}
+	writeReplicationLag(w, repl)
+}
+
+// writeReplicationLag writes the replication offsets, and on a leader how
+// far behind each follower is. distcache_replication_max_lag_seconds is the
+// one to alert on: it climbs steadily once any follower stops applying
+// writes, whichever it is, and stays at 0 while they all keep up.
+func writeReplicationLag(w io.Writer, repl replicationMetrics) {
+	if repl.Leader != nil {
+		writeMetric(w, "distcache_replication_applied_offset", "gauge", "Sequence number of the last replicated operation this follower applied.", repl.Leader.AppliedOffset)
+		return
+	}
+	writeMetric(w, "distcache_replication_offset", "gauge", "Sequence number of the last operation this leader replicated.", repl.Offset)
+	var maxLag float64
+	for _, f := range repl.FollowerLag {
+		maxLag = max(maxLag, f.LagSeconds)
+	}
+	writeMetric(w, "distcache_replication_max_lag_seconds", "gauge", "The largest distcache_replication_lag_seconds of any follower.", maxLag)
+
+	fmt.Fprintf(w, "# HELP distcache_replication_acked_offset Sequence number of the last operation a follower acknowledged applying.\n")
+	fmt.Fprintf(w, "# TYPE distcache_replication_acked_offset gauge\n")
+	for _, f := range repl.FollowerLag {
+		fmt.Fprintf(w, "distcache_replication_acked_offset{follower=%q} %d\n", f.Addr, f.AckedOffset)
+	}
+	fmt.Fprintf(w, "# HELP distcache_replication_lag_ops Operations sent to a follower that it hasn't acknowledged applying.\n")
+	fmt.Fprintf(w, "# TYPE distcache_replication_lag_ops gauge\n")
+	for _, f := range repl.FollowerLag {
+		fmt.Fprintf(w, "distcache_replication_lag_ops{follower=%q} %d\n", f.Addr, f.LagOps)
+	}
+	fmt.Fprintf(w, "# HELP distcache_replication_lag_seconds How long a follower has had operations outstanding without acknowledging any.\n")
+	fmt.Fprintf(w, "# TYPE distcache_replication_lag_seconds gauge\n")
+	for _, f := range repl.FollowerLag {
+		fmt.Fprintf(w, "distcache_replication_lag_seconds{follower=%q} %g\n", f.Addr, f.LagSeconds)
+	}
+}
+
+// writeCommandMetrics writes the per-command counters and latency
+// histograms.
+func (s *Server) writeCommandMetrics(w io.Writer) {
+	stats := s.stats.snapshot()
+	cmds := slices.Sorted(maps.Keys(stats))
+
+	fmt.Fprintf(w, "# HELP distcache_command_errors_total Commands that returned an error.\n")
+	fmt.Fprintf(w, "# TYPE distcache_command_errors_total counter\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "distcache_command_errors_total{cmd=%q} %d\n", cmd, stats[cmd].Errors)
+	}
+
+	fmt.Fprintf(w, "# HELP distcache_command_duration_seconds Time taken to run each command.\n")
+	fmt.Fprintf(w, "# TYPE distcache_command_duration_seconds histogram\n")
+	for _, cmd := range cmds {
+		st := stats[cmd]
+		var cumulative uint64
+		for i, bound := range s.stats.bounds {
+			cumulative += st.buckets[i]
+			fmt.Fprintf(w, "distcache_command_duration_seconds_bucket{cmd=%q,le=\"%g\"} %d\n", cmd, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(w, "distcache_command_duration_seconds_bucket{cmd=%q,le=\"+Inf\"} %d\n", cmd, st.Count)
+		fmt.Fprintf(w, "distcache_command_duration_seconds_sum{cmd=%q} %g\n", cmd, float64(st.TotalLatencyMicros)/1e6)
+		fmt.Fprintf(w, "distcache_command_duration_seconds_count{cmd=%q} %d\n", cmd, st.Count)
+	}
+}
+
+// handleHealthz reports 200 as long as the cache answers within
+// healthTimeout.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	done := make(chan struct{})
+	go func() {
+		s.cache.Metrics()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		w.Write([]byte("ok\n"))
+	case <-time.After(healthTimeout):
+		http.Error(w, "cache unresponsive", http.StatusServiceUnavailable)
+	}
+}
+
+// handleReadyz reports 200 if the server is fit to take traffic, and 503 for
+// a follower that is disconnected from its leader or still syncing.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if ok, reason := s.ready(); !ok {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"distributedCache/cache"
+)
+
+func TestSizeLimitsOverTheWire(t *testing.T) {
+	const (
+		maxKey   = 64
+		maxValue = 1 << 20
+	)
+	s := startTestServer(t, Options{}, cache.WithMaxKeyBytes(maxKey), cache.WithMaxValueBytes(maxValue))
+	c := dialTestServer(t, s)
+
+	tests := []struct {
+		name       string
+		key, value int
+		wantErr    string
+	}{
+		{"key at limit", maxKey, 1, ""},
+		{"key one over", maxKey + 1, 1, "key larger than MaxKeyBytes: 65 bytes, limit is 64"},
+		// Far larger than any read buffer, so it must arrive whole.
+		{"value at limit", 1, maxValue, ""},
+		{"value one over", 1, maxValue + 1, "value larger than MaxValueBytes: 1048577 bytes, limit is 1048576"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := strings.Repeat("k", tt.key)
+			value := strings.Repeat("v", tt.value)
+			_, err := c.do(t, "SET "+key+" "+value+" 0")
+			got, getErr := c.do(t, "GET "+key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("SET: %v", err)
+				}
+				if getErr != nil || string(got) != value {
+					t.Fatalf("GET returned %d bytes, %v; want the %d stored", len(got), getErr, len(value))
+				}
+				c.do(t, "DEL "+key)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("SET replied %v, want %q", err, tt.wantErr)
+			}
+			if getErr == nil {
+				t.Fatal("the rejected value was stored")
+			}
+		})
+	}
+}
+
+func TestCommandLengthBoundary(t *testing.T) {
+	const limit = 1024
+	s := startTestServer(t, Options{MaxCommandBytes: limit})
+	c := dialTestServer(t, s)
+
+	// "SET k <value> 0\n" is 9 bytes plus the value.
+	atLimit := "SET k " + strings.Repeat("v", limit-9) + " 0"
+	if _, err := c.do(t, atLimit); err != nil {
+		t.Fatalf("command of exactly %d bytes: %v", limit, err)
+	}
+	overLimit := "SET k " + strings.Repeat("v", limit-8) + " 0"
+	if _, err := c.do(t, overLimit); err == nil || !strings.Contains(err.Error(), "command too long") {
+		t.Fatalf("command of %d bytes replied %v, want command too long", limit+1, err)
+	}
+	// The oversized command was skipped whole, so the next one is read
+	// from the right place.
+	if got, err := c.do(t, "GET k"); err != nil || len(got) != limit-9 {
+		t.Fatalf("GET after the rejected command = %d bytes, %v; want the %d first stored", len(got), err, limit-9)
+	}
+}
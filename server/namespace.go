@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"distributedCache/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Keys in a namespace other than the default are stored with the namespace's
+// name between two nsSep bytes in front of them; the default namespace's keys
+// are stored as they are, so existing data and clients that never SELECT are
+// unaffected. Clients can't send keys starting with nsSep, so the two never
+// collide. Since the namespace is part of the stored key, replication,
+// snapshots and the WAL carry it without knowing about namespaces.
+const (
+	defaultNamespace = "0"
+	nsSep            = '\x1f'
+	maxNamespaceLen  = 64
+)
+
+func validNamespace(name string) error {
+	if name == "" || len(name) > maxNamespaceLen {
+		return fmt.Errorf("namespace name must be 1 to %d characters", maxNamespaceLen)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return fmt.Errorf("invalid namespace %q: only letters, digits, '_' and '-' are allowed", name)
+		}
+	}
+	return nil
+}
+
+// namespacePrefix is what keys in ns are stored under.
+func namespacePrefix(ns string) string {
+	if ns == "" {
+		return ""
+	}
+	return string(nsSep) + ns + string(nsSep)
+}
+
+// scopeKey returns key as stored in namespace ns.
+func scopeKey(ns string, key []byte) []byte {
+	if ns == "" {
+		return key
+	}
+	return append([]byte(namespacePrefix(ns)), key...)
+}
+
+// splitKey returns the namespace a stored key is in, "" for the default, and
+// the key as clients in that namespace see it.
+func splitKey(key []byte) (string, []byte) {
+	if len(key) == 0 || key[0] != nsSep {
+		return "", key
+	}
+	end := bytes.IndexByte(key[1:], nsSep)
+	if end < 0 {
+		return "", key
+	}
+	return string(key[1 : end+1]), key[end+2:]
+}
+
+// keysIn returns the keys that are in namespace ns, as its clients see them.
+func keysIn(ns string, keys [][]byte) [][]byte {
+	out := keys[:0]
+	for _, k := range keys {
+		if kns, local := splitKey(k); kns == ns {
+			out = append(out, local)
+		}
+	}
+	return out
+}
+
+var errReservedKey = fmt.Errorf("keys may not start with byte %#x", nsSep)
+
+// scope rewrites the keys and patterns in msg into conn's namespace.
+func (s *Server) scope(conn *client, msg *protocol.Message) error {
+	ns := conn.namespace()
+	check := func(key []byte) error {
+		if len(key) > 0 && key[0] == nsSep {
+			return errReservedKey
+		}
+		return nil
+	}
+
+	if err := check(msg.Key); err != nil {
+		return err
+	}
+	if err := check(msg.NewKey); err != nil {
+		return err
+	}
+	for _, k := range msg.Keys {
+		if err := check(k); err != nil {
+			return err
+		}
+	}
+	for k := range msg.Pairs {
+		if err := check([]byte(k)); err != nil {
+			return err
+		}
+	}
+	if ns == "" {
+		return nil
+	}
+
+	if msg.Key != nil {
+		msg.Key = scopeKey(ns, msg.Key)
+	}
+	if msg.NewKey != nil {
+		msg.NewKey = scopeKey(ns, msg.NewKey)
+	}
+	for i, k := range msg.Keys {
+		msg.Keys[i] = scopeKey(ns, k)
+	}
+	if msg.Pairs != nil {
+		pairs := make(map[string][]byte, len(msg.Pairs))
+		for k, v := range msg.Pairs {
+			pairs[namespacePrefix(ns)+k] = v
+		}
+		msg.Pairs = pairs
+	}
+	switch msg.Cmd {
+	case protocol.CMDKeys, protocol.CMDSubscribe:
+		pattern := msg.Pattern
+		if pattern == "" {
+			pattern = "*"
+		}
+		msg.Pattern = namespacePrefix(ns) + pattern
+	}
+	return nil
+}
+
+// unscopeError strips ns's prefix from the keys quoted in err's message.
+func unscopeError(ns string, err error) error {
+	if err == nil || ns == "" || !strings.Contains(err.Error(), namespacePrefix(ns)) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), namespacePrefix(ns), ""))
+}
+
+// handleSelect switches the connection's namespace for the commands that
+// follow it.
+func (s *Server) handleSelect(conn *client, w net.Conn, msg *protocol.Message) error {
+	if err := validNamespace(msg.Namespace); err != nil {
+		return err
+	}
+	ns := msg.Namespace
+	if ns == defaultNamespace {
+		ns = ""
+	}
+	conn.ns.Store(ns)
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+// patternNamespace is the namespace a scoped KEYS or SUBSCRIBE pattern is
+// confined to.
+func patternNamespace(pattern string) string {
+	ns, _ := splitKey([]byte(pattern))
+	return ns
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SaveRule triggers a snapshot once at least Changes writes have been made
+// and After has passed since the last one, like Redis's "save" directive.
+type SaveRule struct {
+	Changes uint64
+	After   time.Duration
+}
+
+// ParseSaveRules parses a comma-separated list of changes/duration pairs,
+// e.g. "1000/1m,10/5m".
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []SaveRule
+	for _, part := range strings.Split(s, ",") {
+		changes, after, ok := strings.Cut(part, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid save rule %q: want changes/duration", part)
+		}
+		n, err := strconv.ParseUint(changes, 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid save rule %q: bad change count", part)
+		}
+		d, err := time.ParseDuration(after)
+		if err != nil {
+			return nil, fmt.Errorf("invalid save rule %q: %w", part, err)
+		}
+		rules = append(rules, SaveRule{Changes: n, After: d})
+	}
+	return rules, nil
+}
+
+// periodicSave snapshots the cache whenever it has unsaved writes and either
+// the save interval has passed or one of the SaveRules is met. A cache with no
+// writes since the last snapshot is never rewritten.
+func (s *Server) periodicSave() {
+	pc, ok := s.cache.(*cache.PersistentCache)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(min(s.opts.SaveInterval, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		dirty := pc.Dirty()
+		if dirty == 0 {
+			continue
+		}
+		since := time.Since(s.started)
+		if last := s.lastSave.Load(); last != 0 {
+			since = time.Since(time.Unix(0, last))
+		}
+		due := since >= time.Duration(s.saveInterval.Load())
+		for _, r := range s.opts.SaveRules {
+			if dirty >= r.Changes && since >= r.After {
+				due = true
+			}
+		}
+		if !due {
+			continue
+		}
+		if err := s.save(); err != nil {
+			s.logger.Error("failed to save cache to disk", "err", err)
+		}
+	}
+}
+
+var errSaveInProgress = errors.New("save already in progress")
+
+func (s *Server) persistentCache() (*cache.PersistentCache, error) {
+	pc, ok := s.cache.(*cache.PersistentCache)
+	if !ok {
+		return nil, errors.New("persistence is not enabled on this server (start it with -storage)")
+	}
+	return pc, nil
+}
+
+// save snapshots the cache to disk. A save that starts while another is still
+// running is refused rather than queued behind it.
+func (s *Server) save() error {
+	pc, err := s.persistentCache()
+	if err != nil {
+		return err
+	}
+	if !s.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	defer s.saving.Store(false)
+	return s.persist(pc)
+}
+
+// persist writes a snapshot and records when and how long it took. Concurrent
+// calls are serialized by the cache.
+func (s *Server) persist(pc *cache.PersistentCache) error {
+	start := time.Now()
+	if err := pc.SaveToDisk(); err != nil {
+		return err
+	}
+	took := time.Since(start)
+	s.lastSave.Store(time.Now().UnixNano())
+	s.lastSaveDuration.Store(int64(took))
+	s.logger.Info("saved cache to disk", "took", took)
+	return nil
+}
+
+// handleSave replies only once a fresh snapshot is on disk, waiting behind any
+// save already in progress rather than trusting it to include recent writes.
+func (s *Server) handleSave(conn net.Conn, msg *protocol.Message) error {
+	pc, err := s.persistentCache()
+	if err != nil {
+		return err
+	}
+	if err := s.persist(pc); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("OK"))
+	return err
+}
+
+// handleBgsave starts a save and replies straight away. A BGSAVE that arrives
+// while a background or periodic save is running joins it instead of
+// queueing another.
+func (s *Server) handleBgsave(conn net.Conn, msg *protocol.Message) error {
+	pc, err := s.persistentCache()
+	if err != nil {
+		return err
+	}
+	if !s.saving.CompareAndSwap(false, true) {
+		_, err = conn.Write([]byte("Background save already in progress"))
+		return err
+	}
+	go func() {
+		defer s.saving.Store(false)
+		if err := s.persist(pc); err != nil {
+			s.logger.Error("background save failed", "err", err)
+		}
+	}()
+	_, err = conn.Write([]byte("Background saving started"))
+	return err
+}
+
+// handleSnapshot writes a named snapshot, lists them, or restores one, and
+// replies with the number of keys written or restored, or for SNAPSHOT LIST,
+// a JSON array describing each snapshot.
+//
+// Only the leader may restore, and it replicates the restore as a RESTORE of
+// every key loaded and a DEL of every key dropped, so followers end up with
+// the same data.
+func (s *Server) handleSnapshot(conn net.Conn, msg *protocol.Message) error {
+	pc, err := s.persistentCache()
+	if err != nil {
+		return err
+	}
+	var n int
+	switch {
+	case msg.Snapshot == "":
+		infos, err := pc.Snapshots()
+		if err != nil {
+			return err
+		}
+		if infos == nil {
+			infos = []cache.SnapshotInfo{}
+		}
+		data, err := json.Marshal(infos)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data)
+		return err
+	case msg.Load:
+		if !s.isLeader() {
+			return errors.New("snapshots can only be restored on the leader; followers take their data from it")
+		}
+		start := time.Now()
+		loaded, dropped, err := pc.RestoreSnapshot(msg.Snapshot)
+		if loaded == nil && err != nil {
+			return err
+		}
+		s.logger.Info("restored snapshot", "name", msg.Snapshot, "keys", len(loaded), "dropped", len(dropped), "took", time.Since(start))
+		s.replicateDeletes(dropped...)
+		for _, key := range loaded {
+			s.publish(protocol.EventSet, key)
+		}
+		s.replicateKeys(loaded...)
+		if err != nil {
+			return err
+		}
+		n = len(loaded)
+	default:
+		if n, err = pc.SaveSnapshot(msg.Snapshot); err != nil {
+			return err
+		}
+		s.logger.Info("saved snapshot", "name", msg.Snapshot, "keys", n)
+	}
+	_, err = conn.Write([]byte(strconv.Itoa(n)))
+	return err
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Preload seeds the cache from r before Start, so a fresh node doesn't send
+// every early read through to whatever is behind it. Each line is either an
+// entry in the ExportJSON format, or a SET or BATCH command as a client would
+// send it, with the TTL in nanoseconds. Blank lines and lines starting with #
+// are skipped. A malformed line is logged and skipped, unless strict is set,
+// in which case Preload stops there and returns its error. It returns the
+// number of keys set.
+func (s *Server) Preload(r io.Reader, strict bool) (int, error) {
+	br := bufio.NewReader(r)
+	n := 0
+	for i := 1; ; i++ {
+		line, _, err := protocol.ReadCommand(br, s.opts.MaxCommandBytes)
+		// The last line needn't end with a newline.
+		eof := errors.Is(err, io.EOF)
+		if eof {
+			err = nil
+		}
+		if err != nil && !errors.Is(err, protocol.ErrCommandTooLong) {
+			return n, err
+		}
+		line = bytes.TrimSpace(line)
+		if err == nil && len(line) > 0 && line[0] != '#' {
+			var set int
+			set, err = s.preloadLine(line)
+			n += set
+		}
+		if err != nil {
+			err = fmt.Errorf("line %d: %w", i, err)
+			if strict {
+				return n, err
+			}
+			s.logger.Warn("skipped preload line", "err", err)
+		}
+		if eof {
+			return n, nil
+		}
+	}
+}
+
+// preloadLine sets the keys on one line of a preload file, returning how many
+// it set.
+func (s *Server) preloadLine(line []byte) (int, error) {
+	if line[0] == '{' {
+		var e cache.JSONEntry
+		err := json.Unmarshal(line, &e)
+		if err == nil {
+			err = e.Validate()
+		}
+		if err == nil {
+			err = s.cache.Set([]byte(e.Key), e.Value, e.TTL())
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	msg, err := protocol.ParseCommand(line)
+	if err != nil {
+		return 0, err
+	}
+	switch msg.Cmd {
+	case protocol.CMDSet:
+		if err := s.cache.Set(msg.Key, msg.Value, msg.TTL); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	case protocol.CMDBatch:
+		err := s.cache.BatchSet(msg.Pairs, msg.TTL)
+		var batchErr *cache.BatchError
+		switch {
+		case err == nil:
+			return len(msg.Pairs), nil
+		case errors.As(err, &batchErr) && batchErr.Applied:
+			return len(msg.Pairs) - len(batchErr.Rejected), err
+		}
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s can't be preloaded; want a JSON entry, SET or BATCH", msg.Cmd)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"errors"
+	"log/slog"
+	"net"
+	"path"
+)
+
+const subscriberQueueSize = 256
+
+// subscriber is a connection in subscribe mode. Everything written to it goes
+// through queue, drained by its own goroutine, so a slow reader never blocks
+// the writes that generate its events.
+type subscriber struct {
+	conn    net.Conn
+	pattern string
+	queue   chan []byte
+	logger  *slog.Logger
+}
+
+func (sub *subscriber) run() {
+	for msg := range sub.queue {
+		if _, err := sub.conn.Write(msg); err != nil {
+			sub.logger.Debug("subscriber write failed", "client", sub.conn.RemoteAddr(), "err", err)
+			sub.conn.Close()
+			return
+		}
+	}
+}
+
+// push queues a newline-terminated line without blocking and reports
+// whether there was room. Callers must hold subMu.
+func (sub *subscriber) push(line []byte) bool {
+	select {
+	case sub.queue <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushToSubscriber queues line for conn if it is in subscribe mode and
+// reports whether it was.
+func (s *Server) pushToSubscriber(conn net.Conn, line []byte) bool {
+	s.subMu.RLock()
+	defer s.subMu.RUnlock()
+	sub, ok := s.subscriptions[conn]
+	if ok {
+		sub.push(line)
+	}
+	return ok
+}
+
+func (s *Server) handleSubscribe(conn net.Conn, msg *protocol.Message) error {
+	if msg.Pattern == "" {
+		return errors.New("SUBSCRIBE requires a pattern")
+	}
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	sub, ok := s.subscriptions[conn]
+	if ok {
+		delete(s.subscribers[sub.pattern], conn)
+		if len(s.subscribers[sub.pattern]) == 0 {
+			delete(s.subscribers, sub.pattern)
+		}
+		sub.pattern = msg.Pattern
+	} else {
+		sub = &subscriber{conn: conn, pattern: msg.Pattern, queue: make(chan []byte, subscriberQueueSize), logger: s.logger}
+		s.subscriptions[conn] = sub
+		go sub.run()
+	}
+	if s.subscribers[sub.pattern] == nil {
+		s.subscribers[sub.pattern] = make(map[net.Conn]*subscriber)
+	}
+	s.subscribers[sub.pattern][conn] = sub
+
+	sub.push([]byte("OK\n"))
+	return nil
+}
+
+func (s *Server) handleUnsubscribe(conn net.Conn, msg *protocol.Message) error {
+	if !s.unsubscribe(conn, []byte("OK\n")) {
+		return errors.New("not subscribed")
+	}
+	return nil
+}
+
+// unsubscribe takes conn out of subscribe mode, flushing any queued events
+// followed by last (if non-nil). It reports whether conn was subscribed.
+func (s *Server) unsubscribe(conn net.Conn, last []byte) bool {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	sub, ok := s.subscriptions[conn]
+	if !ok {
+		return false
+	}
+	delete(s.subscriptions, conn)
+	delete(s.subscribers[sub.pattern], conn)
+	if len(s.subscribers[sub.pattern]) == 0 {
+		delete(s.subscribers, sub.pattern)
+	}
+	if last != nil {
+		sub.push(last)
+	}
+	close(sub.queue)
+	return true
+}
+
+// publish sends an event to every subscriber whose pattern matches key, in
+// the key's namespace.
+// Subscribers that have fallen a full queue behind are disconnected rather
+// than silently missing events.
+func (s *Server) publish(event string, key []byte) {
+	var overflowed []net.Conn
+
+	s.subMu.RLock()
+	if len(s.subscribers) == 0 {
+		s.subMu.RUnlock()
+		return
+	}
+	ns, local := splitKey(key)
+	line := protocol.EncodeEvent(event, local)
+	for pattern, subs := range s.subscribers {
+		if ok, _ := path.Match(pattern, string(key)); !ok || patternNamespace(pattern) != ns {
+			continue
+		}
+		for conn, sub := range subs {
+			if !sub.push(line) {
+				overflowed = append(overflowed, conn)
+			}
+		}
+	}
+	s.subMu.RUnlock()
+
+	for _, conn := range overflowed {
+		s.logger.Warn("subscriber is too slow, disconnecting", "client", conn.RemoteAddr())
+		s.unsubscribe(conn, nil)
+		conn.Close()
+	}
+}
+
+func (s *Server) publishEviction(key, value []byte, reason cache.EvictionReason) {
+	switch reason {
+	case cache.Expired:
+		s.publish(protocol.EventExpire, key)
+	case cache.Deleted:
+		s.publish(protocol.EventDel, key)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errThrottled = errors.New("rate limit exceeded, slow down")
+
+// rateLimits are the limits in force. CONFIG SET replaces them while
+// connections are open, and every connection sees the change on its next
+// command.
+type rateLimits struct {
+	perConn float64       // commands a second on each client connection; 0 for no limit
+	burst   int           // commands a connection may send at once before perConn applies
+	global  float64       // commands a second across every client connection; 0 for no limit
+	wait    time.Duration // how long a command over a limit may be held back before it is refused
+}
+
+// tokenBucket allows rate commands a second on average, and bursts of up to
+// burst at once. The rate and burst are passed in on every call so they can
+// change at runtime. A new bucket starts full.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if one is available and returns 0, or otherwise how
+// long until one will be. A burst below 1 is raised to 1.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) time.Duration {
+	capacity := float64(max(burst, 1))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// admit applies the rate limits to one of conn's commands, first its own
+// and then the global one, holding it back for up to the configured wait
+// until both allow it. It reports whether the command may run. The global
+// bucket holds a second's worth of commands.
+func (s *Server) admit(conn *client) bool {
+	lim := s.limits.Load()
+	if lim.perConn <= 0 && lim.global <= 0 {
+		return true
+	}
+	deadline := time.Now().Add(lim.wait)
+	held := false
+	for _, b := range []struct {
+		bucket *tokenBucket
+		rate   float64
+		burst  int
+	}{
+		{&conn.limiter, lim.perConn, lim.burst},
+		{&s.globalLimiter, lim.global, int(lim.global)},
+	} {
+		if b.rate <= 0 {
+			continue
+		}
+		for {
+			now := time.Now()
+			d := b.bucket.take(b.rate, b.burst, now)
+			if d == 0 {
+				break
+			}
+			if now.Add(d).After(deadline) {
+				conn.throttled.Add(1)
+				s.throttled.Add(1)
+				return false
+			}
+			held = true
+			time.Sleep(d)
+		}
+	}
+	if held {
+		s.delayed.Add(1)
+	}
+	return true
+}
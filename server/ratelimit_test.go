@@ -0,0 +1,81 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	const (
+		rate  = 10 // a token every 100ms
+		burst = 5
+	)
+	var b tokenBucket
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < burst; i++ {
+		if d := b.take(rate, burst, now); d != 0 {
+			t.Fatalf("take %d of the burst waits %v, want 0", i+1, d)
+		}
+	}
+	if d := b.take(rate, burst, now); d != 100*time.Millisecond {
+		t.Fatalf("take past the burst waits %v, want 100ms", d)
+	}
+
+	now = now.Add(50 * time.Millisecond)
+	if d := b.take(rate, burst, now); d != 50*time.Millisecond {
+		t.Fatalf("take halfway to the next token waits %v, want 50ms", d)
+	}
+	now = now.Add(50 * time.Millisecond)
+	if d := b.take(rate, burst, now); d != 0 {
+		t.Fatalf("take once a token has refilled waits %v, want 0", d)
+	}
+
+	// However long the bucket sits idle, it holds no more than burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < burst; i++ {
+		if d := b.take(rate, burst, now); d != 0 {
+			t.Fatalf("take %d after idling waits %v, want 0", i+1, d)
+		}
+	}
+	if d := b.take(rate, burst, now); d == 0 {
+		t.Fatal("bucket refilled past its burst")
+	}
+}
+
+func TestRateLimitRejectsBurst(t *testing.T) {
+	const burst = 5
+	// At this rate no token refills while the test runs, so exactly the
+	// burst gets through.
+	s := startTestServer(t, Options{RateLimit: 0.001, RateBurst: burst})
+	c := dialTestServer(t, s)
+	// HELLO took one token already.
+
+	const sent = 20
+	for i := 0; i < sent; i++ {
+		c.send(t, "PING")
+	}
+	var ok, throttled int
+	for i := 0; i < sent; i++ {
+		_, err := c.read(t)
+		switch {
+		case err == nil:
+			ok++
+		case err.Error() == errThrottled.Error():
+			throttled++
+		default:
+			t.Fatalf("PING: %v", err)
+		}
+	}
+	if ok != burst-1 || throttled != sent-ok {
+		t.Fatalf("%d PINGs ran and %d were throttled, want %d and %d", ok, throttled, burst-1, sent-burst+1)
+	}
+	if n := s.throttled.Load(); n != uint64(throttled) {
+		t.Fatalf("throttled counter = %d, want %d", n, throttled)
+	}
+
+	// The limit is per connection.
+	if _, err := dialTestServer(t, s).do(t, "PING"); err != nil {
+		t.Fatalf("PING on a new connection: %v", err)
+	}
+}
@@ -0,0 +1,648 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// follower tracks the health of a replica connected to the leader.
+type follower struct {
+	addr          string // advertised address, used for failover
+	priority      int
+	joined        time.Time
+	lastHeartbeat time.Time
+	lastAck       time.Time
+	missed        int
+	queue         chan []byte // replicated operations awaiting pumpFollower
+
+	// sent counts the operations queued for the follower, the initial sync
+	// included, and acked how many of them it has confirmed applying.
+	// ackedSeq is the sequence number of the last one, and behindSince when
+	// it last went from having nothing outstanding to having something.
+	sent        uint64
+	acked       uint64
+	ackedSeq    uint64
+	behindSince time.Time
+
+	// While the initial sync is being written, everything for the follower
+	// waits in backlog instead of queue, since the sync can take far longer
+	// than queue has room for.
+	syncing bool
+	backlog [][]byte
+}
+
+// enqueue queues raw for f without blocking, reporting false if f has
+// fallen too far behind to take it. Callers must hold s.mu.
+func (f *follower) enqueue(raw []byte) bool {
+	if f.syncing {
+		if len(f.backlog) >= maxSyncBacklog {
+			return false
+		}
+		f.backlog = append(f.backlog, raw)
+		return true
+	}
+	select {
+	case f.queue <- raw:
+		return true
+	default:
+		return false
+	}
+}
+
+// lag is how long f has had operations outstanding without acknowledging
+// any: zero if it is caught up, and otherwise the time since its last
+// acknowledgement or since it fell behind, whichever is later. A follower
+// that is slow but keeping up stays low; one that has stopped applying
+// grows steadily.
+func (f *follower) lag(now time.Time) time.Duration {
+	if f.acked >= f.sent {
+		return 0
+	}
+	since := f.behindSince
+	if f.lastAck.After(since) {
+		since = f.lastAck
+	}
+	return now.Sub(since)
+}
+
+type followerStatus struct {
+	Addr           string     `json:"addr"`
+	AdvertisedAddr string     `json:"advertised_addr"`
+	Joined         time.Time  `json:"joined"`
+	LastHeartbeat  time.Time  `json:"last_heartbeat"`
+	LastAck        *time.Time `json:"last_ack,omitempty"` // absent until the first write is acknowledged
+	MissedPongs    int        `json:"missed_pongs"`
+	QueueDepth     int        `json:"queue_depth"`
+	// LagOps is how many operations, the initial sync included, the
+	// follower has been sent but not yet acknowledged applying, and
+	// LagSeconds how long it has had some outstanding without acknowledging
+	// any (see follower.lag). AckedOffset is the sequence number of the last
+	// operation it applied; one still taking its initial sync reports the
+	// leader's offset when it joined.
+	LagOps      uint64  `json:"lag_ops"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	AckedOffset uint64  `json:"acked_offset"`
+}
+
+// leaderLink is a follower's view of its connection to the leader.
+type leaderLink struct {
+	addr        string
+	conn        net.Conn
+	connected   bool
+	synced      bool // the initial sync has been received since connecting
+	appliedSeq  uint64
+	attempts    int // failed dials since the last successful connection
+	disconnects int
+
+	// self and peers are advertised by the leader for failover.
+	self  string
+	peers []protocol.Peer
+}
+
+// In replicationMetrics, Offset is the sequence number of the last
+// operation a leader replicated, and FollowerLag how far behind it each
+// follower is.
+type replicationMetrics struct {
+	Role        string             `json:"role"`
+	Followers   int                `json:"followers"`
+	Offset      uint64             `json:"offset,omitempty"`
+	FollowerLag []followerLag      `json:"followerLag,omitempty"`
+	Leader      *leaderLinkMetrics `json:"leader,omitempty"`
+}
+
+type followerLag struct {
+	Addr        string  `json:"addr"`
+	AckedOffset uint64  `json:"ackedOffset"`
+	LagOps      uint64  `json:"lagOps"`
+	LagSeconds  float64 `json:"lagSeconds"`
+}
+
+type leaderLinkMetrics struct {
+	Addr              string `json:"addr"`
+	Connected         bool   `json:"connected"`
+	Synced            bool   `json:"synced"`
+	AppliedOffset     uint64 `json:"appliedOffset"`
+	ReconnectAttempts int    `json:"reconnectAttempts"`
+	Disconnects       int    `json:"disconnects"`
+}
+
+func (s *Server) isLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leading
+}
+
+func (s *Server) leaderAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader.addr
+}
+
+// connectToLeader keeps the follower attached to its leader until it is
+// promoted. Reads are served from the local cache while disconnected.
+func (s *Server) connectToLeader() {
+	for {
+		conn := s.dialLeader()
+		if conn == nil {
+			return
+		}
+		refused := s.followLeader(conn)
+
+		s.mu.Lock()
+		s.leader.conn = nil
+		s.leader.connected = false
+		s.leader.synced = false
+		s.leader.disconnects++
+		leading := s.leading
+		s.mu.Unlock()
+		if leading {
+			return
+		}
+		if refused {
+			time.Sleep(s.opts.ReconnectMaxDelay)
+		}
+		s.logger.Info("reconnecting to leader", "leader", s.leaderAddr())
+	}
+}
+
+// dialLeader retries indefinitely with jittered exponential backoff. Once the
+// leader has been unreachable for HeartbeatMisses attempts it falls back to
+// electing a replacement. It returns nil if this server got promoted.
+func (s *Server) dialLeader() net.Conn {
+	delay := s.retryDelay
+	for !s.isLeader() {
+		addr := s.leaderAddr()
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			s.mu.Lock()
+			s.leader.conn = conn
+			s.leader.connected = true
+			s.leader.attempts = 0
+			s.mu.Unlock()
+			s.logger.Info("connected to leader", "leader", addr)
+			return conn
+		}
+
+		s.mu.Lock()
+		s.leader.attempts++
+		attempt := s.leader.attempts
+		s.mu.Unlock()
+
+		if attempt >= s.opts.HeartbeatMisses && s.elect(addr) {
+			delay = s.retryDelay
+			continue
+		}
+
+		wait := delay/2 + rand.N(delay/2+1)
+		s.logger.Warn("failed to connect to leader", "attempt", attempt, "retry_in", wait, "err", err)
+		time.Sleep(wait)
+		delay = min(delay*2, s.opts.ReconnectMaxDelay)
+	}
+	return nil
+}
+
+// ackEvery bounds how many replicated operations a follower applies without
+// acknowledging them while more are waiting to be read.
+const ackEvery = 1024
+
+// followLeader registers with the leader and applies the operations it
+// replicates, in order, until the link breaks or the leader stops pinging us.
+// Replicated operations are acknowledged with an ACK of how many have been
+// applied so far and the sequence number of the last, sent whenever the
+// follower has caught up with what it has read, and never re-replicated. It reports whether the leader
+// refused to take this server on.
+func (s *Server) followLeader(conn net.Conn) (refused bool) {
+	defer conn.Close()
+
+	join := &protocol.Message{
+		Cmd:      protocol.CMDJoin,
+		Addr:     s.opts.AdvertiseAddr,
+		Priority: s.opts.FailoverPriority,
+	}
+	if _, err := conn.Write(append(join.ToBytes(), '\n')); err != nil {
+		s.logger.Error("failed to join leader", "leader", conn.RemoteAddr(), "err", err)
+		return false
+	}
+
+	timeout := s.opts.HeartbeatInterval * time.Duration(s.opts.HeartbeatMisses)
+	r := bufio.NewReader(conn)
+	var applied uint64
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			s.logger.Warn("lost connection to leader", "leader", conn.RemoteAddr(), "err", err)
+			return false
+		}
+		if reason, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("ERROR: ")); ok {
+			s.logger.Error("leader refused this follower", "leader", conn.RemoteAddr(), "err", string(reason), "retry_in", s.opts.ReconnectMaxDelay)
+			return true
+		}
+
+		msg, err := protocol.ParseCommand(line)
+		if err != nil {
+			s.logger.Warn("invalid message from leader", "err", err)
+			continue
+		}
+		// The leader only pings a follower, or tells it its peers, once
+		// the follower's initial sync has been written.
+		if !msg.Replicated {
+			s.markSynced()
+		}
+		switch {
+		case msg.Replicated:
+			s.applyReplicated(msg)
+			applied++
+			s.mu.Lock()
+			s.leader.appliedSeq = msg.Seq
+			s.mu.Unlock()
+			// An ACK covers everything applied before it, so one is only
+			// needed once we've caught up with what has arrived, or
+			// every so often while more keeps coming, as during a sync.
+			if r.Buffered() > 0 && applied%ackEvery != 0 {
+				continue
+			}
+			ack := &protocol.Message{Cmd: protocol.CMDAck, Offset: applied, Seq: msg.Seq}
+			if _, err := conn.Write(append(ack.ToBytes(), '\n')); err != nil {
+				s.logger.Warn("acknowledgement to leader failed", "err", err)
+				return false
+			}
+		case msg.Cmd == protocol.CMDPing:
+			if err := s.handlePing(conn, msg); err != nil {
+				s.logger.Warn("heartbeat reply to leader failed", "err", err)
+				return false
+			}
+		case msg.Cmd == protocol.CMDPeers:
+			s.mu.Lock()
+			s.leader.self = msg.Addr
+			s.leader.peers = msg.Peers
+			s.mu.Unlock()
+		default:
+			s.logger.Warn("unexpected command from leader, ignoring", "cmd", msg.Cmd)
+		}
+	}
+}
+
+func (s *Server) markSynced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.leader.synced {
+		s.leader.synced = true
+		s.logger.Info("synced with leader", "leader", s.leader.addr)
+	}
+}
+
+// ready reports whether this server should be sent traffic: a leader always
+// is, and a follower once it is connected to its leader and synced.
+func (s *Server) ready() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.leading:
+		return true, ""
+	case !s.leader.connected:
+		return false, "not connected to leader"
+	case !s.leader.synced:
+		return false, "sync with leader in progress"
+	}
+	return true, ""
+}
+
+func (s *Server) applyReplicated(msg *protocol.Message) {
+	var err error
+	switch msg.Cmd {
+	case protocol.CMDSet:
+		if err = s.cache.Set(msg.Key, msg.Value, msg.TTL); err == nil {
+			s.publish(protocol.EventSet, msg.Key)
+		}
+	case protocol.CMDRestore:
+		var applied bool
+		if applied, err = s.cache.ApplyDump(msg.Key, msg.Value); applied {
+			s.publish(protocol.EventSet, msg.Key)
+		}
+	case protocol.CMDDel:
+		_, err = s.cache.Delete(msg.Key)
+	case protocol.CMDSetAbsent:
+		err = s.cache.MarkAbsent(msg.Key)
+	case protocol.CMDTouch:
+		_, err = s.cache.ResetTTL(msg.Key, msg.TTL)
+	case protocol.CMDRename, protocol.CMDCopy:
+		_, err = s.renameOrCopy(msg)
+	case protocol.CMDMDel:
+		_, err = s.cache.MDel(msg.Keys)
+	case protocol.CMDExec:
+		err = s.applyTransaction(msg)
+	case protocol.CMDBatch:
+		if err = s.cache.BatchSet(msg.Pairs, msg.TTL); err == nil {
+			for k := range msg.Pairs {
+				s.publish(protocol.EventSet, []byte(k))
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported replicated command %s", msg.Cmd)
+	}
+	if err != nil {
+		s.logger.Error("failed to apply replicated operation", "cmd", msg.Cmd, "err", err)
+	}
+}
+
+// replicateExpiry forwards a TTL expiry on the leader as an explicit DEL, so
+// the leader alone decides when keys disappear from followers. Expiries a
+// follower observes locally are not propagated anywhere.
+func (s *Server) replicateExpiry(key, value []byte, reason cache.EvictionReason) {
+	if reason != cache.Expired || !s.isLeader() {
+		return
+	}
+	s.replicateDeletes(key)
+}
+
+// replicateSlide forwards a read on the leader that pushed a key's expiry
+// back as a TOUCH, so followers keep the key as long as the leader does.
+func (s *Server) replicateSlide(key []byte, ttl time.Duration) {
+	if !s.isLeader() {
+		return
+	}
+	s.replicateToFollowers(context.Background(), &protocol.Message{Cmd: protocol.CMDTouch, Key: key, TTL: ttl})
+}
+
+// syncFollower sends keys down a freshly joined replication link, as
+// RESTOREs carrying each key's version and TTL, and returns how many it
+// skipped for having gone since. They all carry seq, the offset the follower
+// joined at, since together they bring it up to that.
+func (s *Server) syncFollower(conn net.Conn, keys [][]byte, seq uint64) (uint64, error) {
+	var skipped uint64
+	for _, key := range keys {
+		payload, err := s.cache.Dump(key)
+		if err != nil {
+			skipped++
+			continue
+		}
+		op := &protocol.Message{Cmd: protocol.CMDRestore, Key: key, Value: payload, Replace: true, Replicated: true, Seq: seq}
+		if err := s.writeFollower(conn, append(op.ToBytes(), '\n')); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// writeFollower writes raw to a follower, giving up once it has gone as
+// long without reading as it may go without answering pings.
+func (s *Server) writeFollower(conn net.Conn, raw []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(s.opts.HeartbeatInterval * time.Duration(s.opts.HeartbeatMisses)))
+	_, err := conn.Write(raw)
+	return err
+}
+
+func (s *Server) heartbeatFollowers() {
+	ping := append((&protocol.Message{Cmd: protocol.CMDPing}).ToBytes(), '\n')
+	ticker := time.NewTicker(s.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		var dead []net.Conn
+		for conn, f := range s.followers {
+			if f.missed >= s.opts.HeartbeatMisses {
+				dead = append(dead, conn)
+				continue
+			}
+			f.missed++
+			// Pings queue behind everything else for the follower, so
+			// that it only sees one once its sync is done. One with no
+			// room left goes without, and is dropped soon enough.
+			f.enqueue(ping)
+		}
+		s.mu.Unlock()
+
+		for _, conn := range dead {
+			s.logger.Warn("follower missed heartbeats, dropping", "follower", conn.RemoteAddr(), "missed", s.opts.HeartbeatMisses)
+			s.dropFollower(conn)
+		}
+	}
+}
+
+// markFollowerAlive records a heartbeat, and the acknowledgement if line is
+// an ACK, if conn belongs to a follower and reports whether it did.
+func (s *Server) markFollowerAlive(conn net.Conn, line []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.followers[conn]
+	if !ok {
+		return false
+	}
+	f.lastHeartbeat = time.Now()
+	f.missed = 0
+	if msg, err := protocol.ParseCommand(line); err == nil && msg.Cmd == protocol.CMDAck {
+		s.recordAck(f, msg.Offset, msg.Seq)
+	}
+	return true
+}
+
+// pumpFollower is the only writer to a follower's connection. It writes
+// the initial sync, then whatever was queued for the follower meanwhile,
+// then the rest of its queue as it fills, all in order.
+func (s *Server) pumpFollower(conn net.Conn, f *follower, keys [][]byte, seq uint64) {
+	skipped, err := s.syncFollower(conn, keys, seq)
+	if err != nil {
+		s.logger.Warn("sync to follower failed", "follower", conn.RemoteAddr(), "err", err)
+		s.dropFollower(conn)
+		return
+	}
+	s.mu.Lock()
+	f.sent -= skipped
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		backlog := f.backlog
+		f.backlog = nil
+		if len(backlog) == 0 {
+			f.syncing = false
+		}
+		s.mu.Unlock()
+		if len(backlog) == 0 {
+			break
+		}
+		for _, raw := range backlog {
+			if !s.pump(conn, raw) {
+				return
+			}
+		}
+	}
+	for raw := range f.queue {
+		if !s.pump(conn, raw) {
+			return
+		}
+	}
+}
+
+// pump writes one message to a follower, dropping the follower if it can't.
+func (s *Server) pump(conn net.Conn, raw []byte) bool {
+	if err := s.writeFollower(conn, raw); err != nil {
+		s.logger.Warn("replication to follower failed", "follower", conn.RemoteAddr(), "err", err)
+		s.replFailures.Add(1)
+		s.dropFollower(conn)
+		return false
+	}
+	if bytes.HasPrefix(raw, []byte(protocol.ReplicationTag+" ")) {
+		s.replicated.Add(1)
+	}
+	return true
+}
+
+// removeFollower forgets conn's follower, reporting whether it was one.
+func (s *Server) removeFollower(conn net.Conn) bool {
+	s.mu.Lock()
+	f, ok := s.followers[conn]
+	if ok {
+		delete(s.followers, conn)
+		close(f.queue)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.broadcastPeers()
+	}
+	return ok
+}
+
+// dropFollower cuts a follower off. It is forgotten before its connection
+// closes, so that the connection's own cleanup can't beat it to that and
+// leave the drop uncounted.
+func (s *Server) dropFollower(conn net.Conn) {
+	if s.removeFollower(conn) {
+		s.followersDropped.Add(1)
+	}
+	conn.Close()
+}
+
+// handleJoin promotes a connection to a replication link and brings the
+// follower up to date. Nothing else is written back: the link only carries
+// newline-delimited messages from the leader.
+//
+// The keys to sync are listed, and the follower registered, under s.mu, so
+// every write replicated from then on queues up behind the sync. The sync
+// itself is written by pumpFollower, without holding s.mu, so a slow or
+// stuck follower holds up nothing but itself.
+func (s *Server) handleJoin(conn net.Conn, msg *protocol.Message) error {
+	s.mu.Lock()
+	if !s.leading {
+		s.mu.Unlock()
+		return refuseFollower(conn, errors.New("not the leader"))
+	}
+	if limit := s.maxFollowers.Load(); limit > 0 && int64(len(s.followers)) >= limit {
+		s.mu.Unlock()
+		s.followersRefused.Add(1)
+		s.logger.Warn("refused follower, already at -maxfollowers", "follower", conn.RemoteAddr(), "max", limit)
+		return refuseFollower(conn, fmt.Errorf("this leader is full: -maxfollowers is %d", limit))
+	}
+	keys := s.cache.Keys()
+	seq := s.replOffset
+	now := time.Now()
+	f := &follower{
+		addr:          advertisedAddr(conn, msg.Addr),
+		priority:      msg.Priority,
+		joined:        now,
+		lastHeartbeat: now,
+		queue:         make(chan []byte, followerQueueSize),
+		sent:          uint64(len(keys)),
+		behindSince:   now,
+		syncing:       true,
+	}
+	if len(keys) == 0 {
+		f.ackedSeq = seq
+	}
+	s.followers[conn] = f
+	s.mu.Unlock()
+	go s.pumpFollower(conn, f, keys, seq)
+
+	s.logger.Info("follower joined", "follower", conn.RemoteAddr())
+	s.broadcastPeers()
+	return nil
+}
+
+// refuseFollower tells a server sending JOIN why it can't follow this one,
+// as a line it can read like the rest of the link, and hangs up.
+func refuseFollower(conn net.Conn, err error) error {
+	conn.Write([]byte("ERROR: " + err.Error() + "\n"))
+	conn.Close()
+	return nil
+}
+
+// handlePing answers PONG, or echoes the payload if one was given.
+func (s *Server) handlePing(conn net.Conn, msg *protocol.Message) error {
+	if msg.Value != nil {
+		_, err := conn.Write(msg.Value)
+		return err
+	}
+	_, err := conn.Write(append((&protocol.Message{Cmd: protocol.CMDPong}).ToBytes(), '\n'))
+	return err
+}
+
+func (s *Server) handleReplicas(conn net.Conn, msg *protocol.Message) error {
+	now := time.Now()
+	s.mu.Lock()
+	replicas := make([]followerStatus, 0, len(s.followers))
+	for conn, f := range s.followers {
+		status := followerStatus{
+			Addr:           conn.RemoteAddr().String(),
+			AdvertisedAddr: f.addr,
+			Joined:         f.joined,
+			LastHeartbeat:  f.lastHeartbeat,
+			MissedPongs:    f.missed,
+			QueueDepth:     len(f.queue),
+			LagOps:         f.sent - f.acked,
+			LagSeconds:     f.lag(now).Seconds(),
+			AckedOffset:    f.ackedSeq,
+		}
+		if lastAck := f.lastAck; !lastAck.IsZero() {
+			status.LastAck = &lastAck
+		}
+		replicas = append(replicas, status)
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func (s *Server) replicationMetrics() replicationMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leading {
+		m := replicationMetrics{Role: "leader", Followers: len(s.followers), Offset: s.replOffset}
+		now := time.Now()
+		for conn, f := range s.followers {
+			m.FollowerLag = append(m.FollowerLag, followerLag{
+				Addr:        conn.RemoteAddr().String(),
+				AckedOffset: f.ackedSeq,
+				LagOps:      f.sent - f.acked,
+				LagSeconds:  f.lag(now).Seconds(),
+			})
+		}
+		return m
+	}
+	return replicationMetrics{
+		Role: "follower",
+		Leader: &leaderLinkMetrics{
+			Addr:              s.leader.addr,
+			Connected:         s.leader.connected,
+			Synced:            s.leader.synced,
+			AppliedOffset:     s.leader.appliedSeq,
+			ReconnectAttempts: s.leader.attempts,
+			Disconnects:       s.leader.disconnects,
+		},
+	}
+}
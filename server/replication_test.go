@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keysOn returns the keys c's server holds, sorted.
+func keysOn(t *testing.T, c *testConn) []string {
+	t.Helper()
+	payload, err := c.do(t, "KEYS")
+	if err != nil {
+		t.Fatalf("KEYS: %v", err)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	keys := strings.Split(string(payload), ",")
+	sort.Strings(keys)
+	return keys
+}
+
+// TestDeleteRacingReplicatedSet deletes keys while they are being set, so
+// that a SET's RESTORE and the DEL are replicated concurrently. Whatever
+// order they land in on the leader, the follower must end up agreeing with
+// it: a DEL queued ahead of a RESTORE of the value it removed would bring the
+// key back on the follower for good.
+func TestDeleteRacingReplicatedSet(t *testing.T) {
+	// Each round stays well inside the follower's queue, so that it is
+	// never dropped and resynced part way through.
+	const rounds, keys = 10, 200
+	leader := startTestServer(t, Options{})
+	follower := startTestServer(t, Options{LeaderAddr: leader.Addr().String()})
+	waitForFollowers(t, leader, 1)
+
+	setter, deleter := dialTestServer(t, leader), dialTestServer(t, leader)
+	fc := dialTestServer(t, follower)
+	for r := 0; r < rounds; r++ {
+		var wg sync.WaitGroup
+		for _, c := range []struct {
+			conn *testConn
+			cmd  string
+		}{{setter, "SET k%d-%d v 0"}, {deleter, "DEL k%d-%d"}} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Pipelined, so the server runs many of them at once.
+				for i := 0; i < keys; i++ {
+					c.conn.send(t, fmt.Sprintf(c.cmd, r, i))
+				}
+				for i := 0; i < keys; i++ {
+					c.conn.read(t)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Replication is ordered, so once a later write reaches the
+		// follower, everything before it has too.
+		marker := fmt.Sprintf("done-%d", r)
+		if _, err := setter.do(t, "SET "+marker+" v 0"); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			if _, err := fc.do(t, "GET "+marker); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: follower never caught up", r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	want, got := keysOn(t, setter), keysOn(t, fc)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("follower holds %d keys, leader %d; only the follower has %v, only the leader %v", len(got), len(want), extra(got, want), extra(want, got))
+	}
+}
+
+// waitForFollowers waits until n followers have finished syncing with s.
+func waitForFollowers(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		synced := 0
+		s.mu.Lock()
+		for _, f := range s.followers {
+			if !f.syncing {
+				synced++
+			}
+		}
+		s.mu.Unlock()
+		if synced >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d followers synced", synced, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// extra returns the keys in a that aren't in b.
+func extra(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, k := range b {
+		in[k] = true
+	}
+	var out []string
+	for _, k := range a {
+		if !in[k] {
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -1,44 +1,241 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"distributedCache/cache"
 	"distributedCache/protocol"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	followerQueueSize = 1024
+	// maxSyncBacklog is how many operations may queue up for a follower
+	// while its initial sync is still being written.
+	maxSyncBacklog = 64 * followerQueueSize
+
+	defaultHeartbeatInterval = 3 * time.Second
+	defaultHeartbeatMisses   = 3
+	defaultReconnectMaxDelay = 30 * time.Second
+	defaultSaveInterval      = 5 * time.Minute
+	defaultMaxCommandBytes   = 64 << 20
+	defaultMaxBatchPairs     = 100000
+	defaultAckTimeout        = time.Second
+)
+
 type Options struct {
 	ListenAddr  string
 	IsLeader    bool
 	LeaderAddr  string
 	StoragePath string
+	// SaveInterval is the longest a persistent cache goes between snapshots,
+	// provided anything has changed.
+	SaveInterval time.Duration
+	// SaveRules snapshot sooner once enough writes have built up.
+	SaveRules []SaveRule
+	// HTTPAddr, if set, serves Prometheus /metrics, /healthz and /readyz
+	// over HTTP, along with a REST gateway to the cache (see gateway.go).
+	HTTPAddr string
+
+	// HeartbeatInterval is how often the leader pings its followers.
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses is how many consecutive pings may go unanswered
+	// before a follower (or, from the follower's side, the leader) is
+	// considered dead.
+	HeartbeatMisses int
+
+	// WriteConcern is how many followers must acknowledge a write before a
+	// leader replies to it; AckTimeout is how long it waits for them before
+	// replying with an error instead. The write stays applied either way.
+	WriteConcern WriteConcern
+	AckTimeout   time.Duration
+	// MinReplicasMaxLag, if positive, makes a leader refuse writes unless
+	// at least one follower is within it of caught up (see follower.lag),
+	// and so refuse them while it has no followers at all.
+	MinReplicasMaxLag time.Duration
+
+	// ReconnectMaxDelay caps the exponential backoff a follower uses while
+	// trying to reach its leader. A follower the leader refuses waits this
+	// long before asking again.
+	ReconnectMaxDelay time.Duration
+
+	// MaxFollowers is how many followers a leader takes at once; more are
+	// refused until one leaves. Zero means no limit.
+	MaxFollowers int
+
+	// FailoverPriority makes a follower eligible to take over when the leader
+	// is unreachable; the highest priority wins. Zero never self-promotes.
+	FailoverPriority int
+	// AdvertiseAddr is the address other nodes should use to reach this one
+	// after a failover. Defaults to ListenAddr.
+	AdvertiseAddr string
+
+	// LatencyBuckets are the upper bounds, ascending, of the per-command
+	// latency histograms in METRICS and /metrics. Defaults to 50µs up to 1s.
+	LatencyBuckets []time.Duration
+
+	// RateLimit caps each client connection at this many commands a second
+	// on average, with bursts of up to RateBurst, and GlobalRateLimit caps
+	// all client connections together. A command over a limit is held back
+	// for up to RateLimitWait, and answered with an error without being run
+	// if that isn't long enough. Zero means no limit. Replication links are
+	// never limited.
+	RateLimit       float64
+	RateBurst       int
+	GlobalRateLimit float64
+	RateLimitWait   time.Duration
+
+	// MaxCommandBytes caps the length of a command line, or of an entry sent
+	// to RESTORE, so a client can't make the server buffer without limit.
+	// Longer commands are rejected. Defaults to 64 MiB; negative means no
+	// limit.
+	MaxCommandBytes int
+	// MaxBatchPairs caps how many pairs one BATCH or MSETNX may set, so a
+	// single command can't hold shard locks for too long. Defaults to
+	// 100000; negative means no limit.
+	MaxBatchPairs int
+	// CommandTimeout, if positive, is how long a command may run before it
+	// is abandoned with an error. Commands that can take long, such as KEYS
+	// on a large cache or a GET waiting on the cache's Loader, stop as soon
+	// as it passes; so does waiting for the write concern.
+	CommandTimeout time.Duration
+
+	// ClusterPeers, if set, turns on cluster mode (see cluster.go): keys are
+	// sharded across these nodes and this one, by AdvertiseAddr, each node
+	// given ClusterVNodes points on the ring (ring.DefaultVNodes if zero).
+	// Every node must be named the same way in every node's list. Commands
+	// for another node's keys are proxied to it, or with ClusterRedirect,
+	// answered with MOVED.
+	ClusterPeers    []string
+	ClusterVNodes   int
+	ClusterRedirect bool
+
+	// Logger receives the server's logs. Defaults to slog.Default().
+	Logger *slog.Logger
+	// LogLevel, if set, is the level Logger's handler filters on, so that
+	// CONFIG SET loglevel can change it.
+	LogLevel *slog.LevelVar
 }
 
 type Server struct {
 	opts       Options
 	cache      cache.Cacher
-	followers  map[net.Conn]struct{}
+	logger     *slog.Logger
+	followers  map[net.Conn]*follower
 	mu         sync.Mutex
-	connPool   chan net.Conn
-	maxRetries int
 	retryDelay time.Duration
+	leading    bool
+	leader     leaderLink
+	acks       chan struct{} // closed and replaced whenever a follower acknowledges
+	replOffset uint64        // sequence number of the last replicated operation
+	started    time.Time
+	stats      commandStats
+	saving     atomic.Bool
+	lastSave   atomic.Int64 // unix nanoseconds, 0 before the first save
+
+	lastSaveDuration atomic.Int64
+	throttled        atomic.Uint64 // commands refused by a rate limit
+	delayed          atomic.Uint64 // commands held back by a rate limit, then run
+	parseErrors      atomic.Uint64 // command lines that didn't parse
+	closedBytesIn    atomic.Uint64 // bytes read from connections since closed
+	closedBytesOut   atomic.Uint64 // bytes written to connections since closed
+	replicated       atomic.Uint64 // operations written to a follower
+	replFailures     atomic.Uint64 // operations a follower was dropped without
+	followersDropped atomic.Uint64 // followers cut off for lagging or failing
+	followersRefused atomic.Uint64 // followers turned away by MaxFollowers
+	maxFollowers     atomic.Int64  // Options.MaxFollowers until CONFIG SET changes it
+	limits           atomic.Pointer[rateLimits]
+	cluster          *cluster     // nil unless Options.ClusterPeers is set
+	configMu         sync.Mutex   // serializes changes to the settings in config.go
+	memoryLimited    bool         // whether the cache was created with a memory limit
+	saveInterval     atomic.Int64 // Options.SaveInterval until CONFIG SET changes it
+	globalLimiter    tokenBucket
+
+	ln      net.Listener
+	ctx     context.Context // parent of every connection's context
+	stop    context.CancelFunc
+	closing atomic.Bool
+	closed  chan struct{}
+
+	connsMu  sync.RWMutex
+	conns    map[*client]struct{}
+	accepted atomic.Uint64
+
+	subMu         sync.RWMutex
+	subscribers   map[string]map[net.Conn]*subscriber // by pattern
+	subscriptions map[net.Conn]*subscriber
 }
 
 func New(opts Options, cacher cache.Cacher) *Server {
-	return &Server{
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.HeartbeatMisses <= 0 {
+		opts.HeartbeatMisses = defaultHeartbeatMisses
+	}
+	if opts.ReconnectMaxDelay <= 0 {
+		opts.ReconnectMaxDelay = defaultReconnectMaxDelay
+	}
+	if opts.SaveInterval <= 0 {
+		opts.SaveInterval = defaultSaveInterval
+	}
+	if len(opts.LatencyBuckets) == 0 {
+		opts.LatencyBuckets = defaultLatencyBuckets
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = defaultAckTimeout
+	}
+	if opts.MaxCommandBytes == 0 {
+		opts.MaxCommandBytes = defaultMaxCommandBytes
+	}
+	if opts.MaxBatchPairs == 0 {
+		opts.MaxBatchPairs = defaultMaxBatchPairs
+	}
+	if opts.AdvertiseAddr == "" {
+		opts.AdvertiseAddr = opts.ListenAddr
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	s := &Server{
 		opts:       opts,
 		cache:      cacher,
-		followers:  make(map[net.Conn]struct{}),
-		connPool:   make(chan net.Conn, 10), // Connection pool for followers
-		maxRetries: 3,
+		logger:     opts.Logger,
+		followers:  make(map[net.Conn]*follower),
 		retryDelay: time.Second,
+		leading:    opts.IsLeader,
+		leader:     leaderLink{addr: opts.LeaderAddr},
+		acks:       make(chan struct{}),
+		started:    time.Now(),
+		stats:      commandStats{bounds: opts.LatencyBuckets},
+
+		conns:         make(map[*client]struct{}),
+		subscribers:   make(map[string]map[net.Conn]*subscriber),
+		subscriptions: make(map[net.Conn]*subscriber),
 	}
+	s.limits.Store(&rateLimits{perConn: opts.RateLimit, burst: opts.RateBurst, global: opts.GlobalRateLimit, wait: opts.RateLimitWait})
+	s.saveInterval.Store(int64(opts.SaveInterval))
+	s.maxFollowers.Store(int64(max(opts.MaxFollowers, 0)))
+	s.memoryLimited = cacher.MaxBytes() > 0
+	s.cluster = newCluster(opts)
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	s.closed = make(chan struct{})
+	cacher.OnEvict(s.replicateExpiry)
+	cacher.OnEvict(s.publishEviction)
+	cacher.OnSlide(s.replicateSlide)
+	return s
 }
 
 func (s *Server) Start() error {
@@ -46,12 +243,21 @@ func (s *Server) Start() error {
 	if err != nil {
 		return fmt.Errorf("listen error: %w", err)
 	}
-	log.Printf("Server started on %s [Leader: %v]", s.opts.ListenAddr, s.opts.IsLeader)
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	s.logger.Info("server started", "addr", ln.Addr().String(), "leader", s.isLeader())
 
-	if !s.opts.IsLeader {
+	if s.isLeader() {
+		go s.heartbeatFollowers()
+	} else {
 		go s.connectToLeader()
 	}
 
+	if s.opts.HTTPAddr != "" {
+		go s.serveHTTP()
+	}
+
 	// Periodic persistence if storage path is specified
 	if s.opts.StoragePath != "" {
 		go s.periodicSave()
@@ -60,120 +266,585 @@ func (s *Server) Start() error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			if s.closing.Load() {
+				<-s.closed
+				return nil
+			}
+			s.logger.Error("accept failed", "err", err)
 			continue
 		}
-		s.connPool <- conn
-		go s.handleConnection(conn)
+		go s.handleConnection(s.addClient(conn))
 	}
 }
 
-func (s *Server) periodicSave() {
-	if pc, ok := s.cache.(*cache.PersistentCache); ok {
-		ticker := time.NewTicker(5 * time.Minute)
-		for range ticker.C {
-			if err := pc.SaveToDisk(); err != nil {
-				log.Printf("Failed to save cache to disk: %v", err)
-			}
-		}
+// Addr returns the address the server is listening on, which is useful with
+// a ListenAddr port of 0. It is nil until Start has bound the listener.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
 	}
+	return s.ln.Addr()
 }
 
-func (s *Server) connectToLeader() {
-	for attempt := 1; attempt <= s.maxRetries; attempt++ {
-		conn, err := net.Dial("tcp", s.opts.LeaderAddr)
-		if err == nil {
-			log.Printf("Connected to leader at %s", s.opts.LeaderAddr)
-			s.connPool <- conn
-			s.handleConnection(conn)
-			return
-		}
-		log.Printf("Failed to connect to leader (attempt %d/%d): %v", attempt, s.maxRetries, err)
-		time.Sleep(s.retryDelay)
+// Close stops accepting connections, cancels the work of the open ones, and
+// saves a persistent cache one last time. Start returns nil once it is done.
+func (s *Server) Close() error {
+	if !s.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer close(s.closed)
+	s.stop()
+	if s.cluster != nil {
+		s.cluster.close()
 	}
-	log.Fatalf("Failed to connect to leader after %d attempts", s.maxRetries)
+	s.mu.Lock()
+	ln := s.ln
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+
+	pc, ok := s.cache.(*cache.PersistentCache)
+	if !ok {
+		return nil
+	}
+	// Unlike save, wait out any save already running rather than skip ours;
+	// writes may have landed since it took its snapshot.
+	s.logger.Info("saving cache to disk before shutdown")
+	if err := s.persist(pc); err != nil {
+		pc.Close()
+		return fmt.Errorf("final save: %w", err)
+	}
+	return pc.Close()
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn *client) {
 	defer conn.Close()
-	log.Printf("New connection from %s", conn.RemoteAddr())
-
-	if s.opts.IsLeader {
-		s.mu.Lock()
-		s.followers[conn] = struct{}{}
-		s.mu.Unlock()
-	}
+	defer s.removeClient(conn)
+	s.logger.Debug("new connection", "client", conn.RemoteAddr())
 
-	buf := make([]byte, 2048)
+	r := bufio.NewReader(conn)
 	for {
-		n, err := conn.Read(buf)
+		line, n, err := protocol.ReadCommand(r, s.opts.MaxCommandBytes)
+		conn.bytesIn.Add(uint64(n))
+		if errors.Is(err, protocol.ErrCommandTooLong) {
+			s.logger.Warn("rejected oversized command", "client", conn.RemoteAddr(), "bytes", n)
+			conn.reply(nil, err)
+			continue
+		}
 		if err != nil {
-			log.Printf("Connection read error from %s: %v", conn.RemoteAddr(), err)
-			s.mu.Lock()
-			delete(s.followers, conn)
-			s.mu.Unlock()
+			s.logger.Debug("connection closed", "client", conn.RemoteAddr(), "err", err)
+			s.removeFollower(conn)
+			s.unsubscribe(conn, nil)
 			return
 		}
-		go s.handleCommand(conn, buf[:n])
+		// Followers only ever answer our pings, so anything they send is
+		// proof of life rather than a command.
+		if s.markFollowerAlive(conn, line) {
+			continue
+		}
+		if !s.admit(conn) {
+			conn.reply(nil, errThrottled)
+			continue
+		}
+		if isImport(line) {
+			s.handleImport(conn, r)
+			continue
+		}
+		if s.inTransaction(conn, line) {
+			continue
+		}
+		go s.handleCommand(conn, line)
 	}
 }
 
-func (s *Server) handleCommand(conn net.Conn, raw []byte) {
+// handleCommand runs one command and writes its response, framed if the
+// connection asked for that with HELLO. HELLO's own reply is always framed,
+// so a client can tell whether the server understood it.
+func (s *Server) handleCommand(conn *client, raw []byte) {
 	msg, err := protocol.ParseCommand(raw)
 	if err != nil {
-		conn.Write([]byte("ERROR: " + err.Error()))
+		s.parseErrors.Add(1)
+	}
+	if err == nil && msg.Replicated {
+		err = errors.New("replicated operations are only accepted from the leader")
+	}
+	if err == nil && msg.Cmd != protocol.CMDSubscribe && msg.Cmd != protocol.CMDUnsubscribe &&
+		s.pushToSubscriber(conn, []byte("ERROR: only SUBSCRIBE and UNSUBSCRIBE are allowed in subscribe mode\n")) {
 		return
 	}
 
-	log.Printf("Command received: %s", msg.Cmd)
+	if !conn.framed.Load() && (err != nil || msg.Cmd != protocol.CMDHello) {
+		w := &rawResponse{client: conn}
+		if err == nil {
+			err = s.runCommand(conn, w, msg)
+		}
+		switch {
+		case err != nil:
+			conn.Write([]byte("ERROR: " + replyError(err).Error()))
+		case w.n == 0 && !repliesElsewhere(msg.Cmd):
+			conn.Write([]byte(protocol.EmptyReply))
+		}
+		return
+	}
+
+	resp := &response{client: conn}
+	if err == nil {
+		err = s.runCommand(conn, resp, msg)
+	}
+	if err != nil {
+		err = replyError(err)
+	}
+	conn.Write(protocol.EncodeFrame(resp.buf.Bytes(), err))
+}
+
+var (
+	errReplyNotFound    = errors.New(protocol.ReplyNotFound)
+	errReplyKnownAbsent = errors.New(protocol.ReplyKnownAbsent)
+)
+
+// replyError is what to send a client for err: any miss, from whichever
+// command, becomes the fixed reply clients match, and anything else is sent
+// as it is.
+func replyError(err error) error {
+	switch {
+	case errors.Is(err, cache.ErrKnownAbsent):
+		return errReplyKnownAbsent
+	case errors.Is(err, cache.ErrKeyNotFound), errors.Is(err, cache.ErrKeyExpired):
+		return errReplyNotFound
+	}
+	return err
+}
+
+// commandContext bounds a command run under parent by CommandTimeout.
+func (s *Server) commandContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.CommandTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, s.opts.CommandTimeout)
+}
+
+var errTimedOut = errors.New("timed out")
+
+// timeoutError replaces the bare context error of a command that ran out of
+// time with one saying which command and how long it had.
+func (s *Server) timeoutError(cmd protocol.Command, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s %w after %s", cmd, errTimedOut, s.opts.CommandTimeout)
+	}
+	return err
+}
+
+// repliesElsewhere reports whether cmd answers on the connection itself
+// rather than through the writer runCommand is given: JOIN with the sync
+// stream, and SUBSCRIBE and UNSUBSCRIBE through the subscriber's queue.
+func repliesElsewhere(cmd protocol.Command) bool {
+	switch cmd {
+	case protocol.CMDJoin, protocol.CMDSubscribe, protocol.CMDUnsubscribe:
+		return true
+	}
+	return false
+}
+
+// runCommand dispatches msg, with its response written to w. Every command
+// writes a response or returns an error, bar those repliesElsewhere lists.
+func (s *Server) runCommand(conn *client, w net.Conn, msg *protocol.Message) (err error) {
+	// PING touches nothing, and is left out of the stats so that keepalives
+	// don't swamp them.
+	if msg.Cmd == protocol.CMDPing {
+		return s.handlePing(w, msg)
+	}
+
+	s.logger.Debug("command received", "cmd", msg.Cmd, "client", conn.RemoteAddr())
+	conn.commands.Add(1)
+	conn.lastCmd.Store(msg.Cmd)
+	start := time.Now()
+	defer func() { s.stats.record(msg.Cmd, time.Since(start), err) }()
+	ctx, cancel := s.commandContext(conn.ctx)
+	defer cancel()
+	defer func() { err = s.timeoutError(msg.Cmd, err) }()
+
+	if _, framed := w.(*response); framed {
+		switch msg.Cmd {
+		case protocol.CMDJoin, protocol.CMDSubscribe, protocol.CMDUnsubscribe:
+			return fmt.Errorf("%s is not supported on a framed connection", msg.Cmd)
+		}
+	}
+	if routed, err := s.route(ctx, conn, w, msg); routed {
+		return err
+	}
+	if err := s.scope(conn, msg); err != nil {
+		return err
+	}
+	if isWrite(msg) {
+		if err := s.checkReplicaLag(); err != nil {
+			return err
+		}
+	}
+	ns := conn.namespace()
+
 	switch msg.Cmd {
+	case protocol.CMDHello:
+		err = s.handleHello(conn, w, msg)
+	case protocol.CMDSelect, protocol.CMDUse:
+		err = s.handleSelect(conn, w, msg)
 	case protocol.CMDSet:
-		err = s.handleSet(conn, msg)
+		err = s.handleSet(ctx, w, msg)
+	case protocol.CMDCas:
+		err = s.handleCas(ctx, w, msg)
+	case protocol.CMDCasVersion:
+		err = s.handleCasVersion(ctx, w, msg)
 	case protocol.CMDGet:
-		err = s.handleGet(conn, msg)
+		err = s.handleGet(ctx, w, msg)
+	case protocol.CMDMGet:
+		err = s.handleMGet(w, msg)
 	case protocol.CMDDel:
-		err = s.handleDelete(conn, msg)
+		err = s.handleDelete(ctx, w, msg)
+	case protocol.CMDMDel:
+		err = s.handleMDel(ctx, w, msg)
+	case protocol.CMDRename, protocol.CMDCopy:
+		err = s.handleRename(ctx, w, msg)
+	case protocol.CMDTouch:
+		err = s.handleTouch(ctx, w, msg)
+	case protocol.CMDTouchKeys:
+		err = s.handleTouchKeys(w, msg)
+	case protocol.CMDAppend:
+		err = s.handleAppend(ctx, w, msg)
+	case protocol.CMDGetDel:
+		err = s.handleGetDel(ctx, w, msg)
+	case protocol.CMDGetEx:
+		err = s.handleGetEx(ctx, w, msg)
 	case protocol.CMDHas:
-		err = s.handleHas(conn, msg)
+		err = s.handleHas(w, msg)
+	case protocol.CMDInspect, protocol.CMDInfoKey:
+		err = s.handleInspect(w, msg, ns)
+	case protocol.CMDSetAbsent:
+		err = s.handleSetAbsent(ctx, w, msg)
+	case protocol.CMDHotKeys:
+		err = s.handleHotKeys(w, msg, ns)
+	case protocol.CMDDump:
+		err = s.handleDump(w, msg)
+	case protocol.CMDRestore:
+		err = s.handleRestore(ctx, w, msg)
 	case protocol.CMDKeys:
-		err = s.handleKeys(conn, msg)
+		err = s.handleKeys(ctx, w, msg, ns)
+	case protocol.CMDScan:
+		err = s.handleScan(w, msg, ns)
+	case protocol.CMDDBSize:
+		err = s.handleDBSize(w, msg)
+	case protocol.CMDRandomKey:
+		err = s.handleRandomKey(w, msg, ns)
 	case protocol.CMDMetrics:
-		err = s.handleMetrics(conn, msg)
+		err = s.handleMetrics(w, msg)
+	case protocol.CMDStats:
+		err = s.handleStats(w)
+	case protocol.CMDSave:
+		err = s.handleSave(w, msg)
+	case protocol.CMDBgsave:
+		err = s.handleBgsave(w, msg)
+	case protocol.CMDSnapshot:
+		err = s.handleSnapshot(w, msg)
+	case protocol.CMDAddNode:
+		err = s.handleAddNode(w, msg)
+	case protocol.CMDRemoveNode:
+		err = s.handleRemoveNode(w, msg)
 	case protocol.CMDBatch:
-		err = s.handleBatch(conn, msg)
+		err = s.handleBatch(ctx, w, msg)
+	case protocol.CMDMSetNX:
+		err = s.handleMSetNX(ctx, w, msg)
+	case protocol.CMDLatency:
+		err = s.handleLatency(w, msg)
+	case protocol.CMDConfig:
+		err = s.handleConfig(w, msg)
+	case protocol.CMDValidate:
+		err = s.handleValidate(w, msg)
+	case protocol.CMDMulti:
+		err = s.handleMulti(conn, w)
+	case protocol.CMDExec:
+		err = s.handleExec(ctx, conn, w)
+	case protocol.CMDDiscard:
+		err = s.handleDiscard(conn, w)
+	case protocol.CMDJoin:
+		err = s.handleJoin(conn, msg)
+	case protocol.CMDReplicas, protocol.CMDFollowers:
+		err = s.handleReplicas(w, msg)
+	case protocol.CMDClients:
+		err = s.handleClients(w, msg)
+	case protocol.CMDPromote:
+		err = s.handlePromote(w, msg)
+	case protocol.CMDSubscribe:
+		err = s.handleSubscribe(conn, msg)
+	case protocol.CMDUnsubscribe:
+		err = s.handleUnsubscribe(conn, msg)
+	default:
+		// Every command gets a reply, or a client would wait forever.
+		err = fmt.Errorf("%s is only sent between cluster nodes", msg.Cmd)
+	}
+
+	return unscopeError(ns, err)
+}
+
+// handleGet writes key's value, preceded by its version and a space for
+// GET key WITHVERSION.
+func (s *Server) handleGet(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if msg.WithVersion {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		val, version, err := s.cache.GetWithVersion(msg.Key)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(fmt.Appendf(nil, "%d %s", version, val))
+		return err
+	}
+	val, err := s.cache.GetCtx(ctx, msg.Key)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(val)
+	return err
+}
+
+func (s *Server) handleMGet(conn net.Conn, msg *protocol.Message) error {
+	vals, errs := s.cache.MGet(msg.Keys)
+	found := make([]bool, len(vals))
+	for i, err := range errs {
+		found[i] = err == nil
+	}
+	_, err := conn.Write(protocol.EncodeMulti(vals, found))
+	return err
+}
+
+func (s *Server) handleSet(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if err := s.set(ctx, msg.Key, msg.Value, msg.TTL); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
+
+// set writes key, publishes and replicates the write, and waits for the write
+// concern, for SET and the HTTP gateway alike.
+func (s *Server) set(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := s.cache.SetCtx(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	s.publish(protocol.EventSet, key)
+	if s.isLeader() {
+		s.replicateKeys(key)
+	}
+	return s.awaitWriteConcern(ctx)
+}
+
+// handleCas replies true if the swap happened. Only a swap is replicated,
+// since the leader has already made the comparison.
+func (s *Server) handleCas(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	swapped, err := s.cache.CompareAndSwap(msg.Key, msg.Expected, msg.Value, msg.TTL)
+	if err != nil {
+		return err
+	}
+	return s.replyCas(ctx, conn, msg.Key, swapped)
+}
+
+func (s *Server) handleCasVersion(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	swapped, err := s.cache.CompareAndSwapVersion(msg.Key, msg.KeyVersion, msg.Value, msg.TTL)
+	if err != nil {
+		return err
+	}
+	return s.replyCas(ctx, conn, msg.Key, swapped)
+}
+
+func (s *Server) replyCas(ctx context.Context, conn net.Conn, key []byte, swapped bool) error {
+	if swapped {
+		s.publish(protocol.EventSet, key)
+		if s.isLeader() {
+			s.replicateKeys(key)
+		}
+		if err := s.awaitWriteConcern(ctx); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte(strconv.FormatBool(swapped)))
+	return err
+}
+
+func (s *Server) handleDelete(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	existed, err := s.del(ctx, msg.Key)
+	if err != nil {
+		return err
+	}
+	n := 0
+	if existed {
+		n = 1
+	}
+	_, err = conn.Write([]byte(strconv.Itoa(n)))
+	return err
+}
+
+// del removes key, replicates the delete and waits for the write concern,
+// reporting whether the key existed.
+func (s *Server) del(ctx context.Context, key []byte) (bool, error) {
+	existed, err := s.cache.DeleteCtx(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if s.isLeader() {
+		s.replicateDeletes(key)
+	}
+	return existed, s.awaitWriteConcern(ctx)
+}
+
+func (s *Server) handleMDel(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	n, err := s.cache.MDel(msg.Keys)
+	if err != nil {
+		return err
+	}
+	if s.isLeader() {
+		s.replicateDeletes(msg.Keys...)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(strconv.Itoa(n)))
+	return err
+}
+
+// handleRename runs RENAME, replying OK, or COPY, replying 1 if it copied
+// and 0 if it left dst alone for want of REPLACE. Each is replicated as
+// itself, since the new key takes the old one's version along with its
+// value; a COPY with REPLACE, so followers don't keep a dst the leader
+// replaced.
+func (s *Server) handleRename(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	done, err := s.renameOrCopy(msg)
+	if err != nil {
+		return err
+	}
+	if done && s.isLeader() {
+		op := *msg
+		op.Replace = true
+		s.replicateToFollowers(context.Background(), &op)
 	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	reply := "OK"
+	if msg.Cmd == protocol.CMDCopy {
+		reply = "0"
+		if done {
+			reply = "1"
+		}
+	}
+	_, err = conn.Write([]byte(reply))
+	return err
+}
 
+// renameOrCopy runs RENAME or COPY on the cache and reports whether it
+// wrote dst.
+func (s *Server) renameOrCopy(msg *protocol.Message) (bool, error) {
+	done := true
+	var err error
+	if msg.Cmd == protocol.CMDRename {
+		err = s.cache.Rename(msg.Key, msg.NewKey)
+	} else {
+		done, err = s.cache.CopyTTL(msg.Key, msg.NewKey, msg.TTL, msg.Replace)
+	}
+	if err == nil && done && !bytes.Equal(msg.Key, msg.NewKey) {
+		s.publish(protocol.EventSet, msg.NewKey)
+	}
+	return done, err
+}
+
+func (s *Server) handleGetDel(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	val, err := s.cache.GetDel(msg.Key)
 	if err != nil {
-		conn.Write([]byte("ERROR: " + err.Error()))
+		return err
 	}
+	if s.isLeader() {
+		s.replicateDeletes(msg.Key)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = conn.Write(val)
+	return err
 }
 
-func (s *Server) handleGet(conn net.Conn, msg *protocol.Message) error {
-	val, err := s.cache.Get(msg.Key)
+func (s *Server) handleGetEx(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	val, err := s.cache.GetEx(msg.Key, msg.TTL)
 	if err != nil {
 		return err
 	}
+	if s.isLeader() {
+		s.replicateToFollowers(context.Background(), &protocol.Message{Cmd: protocol.CMDTouch, Key: msg.Key, TTL: msg.TTL})
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
 	_, err = conn.Write(val)
 	return err
 }
 
-func (s *Server) handleSet(conn net.Conn, msg *protocol.Message) error {
-	if err := s.cache.Set(msg.Key, msg.Value, msg.TTL); err != nil {
+// handleAppend replies with the value's new length. Followers are sent the
+// whole value, like any other write.
+func (s *Server) handleAppend(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	n, err := s.cache.Append(msg.Key, msg.Value)
+	if err != nil {
 		return err
 	}
-	if s.opts.IsLeader {
-		go s.replicateToFollowers(context.Background(), msg)
+	s.publish(protocol.EventSet, msg.Key)
+	if s.isLeader() {
+		s.replicateKeys(msg.Key)
 	}
-	_, err := conn.Write([]byte("OK"))
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(strconv.Itoa(n)))
 	return err
 }
 
-func (s *Server) handleDelete(conn net.Conn, msg *protocol.Message) error {
-	if err := s.cache.Delete(msg.Key); err != nil {
+// handleTouch restarts a key's TTL and replies OK. Followers are sent the
+// TTL it ended up with, since they may not remember the one it was set with.
+func (s *Server) handleTouch(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	ttl, err := s.cache.ResetTTL(msg.Key, msg.TTL)
+	if err != nil {
+		return err
+	}
+	if s.isLeader() {
+		s.replicateToFollowers(context.Background(), &protocol.Message{Cmd: protocol.CMDTouch, Key: msg.Key, TTL: ttl})
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
 		return err
 	}
-	if s.opts.IsLeader {
-		go s.replicateToFollowers(context.Background(), msg)
+	_, err = conn.Write([]byte("OK"))
+	return err
+}
+
+// handleTouchKeys marks keys as recently used and replies with how many it
+// found. It isn't replicated: followers keep their own track of what is
+// recently used, as they do for reads.
+func (s *Server) handleTouchKeys(conn net.Conn, msg *protocol.Message) error {
+	n, err := s.cache.Touch(msg.Keys)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(strconv.Itoa(n)))
+	return err
+}
+
+// handleSetAbsent marks a key the client found missing from its backing
+// store, so other readers get told it's absent instead of looking too.
+func (s *Server) handleSetAbsent(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if err := s.cache.MarkAbsent(msg.Key); err != nil {
+		return err
+	}
+	if s.isLeader() {
+		s.replicateToFollowers(context.Background(), msg)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
 	}
 	_, err := conn.Write([]byte("OK"))
 	return err
@@ -185,19 +856,158 @@ func (s *Server) handleHas(conn net.Conn, msg *protocol.Message) error {
 	return err
 }
 
-func (s *Server) handleKeys(conn net.Conn, msg *protocol.Message) error {
-	keys := s.cache.Keys()
+func (s *Server) handleInspect(conn net.Conn, msg *protocol.Message, ns string) error {
+	info, err := s.cache.Inspect(msg.Key)
+	if err != nil {
+		return err
+	}
+	_, key := splitKey([]byte(info.Key))
+	info.Key = string(key)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// defaultHotKeys is how many keys HOTKEYS returns without a count.
+const defaultHotKeys = 10
+
+// handleHotKeys ranks only the keys in the connection's namespace, so it may
+// return fewer than asked for even when other namespaces have more.
+func (s *Server) handleHotKeys(conn net.Conn, msg *protocol.Message, ns string) error {
+	n := msg.Count
+	if n == 0 {
+		n = defaultHotKeys
+	}
+	all, err := s.cache.HotKeys(cache.MaxHotKeys)
+	if err != nil {
+		return err
+	}
+	keys := make([]cache.KeyAccess, 0, n)
+	for _, k := range all {
+		if kns, local := splitKey([]byte(k.Key)); kns == ns && len(keys) < n {
+			k.Key = string(local)
+			keys = append(keys, k)
+		}
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// handleDump writes key's DUMP payload, base64-encoded so it can be passed
+// straight back to RESTORE. Without a key it exports the whole cache.
+func (s *Server) handleDump(conn net.Conn, msg *protocol.Message) error {
+	if msg.Key == nil {
+		return s.handleExport(conn)
+	}
+	payload, err := s.cache.Dump(msg.Key)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(base64.StdEncoding.EncodeToString(payload)))
+	return err
+}
+
+func (s *Server) handleRestore(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if err := s.cache.Restore(msg.Key, msg.Value, msg.Replace); err != nil {
+		return err
+	}
+	s.publish(protocol.EventSet, msg.Key)
+	if s.isLeader() {
+		s.replicateKeys(msg.Key)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte("OK"))
+	return err
+}
+
+// handleKeys writes every key in a single response, which can be very large
+// on a big cache. Clients should page with SCAN instead.
+func (s *Server) handleKeys(ctx context.Context, conn net.Conn, msg *protocol.Message, ns string) error {
+	keys, err := s.cache.KeysMatchingCtx(ctx, msg.Pattern)
+	if err != nil {
+		return err
+	}
+	keys = keysIn(ns, keys)
+	keyStrings := make([]string, len(keys))
+	for i, k := range keys {
+		keyStrings[i] = string(k)
+	}
+	_, err = conn.Write([]byte(strings.Join(keyStrings, ",")))
+	return err
+}
+
+// handleDBSize writes how many live keys the cache holds, in every namespace.
+func (s *Server) handleDBSize(conn net.Conn, msg *protocol.Message) error {
+	_, err := conn.Write([]byte(strconv.Itoa(s.cache.DBSize())))
+	return err
+}
+
+// randomKeyTries is how many random keys RANDOMKEY looks at for one in the
+// connection's namespace.
+const randomKeyTries = 8
+
+// handleRandomKey writes a random key from the connection's namespace, or
+// nothing if it is empty. Most caches only use one namespace, so a few random
+// picks nearly always find one; only if they don't is the namespace listed.
+func (s *Server) handleRandomKey(conn net.Conn, msg *protocol.Message, ns string) error {
+	var key []byte
+	for range randomKeyTries {
+		k := s.cache.RandomKey()
+		if k == nil {
+			break
+		}
+		if kns, local := splitKey(k); kns == ns {
+			key = local
+			break
+		}
+	}
+	if key == nil && s.cache.DBSize() > 0 {
+		if keys := keysIn(ns, s.cache.Keys()); len(keys) > 0 {
+			key = keys[rand.IntN(len(keys))]
+		}
+	}
+	_, err := conn.Write(key)
+	return err
+}
+
+type metricsResponse struct {
+	*cache.CacheMetrics
+	UptimeSeconds            int64                  `json:"uptimeSeconds"`
+	ConnectedClients         int                    `json:"connectedClients"`
+	TotalConnectionsAccepted uint64                 `json:"totalConnectionsAccepted"`
+	LastSaveTime             *time.Time             `json:"lastSaveTime,omitempty"`
+	LastSaveDurationMs       int64                  `json:"lastSaveDurationMs"`
+	ThrottledCommands        uint64                 `json:"throttledCommands"`
+	DelayedCommands          uint64                 `json:"delayedCommands"`
+	Commands                 map[string]commandStat `json:"commands"`
+	Replication              replicationMetrics     `json:"replication"`
+}
+
+// handleScan writes the next cursor followed by one page of keys. Keys in
+// other namespaces are left out, so a page may come back short, or even
+// empty, before the scan is over.
+func (s *Server) handleScan(conn net.Conn, msg *protocol.Message, ns string) error {
+	keys, next := s.cache.Scan(msg.Cursor, msg.Count)
+	keys = keysIn(ns, keys)
 	keyStrings := make([]string, len(keys))
 	for i, k := range keys {
 		keyStrings[i] = string(k)
 	}
-	_, err := conn.Write([]byte(strings.Join(keyStrings, ",")))
+	_, err := conn.Write([]byte(fmt.Sprintf("%d %s", next, strings.Join(keyStrings, ","))))
 	return err
 }
 
 func (s *Server) handleMetrics(conn net.Conn, msg *protocol.Message) error {
-	metrics := s.cache.Metrics()
-	data, err := json.Marshal(metrics)
+	data, err := json.Marshal(s.metrics())
 	if err != nil {
 		return err
 	}
@@ -205,41 +1015,179 @@ func (s *Server) handleMetrics(conn net.Conn, msg *protocol.Message) error {
 	return err
 }
 
-func (s *Server) handleBatch(conn net.Conn, msg *protocol.Message) error {
-	if err := s.cache.BatchSet(msg.Pairs, msg.TTL); err != nil {
+// metrics gathers what METRICS and the HTTP gateway's /metrics-json report.
+func (s *Server) metrics() metricsResponse {
+	metrics := metricsResponse{
+		CacheMetrics:             s.cache.Metrics(),
+		UptimeSeconds:            int64(time.Since(s.started).Seconds()),
+		ConnectedClients:         s.connectedClients(),
+		TotalConnectionsAccepted: s.accepted.Load(),
+		ThrottledCommands:        s.throttled.Load(),
+		DelayedCommands:          s.delayed.Load(),
+		Commands:                 s.stats.snapshot(),
+		Replication:              s.replicationMetrics(),
+	}
+	if last := s.lastSave.Load(); last != 0 {
+		t := time.Unix(0, last)
+		metrics.LastSaveTime = &t
+		metrics.LastSaveDurationMs = time.Duration(s.lastSaveDuration.Load()).Milliseconds()
+	}
+	return metrics
+}
+
+// checkBatchSize rejects a BATCH or MSETNX over MaxBatchPairs.
+func (s *Server) checkBatchSize(msg *protocol.Message) error {
+	if s.opts.MaxBatchPairs > 0 && len(msg.Pairs) > s.opts.MaxBatchPairs {
+		return fmt.Errorf("%s has %d pairs, more than the limit of %d; split it into smaller batches", msg.Cmd, len(msg.Pairs), s.opts.MaxBatchPairs)
+	}
+	return nil
+}
+
+func (s *Server) handleBatch(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if err := s.checkBatchSize(msg); err != nil {
 		return err
 	}
-	if s.opts.IsLeader {
-		go s.replicateToFollowers(context.Background(), msg)
+	err := s.cache.BatchSet(msg.Pairs, msg.TTL)
+	var batchErr *cache.BatchError
+	if err != nil && !(errors.As(err, &batchErr) && batchErr.Applied) {
+		return err
 	}
-	_, err := conn.Write([]byte("OK"))
+
+	// Only what was actually written gets published and replicated.
+	applied := make([][]byte, 0, len(msg.Pairs))
+	for k := range msg.Pairs {
+		if batchErr != nil && batchErr.Rejected[k] != nil {
+			continue
+		}
+		applied = append(applied, []byte(k))
+		s.publish(protocol.EventSet, []byte(k))
+	}
+	if s.isLeader() {
+		s.replicateKeys(applied...)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("OK"))
 	return err
 }
 
-func (s *Server) replicateToFollowers(ctx context.Context, msg *protocol.Message) {
-	raw := msg.ToBytes()
+// handleMSetNX replies 1 if it wrote the batch and 0 if some key already
+// existed, in which case there is nothing to publish or replicate.
+func (s *Server) handleMSetNX(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
+	if err := s.checkBatchSize(msg); err != nil {
+		return err
+	}
+	written, err := s.cache.BatchSetNX(msg.Pairs, msg.TTL)
+	if err != nil {
+		return err
+	}
+	if !written {
+		_, err = conn.Write([]byte("0"))
+		return err
+	}
+	keys := make([][]byte, 0, len(msg.Pairs))
+	for k := range msg.Pairs {
+		keys = append(keys, []byte(k))
+		s.publish(protocol.EventSet, []byte(k))
+	}
+	if s.isLeader() {
+		s.replicateKeys(keys...)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("1"))
+	return err
+}
+
+// replicateKeys sends followers the current state of keys as RESTOREs,
+// versions included, which they apply only over an older version. Sending
+// state rather than the command that produced it keeps versions identical
+// across the cluster, and means two writes to a key replicated out of order
+// still leave followers with the later one.
+//
+// Each key is dumped and queued under s.mu, so what is queued is the key's
+// state at that point in the replication order: a RESTORE of a value a
+// concurrent delete has since removed can't be queued behind that delete's
+// DEL and bring the key back on followers.
+func (s *Server) replicateKeys(keys ...[]byte) {
+	var lagging []net.Conn
 	s.mu.Lock()
-	followers := make([]net.Conn, 0, len(s.followers))
-	for conn := range s.followers {
-		followers = append(followers, conn)
+	for _, key := range keys {
+		payload, err := s.cache.Dump(key)
+		if err != nil {
+			continue // gone already; its DEL is replicated separately
+		}
+		lagging = append(lagging, s.queueReplicated(&protocol.Message{
+			Cmd: protocol.CMDRestore, Key: key, Value: payload, Replace: true,
+		})...)
 	}
 	s.mu.Unlock()
+	s.dropLagging(lagging)
+}
 
-	for _, conn := range followers {
-		for attempt := 1; attempt <= s.maxRetries; attempt++ {
-			if _, err := conn.Write(raw); err != nil {
-				log.Printf("Replication to %s failed (attempt %d/%d): %v",
-					conn.RemoteAddr(), attempt, s.maxRetries, err)
-				if attempt == s.maxRetries {
-					conn.Close()
-					s.mu.Lock()
-					delete(s.followers, conn)
-					s.mu.Unlock()
-				}
-				time.Sleep(s.retryDelay)
-				continue
-			}
-			break
+// replicateDeletes tells followers keys were removed. Like replicateKeys it
+// looks at each key under s.mu: one still gone is queued as a DEL, but one
+// set again since it was removed is queued as a RESTORE of its new state,
+// since the SET that wrote it may already have queued its own RESTORE, and a
+// DEL behind that would remove the key from followers but not the leader.
+func (s *Server) replicateDeletes(keys ...[]byte) {
+	var lagging []net.Conn
+	s.mu.Lock()
+	for _, key := range keys {
+		op := &protocol.Message{Cmd: protocol.CMDDel, Key: key}
+		if payload, err := s.cache.Dump(key); err == nil {
+			op = &protocol.Message{Cmd: protocol.CMDRestore, Key: key, Value: payload, Replace: true}
+		}
+		lagging = append(lagging, s.queueReplicated(op)...)
+	}
+	s.mu.Unlock()
+	s.dropLagging(lagging)
+}
+
+// replicateToFollowers queues msg on every follower's replication queue
+// without blocking. A follower whose queue is full has fallen too far behind
+// and is dropped; it will resync when it reconnects.
+func (s *Server) replicateToFollowers(ctx context.Context, msg *protocol.Message) {
+	s.mu.Lock()
+	lagging := s.queueReplicated(msg)
+	s.mu.Unlock()
+	s.dropLagging(lagging)
+}
+
+// queueReplicated numbers msg as the next replicated operation and queues it
+// for every follower, returning those whose queues were full. Callers must
+// hold s.mu.
+func (s *Server) queueReplicated(msg *protocol.Message) []net.Conn {
+	op := *msg
+	op.Replicated = true
+	s.replOffset++
+	op.Seq = s.replOffset
+	raw := append(op.ToBytes(), '\n')
+	var lagging []net.Conn
+	now := time.Now()
+	for conn, f := range s.followers {
+		if !f.enqueue(raw) {
+			lagging = append(lagging, conn)
+			s.replFailures.Add(1)
+			continue
+		}
+		if f.acked >= f.sent {
+			f.behindSince = now
 		}
+		f.sent++
+	}
+	return lagging
+}
+
+// dropLagging drops the followers queueReplicated found too far behind.
+func (s *Server) dropLagging(lagging []net.Conn) {
+	for _, conn := range lagging {
+		s.logger.Warn("replication queue full, dropping follower", "follower", conn.RemoteAddr())
+		s.dropFollower(conn)
 	}
 }
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"distributedCache/cache"
+	"distributedCache/protocol"
+)
+
+// startTestServer starts a server on a free loopback port, in front of a
+// cache made with cacheOpts, closing it when the test ends. It is a leader
+// unless opts.LeaderAddr is set.
+func startTestServer(t testing.TB, opts Options, cacheOpts ...cache.Option) *Server {
+	t.Helper()
+	opts.ListenAddr = "127.0.0.1:0"
+	opts.IsLeader = opts.LeaderAddr == ""
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	s := New(opts, cache.NewCache(cacheOpts...))
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	t.Cleanup(func() {
+		s.Close()
+		<-errc
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); s.Addr() == nil; {
+		select {
+		case err := <-errc:
+			t.Fatalf("Start: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s
+}
+
+// testConn is a client connection speaking the framed protocol.
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialTestServer(t testing.TB, s *Server) *testConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &testConn{Conn: nc, r: bufio.NewReader(nc)}
+	if _, err := c.do(t, "HELLO 2"); err != nil {
+		t.Fatalf("HELLO: %v", err)
+	}
+	return c
+}
+
+// send writes one command line without waiting for its reply.
+func (c *testConn) send(t testing.TB, line string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, line+"\n"); err != nil {
+		t.Fatalf("sending %q: %v", line, err)
+	}
+}
+
+// read reads one reply. A reply that is an error comes back as a
+// *protocol.ResponseError; any other error fails the test.
+func (c *testConn) read(t testing.TB) ([]byte, error) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	payload, err := protocol.ReadFrame(c.r)
+	var respErr *protocol.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return payload, err
+}
+
+// do sends one command and reads its reply.
+func (c *testConn) do(t testing.TB, line string) ([]byte, error) {
+	t.Helper()
+	c.send(t, line)
+	return c.read(t)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	s := startTestServer(t, Options{})
+
+	// An unframed connection, as from the REPL, must get an answer rather
+	// than wait forever, and stay usable after it.
+	nc, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	buf := make([]byte, 256)
+	for _, step := range []struct{ send, want string }{
+		{"FOOBAR key", `ERROR: unknown command "FOOBAR"`},
+		{"PING", "PONG\n"},
+	} {
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(nc, step.send+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		n, err := nc.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", step.send, err)
+		}
+		if got := string(buf[:n]); got != step.want {
+			t.Fatalf("%s replied %q, want %q", step.send, got, step.want)
+		}
+	}
+
+	c := dialTestServer(t, s)
+	if _, err := c.do(t, "FOOBAR key"); err == nil || err.Error() != `unknown command "FOOBAR"` {
+		t.Fatalf("framed FOOBAR replied %v, want an unknown command error", err)
+	}
+	if _, err := c.do(t, "PING"); err != nil {
+		t.Fatalf("PING after FOOBAR: %v", err)
+	}
+}
+
+// TestMissReply checks misses get the fixed replies clients match on,
+// whichever command found the key missing. Each reads a different key, since
+// with negative caching a Get that misses marks its key absent.
+func TestMissReply(t *testing.T) {
+	s := startTestServer(t, Options{}, cache.WithNegativeCaching(time.Hour))
+	c := dialTestServer(t, s)
+	if _, err := c.do(t, "SETABSENT gone"); err != nil {
+		t.Fatalf("SETABSENT: %v", err)
+	}
+	for _, tt := range []struct{ line, want string }{
+		{"GET a", protocol.ReplyNotFound},
+		{"GET b WITHVERSION", protocol.ReplyNotFound},
+		{"GETDEL c", protocol.ReplyNotFound},
+		{"RENAME d other", protocol.ReplyNotFound},
+		{"GET gone", protocol.ReplyKnownAbsent},
+	} {
+		if _, err := c.do(t, tt.line); err == nil || err.Error() != tt.want {
+			t.Errorf("%s replied %v, want %s", tt.line, err, tt.want)
+		}
+	}
+}
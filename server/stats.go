@@ -0,0 +1,320 @@
+package server
+
+import (
+	"distributedCache/protocol"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLatencyBuckets are the upper bounds of the command latency
+// histogram unless Options.LatencyBuckets says otherwise.
+var defaultLatencyBuckets = []time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second,
+}
+
+// ParseLatencyBuckets parses a comma-separated list of durations, e.g.
+// "100us,1ms,10ms", into histogram bucket bounds in ascending order.
+func ParseLatencyBuckets(s string) ([]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var bounds []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(part)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid latency bucket %q", part)
+		}
+		bounds = append(bounds, d)
+	}
+	slices.Sort(bounds)
+	return slices.Compact(bounds), nil
+}
+
+// commandStat is one command's totals as reported by METRICS and LATENCY.
+// Average latency is TotalLatencyMicros / Count. The percentiles are
+// estimated from the histogram, as the upper bound of the bucket they fall
+// in, or the slowest latency seen if that is beyond the last bound.
+type commandStat struct {
+	Count              uint64 `json:"count"`
+	Errors             uint64 `json:"errors"`
+	TotalLatencyMicros uint64 `json:"totalLatencyMicros"`
+	MaxLatencyMicros   uint64 `json:"maxLatencyMicros"`
+	P50Micros          uint64 `json:"p50Micros"`
+	P95Micros          uint64 `json:"p95Micros"`
+	P99Micros          uint64 `json:"p99Micros"`
+
+	// buckets counts latencies up to each bound, not cumulatively, with a
+	// last entry for those over every bound.
+	buckets []uint64
+}
+
+// commandCounters is the running total for one command. Recording only takes
+// atomic adds, so it doesn't skew the latencies it measures.
+type commandCounters struct {
+	count, errors, totalMicros, maxMicros atomic.Uint64
+	buckets                               []atomic.Uint64
+}
+
+type commandStats struct {
+	mu     sync.RWMutex // guards byCmd itself; the counters are atomic
+	bounds []time.Duration
+	byCmd  map[protocol.Command]*commandCounters
+}
+
+// counters returns cmd's counters, creating them the first time it runs.
+func (cs *commandStats) counters(cmd protocol.Command) *commandCounters {
+	cs.mu.RLock()
+	c, ok := cs.byCmd[cmd]
+	cs.mu.RUnlock()
+	if ok {
+		return c
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.byCmd == nil {
+		cs.byCmd = make(map[protocol.Command]*commandCounters)
+	}
+	if c, ok = cs.byCmd[cmd]; !ok {
+		c = &commandCounters{buckets: make([]atomic.Uint64, len(cs.bounds)+1)}
+		cs.byCmd[cmd] = c
+	}
+	return c
+}
+
+func (cs *commandStats) record(cmd protocol.Command, elapsed time.Duration, err error) {
+	i, _ := slices.BinarySearch(cs.bounds, elapsed)
+	c := cs.counters(cmd)
+	c.count.Add(1)
+	micros := uint64(elapsed.Microseconds())
+	c.totalMicros.Add(micros)
+	for {
+		seen := c.maxMicros.Load()
+		if micros <= seen || c.maxMicros.CompareAndSwap(seen, micros) {
+			break
+		}
+	}
+	c.buckets[i].Add(1)
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// reset drops every command's totals, so later reports only cover what runs
+// from now on.
+func (cs *commandStats) reset() {
+	cs.mu.Lock()
+	cs.byCmd = nil
+	cs.mu.Unlock()
+}
+
+// snapshot copies every command's stats, with percentiles filled in. A
+// command being recorded meanwhile may be counted in some totals and not yet
+// in others.
+func (cs *commandStats) snapshot() map[string]commandStat {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	out := make(map[string]commandStat, len(cs.byCmd))
+	for cmd, c := range cs.byCmd {
+		st := commandStat{
+			Count:              c.count.Load(),
+			Errors:             c.errors.Load(),
+			TotalLatencyMicros: c.totalMicros.Load(),
+			MaxLatencyMicros:   c.maxMicros.Load(),
+			buckets:            make([]uint64, len(c.buckets)),
+		}
+		for i := range c.buckets {
+			st.buckets[i] = c.buckets[i].Load()
+		}
+		st.P50Micros = cs.percentile(&st, 0.50)
+		st.P95Micros = cs.percentile(&st, 0.95)
+		st.P99Micros = cs.percentile(&st, 0.99)
+		out[string(cmd)] = st
+	}
+	return out
+}
+
+func (cs *commandStats) percentile(st *commandStat, p float64) uint64 {
+	var total uint64
+	for _, n := range st.buckets {
+		total += n
+	}
+	rank := uint64(p * float64(total))
+	var seen uint64
+	for i, n := range st.buckets {
+		seen += n
+		if seen > rank || (seen == total && seen > 0) {
+			if i == len(cs.bounds) {
+				return st.MaxLatencyMicros
+			}
+			return min(uint64(cs.bounds[i].Microseconds()), st.MaxLatencyMicros)
+		}
+	}
+	return 0
+}
+
+// latencyReport is one command's entry in the LATENCY reply: its totals and
+// percentiles, and the histogram they were estimated from.
+type latencyReport struct {
+	commandStat
+	Histogram []latencyBucket `json:"histogram"`
+}
+
+type latencyBucket struct {
+	Le    string `json:"le"`    // the bucket's upper bound as -latencybuckets takes it, or +Inf
+	Count uint64 `json:"count"` // latencies in this bucket alone, not cumulative
+}
+
+// handleLatency writes each command's latency histogram and percentiles as
+// JSON, or with LATENCY RESET, starts them over.
+func (s *Server) handleLatency(conn net.Conn, msg *protocol.Message) error {
+	if msg.Reset {
+		s.stats.reset()
+		_, err := conn.Write([]byte("OK"))
+		return err
+	}
+	stats := s.stats.snapshot()
+	report := make(map[string]latencyReport, len(stats))
+	for cmd, st := range stats {
+		r := latencyReport{commandStat: st, Histogram: make([]latencyBucket, len(st.buckets))}
+		for i, n := range st.buckets {
+			r.Histogram[i] = latencyBucket{Le: "+Inf", Count: n}
+			if i < len(s.stats.bounds) {
+				r.Histogram[i].Le = strings.ReplaceAll(s.stats.bounds[i].String(), "µ", "u")
+			}
+		}
+		report[cmd] = r
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// statsReport is the STATS reply: how the protocol and replication are
+// faring, where METRICS is about the cache.
+type statsReport struct {
+	Commands    map[string]commandCount `json:"commands"`
+	ParseErrors uint64                  `json:"parseErrors"`
+	BytesIn     uint64                  `json:"bytesIn"`
+	BytesOut    uint64                  `json:"bytesOut"`
+	Replication replicationStats        `json:"replication"`
+	Process     processStats            `json:"process"`
+}
+
+type commandCount struct {
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+}
+
+type replicationStats struct {
+	Replicated       uint64 `json:"replicated"`       // operations written to a follower
+	Failures         uint64 `json:"failures"`         // operations a follower never got because it was dropped
+	FollowersDropped uint64 `json:"followersDropped"` // followers cut off for lagging, missing heartbeats or failing writes
+	FollowersRefused uint64 `json:"followersRefused"` // followers turned away for being over -maxfollowers
+}
+
+type processStats struct {
+	Goroutines     uint64  `json:"goroutines"`
+	GCCycles       uint64  `json:"gcCycles"`
+	GCPauses       uint64  `json:"gcPauses"`
+	GCPauseSeconds float64 `json:"gcPauseSeconds"` // estimated from the runtime's pause histogram
+	HeapLiveBytes  uint64  `json:"heapLiveBytes"`
+}
+
+// handleStats writes a statsReport as JSON. Traffic counts both open
+// connections and those since closed, followers' replication links
+// included.
+func (s *Server) handleStats(conn net.Conn) error {
+	report := statsReport{
+		Commands:    make(map[string]commandCount),
+		ParseErrors: s.parseErrors.Load(),
+		BytesIn:     s.closedBytesIn.Load(),
+		BytesOut:    s.closedBytesOut.Load(),
+		Replication: replicationStats{
+			Replicated:       s.replicated.Load(),
+			Failures:         s.replFailures.Load(),
+			FollowersDropped: s.followersDropped.Load(),
+			FollowersRefused: s.followersRefused.Load(),
+		},
+		Process: readProcessStats(),
+	}
+	for cmd, st := range s.stats.snapshot() {
+		report.Commands[cmd] = commandCount{Count: st.Count, Errors: st.Errors}
+	}
+	s.connsMu.RLock()
+	for c := range s.conns {
+		report.BytesIn += c.bytesIn.Load()
+		report.BytesOut += c.bytesOut.Load()
+	}
+	s.connsMu.RUnlock()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func readProcessStats() processStats {
+	samples := []metrics.Sample{
+		{Name: "/sched/goroutines:goroutines"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/sched/pauses/total/gc:seconds"},
+	}
+	metrics.Read(samples)
+	var ps processStats
+	for _, sample := range samples {
+		switch v := sample.Value; v.Kind() {
+		case metrics.KindUint64:
+			switch sample.Name {
+			case "/sched/goroutines:goroutines":
+				ps.Goroutines = v.Uint64()
+			case "/gc/cycles/total:gc-cycles":
+				ps.GCCycles = v.Uint64()
+			case "/gc/heap/live:bytes":
+				ps.HeapLiveBytes = v.Uint64()
+			}
+		case metrics.KindFloat64Histogram:
+			ps.GCPauses, ps.GCPauseSeconds = histogramTotal(v.Float64Histogram())
+		}
+	}
+	return ps
+}
+
+// histogramTotal returns how many samples h holds and roughly what they add
+// up to, taking each as the middle of its bucket, or the bucket's finite
+// bound if it is open-ended.
+func histogramTotal(h *metrics.Float64Histogram) (uint64, float64) {
+	var (
+		n   uint64
+		sum float64
+	)
+	for i, count := range h.Counts {
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		mid := (lo + hi) / 2
+		switch {
+		case math.IsInf(lo, -1):
+			mid = hi
+		case math.IsInf(hi, 1):
+			mid = lo
+		}
+		n += count
+		sum += float64(count) * mid
+	}
+	return n, sum
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"distributedCache/cache"
+	"distributedCache/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// transaction holds the writes a connection has queued since MULTI. Only the
+// connection's read loop touches it: every line of a transaction is handled
+// there, in order, rather than on a goroutine of its own.
+type transaction struct {
+	ops    []*protocol.Message
+	failed error // the first command that couldn't be queued; EXEC refuses to run
+}
+
+// inTransaction handles line if it is MULTI, EXEC or DISCARD, or is sent
+// between MULTI and EXEC, and reports whether it was.
+func (s *Server) inTransaction(conn *client, line []byte) bool {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return false
+	}
+	switch protocol.Command(fields[0]) {
+	case protocol.CMDMulti, protocol.CMDExec, protocol.CMDDiscard:
+		s.handleCommand(conn, line)
+		return true
+	}
+	if conn.tx == nil {
+		return false
+	}
+	s.queueCommand(conn, line)
+	return true
+}
+
+// queueCommand adds a command to the connection's transaction and replies
+// QUEUED. Only SET and DEL can be queued.
+func (s *Server) queueCommand(conn *client, line []byte) {
+	conn.commands.Add(1)
+	msg, err := protocol.ParseCommand(line)
+	if err == nil {
+		switch {
+		case msg.Replicated:
+			err = errors.New("replicated operations are only accepted from the leader")
+		case msg.Cmd != protocol.CMDSet && msg.Cmd != protocol.CMDDel:
+			err = fmt.Errorf("%s can't be used in a transaction", msg.Cmd)
+		default:
+			if err = s.checkOwner(msg); err == nil {
+				err = s.scope(conn, msg)
+			}
+		}
+	}
+	if err != nil {
+		if conn.tx.failed == nil {
+			conn.tx.failed = err
+		}
+		conn.reply(nil, err)
+		return
+	}
+	conn.tx.ops = append(conn.tx.ops, msg)
+	conn.reply([]byte(protocol.Queued), nil)
+}
+
+func (s *Server) handleMulti(conn *client, w net.Conn) error {
+	if conn.tx != nil {
+		return errors.New("MULTI calls can't be nested")
+	}
+	conn.tx = &transaction{}
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+func (s *Server) handleDiscard(conn *client, w net.Conn) error {
+	if conn.tx == nil {
+		return errors.New("DISCARD without MULTI")
+	}
+	conn.tx = nil
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+// handleExec applies the queued writes in one step and replies with each
+// one's result: OK for a SET, and 1 or 0 for a DEL, as they would on their
+// own. Followers are sent the state the transaction left its keys in as a
+// single EXEC, so they apply it in one step too.
+func (s *Server) handleExec(ctx context.Context, conn *client, w net.Conn) error {
+	tx := conn.tx
+	if tx == nil {
+		return errors.New("EXEC without MULTI")
+	}
+	conn.tx = nil
+	if tx.failed != nil {
+		return fmt.Errorf("transaction discarded because of an earlier error: %w", tx.failed)
+	}
+	if len(tx.ops) > 0 {
+		if err := s.checkReplicaLag(); err != nil {
+			return fmt.Errorf("transaction discarded: %w", err)
+		}
+	}
+
+	ops := make([]cache.Operation, len(tx.ops))
+	for i, msg := range tx.ops {
+		ops[i] = cache.Operation{Kind: cache.OpSet, Key: msg.Key, Value: msg.Value, TTL: msg.TTL}
+		if msg.Cmd == protocol.CMDDel {
+			ops[i] = cache.Operation{Kind: cache.OpDelete, Key: msg.Key}
+		}
+	}
+	applied, err := s.cache.ApplyBatch(ops)
+	if err != nil {
+		return err
+	}
+
+	results := make([][]byte, len(ops))
+	found := make([]bool, len(ops))
+	var keys [][]byte
+	seen := make(map[string]bool)
+	for i, op := range ops {
+		found[i] = true
+		switch {
+		case op.Kind == cache.OpSet:
+			results[i] = []byte("OK")
+			s.publish(protocol.EventSet, op.Key)
+		case applied[i]:
+			results[i] = []byte("1")
+		default:
+			results[i] = []byte("0")
+		}
+		if !seen[string(op.Key)] {
+			seen[string(op.Key)] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	if s.isLeader() {
+		s.replicateTransaction(keys)
+	}
+	if err := s.awaitWriteConcern(ctx); err != nil {
+		return err
+	}
+	_, err = w.Write(protocol.EncodeMulti(results, found))
+	return err
+}
+
+// replicateTransaction sends followers the current state of keys as one
+// EXEC: a versioned RESTORE for each key that exists and a DEL for each that
+// doesn't.
+func (s *Server) replicateTransaction(keys [][]byte) {
+	msg := &protocol.Message{Cmd: protocol.CMDExec}
+	// As in replicateKeys, dumping under s.mu keeps a concurrent delete's
+	// DEL from being queued ahead of the state it removed.
+	s.mu.Lock()
+	for _, key := range keys {
+		op := &protocol.Message{Cmd: protocol.CMDDel, Key: key}
+		if payload, err := s.cache.Dump(key); err == nil {
+			op = &protocol.Message{Cmd: protocol.CMDRestore, Key: key, Value: payload, Replace: true}
+		}
+		msg.Ops = append(msg.Ops, op)
+	}
+	lagging := s.queueReplicated(msg)
+	s.mu.Unlock()
+	s.dropLagging(lagging)
+}
+
+// applyTransaction applies a transaction replicated by the leader.
+func (s *Server) applyTransaction(msg *protocol.Message) error {
+	ops := make([]cache.Operation, len(msg.Ops))
+	for i, m := range msg.Ops {
+		switch m.Cmd {
+		case protocol.CMDRestore:
+			op, err := cache.DumpOperation(m.Key, m.Value)
+			if err != nil {
+				return err
+			}
+			ops[i] = op
+		case protocol.CMDDel:
+			ops[i] = cache.Operation{Kind: cache.OpDelete, Key: m.Key}
+		default:
+			return fmt.Errorf("unsupported operation %s in replicated transaction", m.Cmd)
+		}
+	}
+	applied, err := s.cache.ApplyBatch(ops)
+	if err != nil {
+		return err
+	}
+	for i, op := range ops {
+		if op.Kind == cache.OpSet && applied[i] {
+			s.publish(protocol.EventSet, op.Key)
+		}
+	}
+	return nil
+}
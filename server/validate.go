@@ -0,0 +1,65 @@
+package server
+
+import (
+	"distributedCache/protocol"
+	"encoding/json"
+	"net"
+	"reflect"
+	"time"
+)
+
+// handleValidate parses the command VALIDATE carries without running it and
+// writes what it was parsed into as JSON, or fails with the parse error the
+// command itself would get.
+func (s *Server) handleValidate(conn net.Conn, msg *protocol.Message) error {
+	parsed, err := protocol.ParseCommand(msg.Value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(messageFields(parsed))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// messageFields maps the name of every field set in m to its value, with
+// keys and values as strings rather than base64 and TTLs as durations.
+func messageFields(m *protocol.Message) map[string]any {
+	fields := make(map[string]any)
+	v := reflect.ValueOf(m).Elem()
+	for i := range v.NumField() {
+		if v.Field(i).IsZero() {
+			continue
+		}
+		name := v.Type().Field(i).Name
+		switch x := v.Field(i).Interface().(type) {
+		case []byte:
+			fields[name] = string(x)
+		case [][]byte:
+			strs := make([]string, len(x))
+			for j, b := range x {
+				strs[j] = string(b)
+			}
+			fields[name] = strs
+		case map[string][]byte:
+			strs := make(map[string]string, len(x))
+			for k, b := range x {
+				strs[k] = string(b)
+			}
+			fields[name] = strs
+		case []*protocol.Message:
+			ops := make([]map[string]any, len(x))
+			for j, op := range x {
+				ops[j] = messageFields(op)
+			}
+			fields[name] = ops
+		case time.Duration:
+			fields[name] = x.String()
+		default:
+			fields[name] = x
+		}
+	}
+	return fields
+}
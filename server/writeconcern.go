@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"distributedCache/protocol"
+	"fmt"
+	"net"
+	"time"
+)
+
+// WriteConcern is how many followers must acknowledge a write before the
+// leader replies to it.
+type WriteConcern byte
+
+const (
+	// WriteAsync replies once the leader has applied the write, so a leader
+	// crash can lose writes that were already acknowledged.
+	WriteAsync  WriteConcern = iota
+	WriteOne                 // at least one follower
+	WriteQuorum              // enough followers to make a majority with the leader
+	WriteAll                 // every follower connected at the time of the write
+)
+
+func (w WriteConcern) String() string {
+	switch w {
+	case WriteAsync:
+		return "async"
+	case WriteOne:
+		return "one"
+	case WriteQuorum:
+		return "quorum"
+	case WriteAll:
+		return "all"
+	}
+	return fmt.Sprintf("WriteConcern(%d)", byte(w))
+}
+
+// ParseWriteConcern maps a name such as "quorum" to a WriteConcern.
+func ParseWriteConcern(name string) (WriteConcern, error) {
+	switch name {
+	case "", "async":
+		return WriteAsync, nil
+	case "one":
+		return WriteOne, nil
+	case "quorum":
+		return WriteQuorum, nil
+	case "all":
+		return WriteAll, nil
+	}
+	return 0, fmt.Errorf("unsupported write concern %q (want async, one, quorum or all)", name)
+}
+
+// needed is how many of n followers must acknowledge a write.
+func (w WriteConcern) needed(n int) int {
+	switch w {
+	case WriteOne:
+		return 1
+	case WriteQuorum:
+		return (n + 1) / 2
+	case WriteAll:
+		return n
+	}
+	return 0
+}
+
+// awaitWriteConcern waits until enough followers have applied everything
+// queued for them so far, which includes the write the caller just
+// replicated. Followers are counted as of the call; one that drops out
+// meanwhile never acknowledges. Giving up leaves the write applied on the
+// leader and on whichever followers it reached.
+func (s *Server) awaitWriteConcern(ctx context.Context) error {
+	if s.opts.WriteConcern == WriteAsync || !s.isLeader() {
+		return nil
+	}
+
+	s.mu.Lock()
+	targets := make(map[net.Conn]uint64, len(s.followers))
+	for conn, f := range s.followers {
+		targets[conn] = f.sent
+	}
+	s.mu.Unlock()
+	need := s.opts.WriteConcern.needed(len(targets))
+
+	timer := time.NewTimer(s.opts.AckTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		acked := 0
+		for conn, target := range targets {
+			if f, ok := s.followers[conn]; ok && f.acked >= target {
+				acked++
+			}
+		}
+		signal := s.acks
+		s.mu.Unlock()
+		if acked >= need {
+			return nil
+		}
+		if need > len(targets) {
+			return fmt.Errorf("write concern %s not met: applied on the leader, but there are only %d followers to acknowledge it", s.opts.WriteConcern, len(targets))
+		}
+
+		select {
+		case <-signal:
+		case <-timer.C:
+			return fmt.Errorf("write concern %s not met: applied on the leader, but only %d of %d required followers acknowledged it within %s",
+				s.opts.WriteConcern, acked, need, s.opts.AckTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isWrite reports whether msg changes the cache, for checkReplicaLag. EXEC
+// is checked by handleExec instead, since it depends on what was queued.
+func isWrite(msg *protocol.Message) bool {
+	switch msg.Cmd {
+	case protocol.CMDSet, protocol.CMDCas, protocol.CMDCasVersion, protocol.CMDDel, protocol.CMDMDel,
+		protocol.CMDRename, protocol.CMDCopy, protocol.CMDAppend, protocol.CMDGetDel,
+		protocol.CMDGetEx, protocol.CMDSetAbsent, protocol.CMDRestore, protocol.CMDBatch, protocol.CMDMSetNX,
+		protocol.CMDTouch:
+		return true
+	case protocol.CMDSnapshot:
+		return msg.Load
+	}
+	return false
+}
+
+// checkReplicaLag refuses a write on a leader with MinReplicasMaxLag set
+// unless some follower is within it, so that a leader cut off from its
+// followers stops taking writes it would be the only one to have.
+func (s *Server) checkReplicaLag() error {
+	if s.opts.MinReplicasMaxLag <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.leading {
+		return nil
+	}
+	if len(s.followers) == 0 {
+		return fmt.Errorf("writes refused: no followers are connected, and -min-replicas-max-lag is %s", s.opts.MinReplicasMaxLag)
+	}
+	now := time.Now()
+	for _, f := range s.followers {
+		if f.lag(now) <= s.opts.MinReplicasMaxLag {
+			return nil
+		}
+	}
+	return fmt.Errorf("writes refused: every follower is more than -min-replicas-max-lag (%s) behind", s.opts.MinReplicasMaxLag)
+}
+
+// recordAck notes that f has applied offset operations, up to sequence
+// number seq, and wakes writes waiting on acknowledgements. Callers must
+// hold s.mu.
+func (s *Server) recordAck(f *follower, offset, seq uint64) {
+	f.lastAck = time.Now()
+	f.ackedSeq = max(f.ackedSeq, seq)
+	if offset <= f.acked {
+		return
+	}
+	f.acked = offset
+	close(s.acks)
+	s.acks = make(chan struct{})
+}